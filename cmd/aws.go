@@ -0,0 +1,865 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	ui "github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+	log "github.com/sirupsen/logrus"
+	"github.com/threetoes/tunneller/internal"
+)
+
+var regions = []string{
+	"us-east-1",
+	"us-east-2",
+	"us-west-1",
+	"us-west-2",
+	"af-south-1",
+	"ap-east-1",
+	"ap-south-1",
+	"ap-northeast-2",
+	"ap-southeast-1",
+	"ap-southeast-2",
+	"ap-northeast-1",
+	"ca-central-1",
+	"eu-central-1",
+	"eu-west-1",
+	"eu-west-2",
+	"eu-south-1",
+	"eu-west-3",
+	"eu-north-1",
+	"me-south-1",
+	"sa-east-1",
+}
+
+// awsEndpoints walks the user through picking a region, profile, RDS target
+// and EC2 bastion, and returns the bastion and the database endpoints to
+// tunnel to, which are a cluster's writer and reader if both were chosen
+func awsEndpoints(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags, prof internal.Profiles,
+	authConfig *internal.AuthConfig, pendingKeys *internal.PendingKeys, proxy *internal.Proxy,
+	sshOpts *sshOptions) (internal.EndpointIface, []tunnelTarget) {
+	statusLabel.Text = "Choose a region"
+	var options []string
+	var selectedRegion string
+	if f.region == "" {
+		optionsList.Rows = regions
+		if handleListSelect(statusLabel, optionsList) {
+			quit()
+		}
+		selectedRegion = regions[optionsList.SelectedRow]
+	} else {
+		selectedRegion = f.region
+	}
+
+	profileContainers := prof.GetProfiles()
+	var selectedProfile internal.ProfileContainer
+	for i, p := range profileContainers {
+		if p.GetName() == f.profile {
+			selectedProfile = p
+			break
+		}
+		options = append(options, fmt.Sprintf("[%d] %s", i, p.GetName()))
+	}
+
+	if selectedProfile == nil {
+		optionsList.Rows = options
+		statusLabel.Text = "Choose a profile"
+		if handleListSelect(statusLabel, optionsList) {
+			quit()
+		}
+		selectedProfile = profileContainers[optionsList.SelectedRow]
+		statusLabel.Text = fmt.Sprintf("Chose profile %s. Connecting", selectedProfile.GetName())
+		ui.Clear()
+		ui.Render(statusLabel)
+	}
+
+	if err := selectedProfile.Connect(selectedRegion); err != nil {
+		fatal(statusLabel, fmt.Sprintf("Error connecting profile to region %s", selectedRegion), err)
+	}
+
+	dbSvc, err := selectedProfile.GetRDSService()
+	if err != nil {
+		fatal(statusLabel, "Could not initialise RDS service", err)
+	}
+	statusLabel.Text = "Connected, fetching RDS instances and clusters..."
+	ui.Clear()
+	ui.Render(statusLabel)
+	selectedTargets := selectDatabase(statusLabel, optionsList, f, dbSvc)
+	if f.restore != "" {
+		selectedTargets = restoreDatabase(statusLabel, optionsList, f, dbSvc, selectedTargets[0])
+	} else if selectedTargets[0].IsStopped() {
+		selectedTargets = startDatabase(statusLabel, optionsList, f, dbSvc, selectedTargets)
+	}
+	// The first target's instance stands for the network placement of all
+	// of them, as they are in the same cluster
+	selectedDb := selectedTargets[0].Instance
+
+	statusLabel.Text = fmt.Sprintf("Chose %s. Finding bastions that can reach it...", selectedTargets[0].Address)
+	ui.Clear()
+	ui.Render(statusLabel)
+	ecSvc, err := selectedProfile.GetEC2Service()
+	if err != nil {
+		fatal(statusLabel, "Could not get EC2 instances", err)
+	}
+	var selectedBastion *ec2.Instance
+	addressMode := internal.AddressMode(f.bastionAddress)
+	startedBastion := false
+	if f.ephemeral {
+		selectedBastion = launchBastion(statusLabel, f, selectedProfile, ecSvc, selectedDb, proxy)
+		startedBastion = true
+		leaseBastion(ecSvc, *selectedBastion.InstanceId)
+	} else {
+		selectedBastion, addressMode = selectBastion(statusLabel, optionsList, f, ecSvc,
+			internal.NewBastionRanker(context.Background(), ecSvc, selectedDb))
+		if internal.IsStopped(selectedBastion) {
+			selectedBastion = startBastion(statusLabel, optionsList, f, ecSvc, selectedBastion)
+			startedBastion = true
+		} else {
+			leaseBastion(ecSvc, *selectedBastion.InstanceId)
+		}
+	}
+
+	// A temporary bastion's path is set up by launching it
+	if f.checkPath && !f.ephemeral {
+		checkPath(statusLabel, optionsList, ecSvc, selectedBastion, selectedDb)
+	}
+
+	ui.Clear()
+	statusLabel.Text = fmt.Sprintf("Selected %s as the bastion. Tunnelling in", *selectedBastion.InstanceId)
+	ui.Render(statusLabel)
+	cnnct, err := selectedProfile.GetEC2InstanceConnectService()
+	if err != nil {
+		fatal(statusLabel, "Could not get ec2instanceconnect session", err)
+	}
+
+	ec2Endpoint, err := internal.NewEC2Endpoint(*selectedBastion.InstanceId, pendingKeys, ecSvc, cnnct)
+	if err != nil {
+		fatal(statusLabel, "Could not configure bastion endpoint", err)
+	}
+	ec2Endpoint.Auth = authConfig
+	// Some bastions' sshd is too old for ED25519 keys, so an RSA key is
+	// generated if the bastion rejects it
+	if ec2Endpoint.KeyType == internal.KeyTypeED25519 {
+		ec2Endpoint.FallbackKeyType = internal.KeyTypeRSA
+	}
+	ec2Endpoint.AddressMode = addressMode
+	ec2Endpoint.Proxy = proxy
+	ec2Endpoint.Options = sshOpts.forBastion(ec2Endpoint.InstanceID, instanceName(selectedBastion))
+	if f.osUser == autoOSUser {
+		osUser := internal.DetectOSUser(context.Background(), ecSvc, ec2Endpoint.Instance)
+		log.Debugf("Logging in to %s as %s", ec2Endpoint.InstanceID, osUser)
+		ec2Endpoint.User = osUser.User
+		ec2Endpoint.FallbackUsers = osUser.Fallbacks()
+	} else {
+		ec2Endpoint.User = f.osUser
+	}
+	if addressMode == internal.AddressProbe {
+		statusLabel.Text = fmt.Sprintf("Probing the addresses of %s", ec2Endpoint.InstanceID)
+		ui.Clear()
+		ui.Render(statusLabel)
+	}
+	if err := ec2Endpoint.SelectAddress(context.Background()); err != nil {
+		fatal(statusLabel, "Could not pick an address for the bastion", err)
+	}
+	if startedBastion {
+		ctx, cancel := context.WithTimeout(context.Background(), sshStartTimeout)
+		err := internal.WaitForSSH(ctx, proxy, ec2Endpoint.String(), func(status string) {
+			showStatus(statusLabel, status)
+		})
+		cancel()
+		if err != nil {
+			fatal(statusLabel, "The bastion started but SSH isn't answering", err)
+		}
+	}
+
+	// The targets are all in the same cluster, so share its secret
+	var secret *internal.DatabaseSecret
+	if !f.iamAuth {
+		secret = databaseSecret(statusLabel, f, selectedProfile, dbSvc, selectedTargets[0])
+	}
+	var targets []tunnelTarget
+	for _, t := range selectedTargets {
+		dbEndpoint, err := internal.ParseEndpoint(t.String())
+		if err != nil {
+			fatal(statusLabel, "Invalid database endpoint", err)
+		}
+		target := tunnelTarget{endpoint: dbEndpoint, login: databaseLogin(statusLabel, f, selectedProfile, selectedRegion, t, secret)}
+		if len(selectedTargets) > 1 {
+			target.label = string(t.Kind)
+		}
+		targets = append(targets, target)
+	}
+	return ec2Endpoint, targets
+}
+
+// databaseLogin works out the user and database to log in to the target
+// with, and the password from the secret or, with -iam-auth, IAM auth tokens
+func databaseLogin(statusLabel *widgets.Paragraph, f *flags, prof internal.ProfileContainer, region string,
+	t internal.DatabaseTarget, secret *internal.DatabaseSecret) *internal.DBLogin {
+	login := &internal.DBLogin{
+		Engine:   t.Engine,
+		User:     f.dbUser,
+		Database: t.DatabaseName(),
+	}
+	// The secret's password is only any use for the secret's user
+	if secret != nil && (f.dbUser == "" || f.dbUser == secret.Username) {
+		login.Password = secret
+		if secret.Username != "" {
+			login.User = secret.Username
+		}
+		if login.Database == "" {
+			login.Database = secret.DBName
+		}
+	}
+	if login.User == "" {
+		login.User = t.MasterUsername()
+	}
+	if !f.iamAuth {
+		return login
+	}
+	if !t.IAMAuthEnabled() {
+		fatal(statusLabel, "Can't use -iam-auth", internal.NewTunnelError(internal.ErrDatabaseAuth,
+			fmt.Errorf("IAM database authentication isn't enabled on %s", t.Name)))
+	}
+	creds, err := prof.GetCredentials()
+	if err != nil {
+		fatal(statusLabel, "Could not get the profile's credentials", err)
+	}
+	// The token is signed for the database's own address, not the tunnel's
+	token, err := internal.NewIAMAuthToken(t.String(), region, login.User, creds)
+	if err != nil {
+		fatal(statusLabel, "Could not generate an IAM auth token", err)
+	}
+	login.Password = token
+	return login
+}
+
+// bastionRows formats candidates for the bastion list, showing the address
+// mode would connect to and why each was ranked where it is
+func bastionRows(candidates []internal.BastionCandidate, mode internal.AddressMode) []string {
+	var rows []string
+	for i, c := range candidates {
+		inst := c.Instance
+		var tags []string
+		for _, t := range inst.Tags {
+			tags = append(tags, fmt.Sprintf("%s=%s", *t.Key, *t.Value))
+		}
+		marker := ""
+		if internal.IsTaggedBastion(inst) {
+			marker = " (bastion)"
+		}
+		verdict := strings.Join(c.Reasons, ", ")
+		if c.Rejected {
+			verdict = "rejected: " + strings.Join(c.Problems, ", ")
+		} else if len(c.Problems) > 0 {
+			verdict += "; but " + strings.Join(c.Problems, ", ")
+		}
+		rows = append(rows, fmt.Sprintf("[%d] %s%s \t %s \t %s \t %s", i, *inst.InstanceId, marker,
+			bastionAddressLabel(inst, mode), verdict, strings.Join(tags, ",")))
+	}
+	return rows
+}
+
+func bastionAddressLabel(inst *ec2.Instance, mode internal.AddressMode) string {
+	addresses := internal.InstanceAddresses(inst)
+	switch mode {
+	case internal.AddressAuto:
+		if len(addresses) > 0 {
+			return addresses[0].String()
+		}
+	case internal.AddressProbe:
+		var hosts []string
+		for _, a := range addresses {
+			hosts = append(hosts, a.Host)
+		}
+		if len(hosts) > 0 {
+			return "probe " + strings.Join(hosts, "|")
+		}
+	default:
+		for _, a := range addresses {
+			if a.Mode == mode {
+				return a.String()
+			}
+		}
+		return fmt.Sprintf("(no %s address)", mode)
+	}
+	return "(no address)"
+}
+
+func nextAddressMode(mode internal.AddressMode) internal.AddressMode {
+	for i, m := range internal.AddressModes {
+		if m == mode {
+			return internal.AddressModes[(i+1)%len(internal.AddressModes)]
+		}
+	}
+	return internal.AddressAuto
+}
+
+// selectDatabase lists the RDS instances and Aurora clusters matching
+// -db-filter, with each cluster's endpoints and instances under it, and
+// returns the target the user picks. Picking a cluster returns both its
+// writer and reader.
+func selectDatabase(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags,
+	dbSvc rdsiface.RDSAPI) []internal.DatabaseTarget {
+	all, err := internal.DiscoverDatabases(context.Background(), dbSvc)
+	if err != nil {
+		fatal(statusLabel, "Could not describe RDS instances", err)
+	}
+	search := f.dbFilter
+	filter, err := internal.ParseDatabaseFilter(search)
+	if err != nil {
+		fatal(statusLabel, "Invalid -db-filter", err)
+	}
+	groups, err := filter.Apply(context.Background(), dbSvc, all)
+	if err != nil {
+		fatal(statusLabel, "Could not filter databases", err)
+	}
+	var choices [][]internal.DatabaseTarget
+	showDatabases := func() {
+		optionsList.Rows, choices = databaseRows(groups)
+		action := "Choose a database"
+		if f.restore != "" {
+			action = "Choose an instance to restore a temporary copy of"
+		}
+		statusLabel.Text = fmt.Sprintf("%s, %d of %d shown (/: filter, r: restore a copy on/off)", action,
+			len(groups), len(all))
+		if search != "" {
+			statusLabel.Text += " matching " + search
+		}
+	}
+	showDatabases()
+	for {
+		cancelled := handleListSelectKeys(statusLabel, optionsList, map[string]func(int){
+			"/": func(int) {
+				query, err := promptInput("Filter by identifier, engine=, status= or tag:key=value (* wildcards, "+
+					"comma separated terms must all match, empty for all)", false)
+				if err != nil {
+					return
+				}
+				filter, err := internal.ParseDatabaseFilter(query)
+				if err == nil {
+					groups, err = filter.Apply(context.Background(), dbSvc, all)
+				}
+				if err != nil {
+					statusLabel.Text = fmt.Sprintf("Filter failed: %v", err)
+					return
+				}
+				search = query
+				optionsList.SelectedRow = 0
+				showDatabases()
+			},
+			"r": func(int) {
+				if f.restore == "" {
+					f.restore = askRestore
+				} else {
+					f.restore = ""
+				}
+				showDatabases()
+			},
+		})
+		if cancelled {
+			quit()
+		}
+		if len(choices) == 0 {
+			continue
+		}
+		chosen := choices[optionsList.SelectedRow]
+		if f.restore != "" {
+			if chosen[0].Kind != internal.TargetInstance || chosen[0].Cluster != nil {
+				statusLabel.Text = fmt.Sprintf("%s is part of a cluster, only standalone instances can be restored",
+					chosen[0].Name)
+				continue
+			}
+			return chosen
+		}
+		if !chosen[0].HasEndpoint() && !chosen[0].IsStopped() {
+			statusLabel.Text = fmt.Sprintf("%s has no endpoint while it is %s, choose another", chosen[0].Name,
+				chosen[0].Status)
+			continue
+		}
+		return chosen
+	}
+}
+
+// databaseRows lists each cluster, followed by its endpoints and instances,
+// and each standalone instance, returning the rows and the targets each
+// row stands for
+func databaseRows(groups []internal.DatabaseGroup) ([]string, [][]internal.DatabaseTarget) {
+	var rows []string
+	var choices [][]internal.DatabaseTarget
+	add := func(row string, targets ...internal.DatabaseTarget) {
+		rows = append(rows, fmt.Sprintf("[%d] %s", len(rows), row))
+		choices = append(choices, targets)
+	}
+	for _, g := range groups {
+		if g.Cluster == nil {
+			t := g.Targets[0]
+			add(fmt.Sprintf("%s \t %s \t %s", t.Name, databaseDetails(t), databaseAddress(t)), t)
+			continue
+		}
+		writer, reader := g.Writer(), g.Reader()
+		header := fmt.Sprintf("%s cluster \t %s", g.Name(), databaseDetails(g.Targets[0]))
+		if writer != nil && reader != nil {
+			add(header+" \t writer and reader on adjacent ports", *writer, *reader)
+		} else {
+			add(header, g.Targets[0])
+		}
+		for _, t := range g.Targets {
+			if t.Kind == internal.TargetInstance {
+				add(fmt.Sprintf("    instance %s \t %s \t %s", t.Name, databaseDetails(t), databaseAddress(t)), t)
+			} else {
+				add(fmt.Sprintf("    %s %s \t %s", t.Kind, t.Name, databaseAddress(t)), t)
+			}
+		}
+	}
+	return rows, choices
+}
+
+// databaseDetails describes the engine, status, class and network placement
+// of a target
+func databaseDetails(t internal.DatabaseTarget) string {
+	var details []string
+	for _, d := range []string{strings.TrimSpace(t.Engine + " " + t.EngineVersion), t.Status, t.InstanceClass} {
+		if d != "" {
+			details = append(details, d)
+		}
+	}
+	if t.MultiAZ {
+		details = append(details, "multi-AZ")
+	}
+	if vpc := t.VpcID(); vpc != "" {
+		details = append(details, vpc)
+	}
+	return strings.Join(details, ", ")
+}
+
+func databaseAddress(t internal.DatabaseTarget) string {
+	if !t.HasEndpoint() {
+		return fmt.Sprintf("no endpoint while %s", t.Status)
+	}
+	return t.String()
+}
+
+// selectBastion finds the bastion given by -bastion, or lists the running
+// and stopped instances ranked by how likely they are to reach the database and returns
+// the one the user picks, along with the address mode they chose
+func selectBastion(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags, ecSvc ec2iface.EC2API,
+	ranker *internal.BastionRanker) (*ec2.Instance, internal.AddressMode) {
+	var filters []*ec2.Filter
+	var err error
+	if f.bastion != "" {
+		if filters, err = internal.BastionFilters(f.bastion); err != nil {
+			fatal(statusLabel, "Invalid -bastion", err)
+		}
+	}
+	instances, err := internal.FindBastions(context.Background(), ecSvc, filters)
+	if err != nil {
+		fatal(statusLabel, "Could not describe instances", err)
+	}
+	if f.bastion != "" && len(instances) == 0 {
+		fatal(statusLabel, "Could not find the bastion",
+			internal.NewTunnelError(internal.ErrDiscovery, fmt.Errorf("no running or stopped instance matches %q", f.bastion)))
+	}
+
+	addressMode := internal.AddressMode(f.bastionAddress)
+	if len(instances) == 1 && f.bastion != "" {
+		return instances[0], addressMode
+	}
+
+	// The best candidate is first, so it's the one selected to begin with
+	candidates := ranker.Rank(instances)
+	search := f.bastion
+	showBastions := func() {
+		statusLabel.Text = fmt.Sprintf("Got %d instances, best match first. Please choose below "+
+			"(a: address %s, /: search)", len(candidates), addressMode)
+		if search != "" {
+			statusLabel.Text += fmt.Sprintf(" matching %s", search)
+		}
+		optionsList.Rows = bastionRows(candidates, addressMode)
+	}
+	showBastions()
+	ui.Render(statusLabel, optionsList)
+	for {
+		cancelled := handleListSelectKeys(statusLabel, optionsList, map[string]func(int){
+			"a": func(int) {
+				addressMode = nextAddressMode(addressMode)
+				showBastions()
+			},
+			"/": func(int) {
+				query, err := promptInput("Search by instance ID, Name tag or tag:key=value (* wildcards, "+
+					"comma separated terms must all match, empty for all)", false)
+				if err != nil {
+					return
+				}
+				found, err := searchBastions(ecSvc, query)
+				if err != nil {
+					statusLabel.Text = fmt.Sprintf("Search failed: %v", err)
+					return
+				}
+				search, candidates = query, ranker.Rank(found)
+				optionsList.SelectedRow = 0
+				showBastions()
+			},
+		})
+		if cancelled {
+			quit()
+		}
+		if len(candidates) > 0 {
+			return candidates[optionsList.SelectedRow].Instance, addressMode
+		}
+	}
+}
+
+// checkPath analyses the network path from the bastion to the database and,
+// if it looks blocked, shows why and lets the user decide whether to carry on
+func checkPath(statusLabel *widgets.Paragraph, optionsList *widgets.List, ecSvc ec2iface.EC2API,
+	bastion *ec2.Instance, db *rds.DBInstance) {
+	statusLabel.Text = fmt.Sprintf("Checking the network path from %s to %s",
+		aws.StringValue(bastion.InstanceId), aws.StringValue(db.DBInstanceIdentifier))
+	ui.Clear()
+	ui.Render(statusLabel)
+	report, err := internal.AnalyzePath(context.Background(), ecSvc, bastion, db)
+	if err != nil {
+		// Not being able to check isn't a reason not to try
+		log.Debugf("Could not check the network path: %v", err)
+		return
+	}
+	var rows []string
+	for _, c := range report.Checks {
+		log.Debugf("Path check %s", c)
+		rows = append(rows, c.String())
+	}
+	if report.Allowed() {
+		return
+	}
+	blocked := report.Blocked()
+	statusLabel.Text = fmt.Sprintf("The bastion probably can't reach the database: %s. "+
+		"Enter to try anyway, Ctrl-C to quit", blocked[0].Detail)
+	optionsList.Rows = rows
+	if handleListSelect(statusLabel, optionsList) {
+		quit()
+	}
+}
+
+// autoOSUser is the -os-user value for working the user out from the
+// bastion's tags and AMI
+const autoOSUser = "auto"
+
+// sshStartTimeout is how long a freshly started bastion gets to start sshd
+const sshStartTimeout = 3 * time.Minute
+
+// startBastion asks whether to start a stopped bastion, and whether to stop
+// it again afterwards, then starts it and returns its refreshed description
+func startBastion(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags, ecSvc ec2iface.EC2API,
+	bastion *ec2.Instance) *ec2.Instance {
+	id := aws.StringValue(bastion.InstanceId)
+	stopChoice := "Start it, and stop it again when finished unless someone else is using it"
+	leaveChoice := "Start it, and leave it running"
+	optionsList.Rows = []string{leaveChoice, stopChoice}
+	if f.stopBastion {
+		optionsList.Rows = []string{stopChoice, leaveChoice}
+	}
+	statusLabel.Text = fmt.Sprintf("%s is stopped. Start it?", id)
+	if handleListSelect(statusLabel, optionsList) {
+		quit()
+	}
+	stopAfter := optionsList.Rows[optionsList.SelectedRow] == stopChoice
+
+	started, err := internal.StartInstance(context.Background(), ecSvc, id, func(status string) {
+		showStatus(statusLabel, status)
+	})
+	if err != nil {
+		fatal(statusLabel, "Could not start the bastion", err)
+	}
+	// The tag, rather than this session, remembers to stop it, so it is
+	// stopped by whichever session finishes with it last
+	if err := internal.SetStopWhenIdle(context.Background(), ecSvc, id, stopAfter); err != nil {
+		log.Warnf("Could not tag %s with %s: %v", id, internal.StopWhenIdleTagKey, err)
+	}
+	leaseBastion(ecSvc, id)
+	return started
+}
+
+// dbStartTimeout is how long a stopped database gets to become available.
+// RDS usually takes a few minutes, Aurora clusters longer.
+const dbStartTimeout = 30 * time.Minute
+
+// startDatabase asks whether to start a stopped database, and whether to
+// stop it again afterwards, then starts it and returns the refreshed
+// targets. The targets are all in the same cluster, so only the first is
+// started.
+func startDatabase(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags, dbSvc rdsiface.RDSAPI,
+	targets []internal.DatabaseTarget) []internal.DatabaseTarget {
+	stopChoice := "Start it, and stop it again when finished"
+	leaveChoice := "Start it, and leave it running"
+	optionsList.Rows = []string{leaveChoice, stopChoice}
+	if f.stopDB {
+		optionsList.Rows = []string{stopChoice, leaveChoice}
+	}
+	statusLabel.Text = fmt.Sprintf("%s is stopped. Start it? It usually takes a few minutes", targets[0].Name)
+	if handleListSelect(statusLabel, optionsList) {
+		quit()
+	}
+	stopAfter := optionsList.Rows[optionsList.SelectedRow] == stopChoice
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbStartTimeout)
+	defer cancel()
+	started, err := internal.StartDatabase(ctx, dbSvc, targets[0], func(status string) {
+		showStatus(statusLabel, status)
+	})
+	if err != nil {
+		fatal(statusLabel, "Could not start the database", err)
+	}
+	if stopAfter {
+		onExit(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := internal.StopDatabase(ctx, dbSvc, started); err != nil {
+				log.Warnf("Could not stop the database: %v", err)
+				return
+			}
+			log.Infof("Stopping %s", started.Name)
+		})
+	}
+	refreshed := []internal.DatabaseTarget{started}
+	for _, t := range targets[1:] {
+		t.Cluster, t.Status = started.Cluster, started.Status
+		refreshed = append(refreshed, t)
+	}
+	return refreshed
+}
+
+// databaseSecret finds the Secrets Manager secret with the target's
+// credentials. Not finding one is only fatal if -db-secret names it.
+func databaseSecret(statusLabel *widgets.Paragraph, f *flags, prof internal.ProfileContainer, dbSvc rdsiface.RDSAPI,
+	t internal.DatabaseTarget) *internal.DatabaseSecret {
+	smSvc, err := prof.GetSecretsManagerService(f.secretsURL)
+	if err != nil {
+		fatal(statusLabel, "Could not initialise Secrets Manager service", err)
+	}
+	showStatus(statusLabel, fmt.Sprintf("Looking for the credentials of %s", t.Name))
+	secret, err := internal.FindDatabaseSecret(context.Background(), dbSvc, smSvc, t, f.dbSecret)
+	if err != nil {
+		if f.dbSecret != "" {
+			fatal(statusLabel, "Could not read the database secret", err)
+		}
+		log.Debugf("Could not look for the credentials of %s: %v", t.Name, err)
+		return nil
+	}
+	if secret != nil {
+		log.Debugf("Using the credentials %s", secret)
+	}
+	return secret
+}
+
+// askRestore is the -restore value for choosing what to restore from a list
+const askRestore = "ask"
+
+// dbRestoreTimeout is how long a restore gets to become available. It
+// depends on the size of the database, and takes at least ten minutes.
+const dbRestoreTimeout = 2 * time.Hour
+
+// restoreDatabase restores a temporary copy of the instance from the
+// snapshot or time given by -restore, or chosen from a list, and arranges
+// for it to be deleted on exit. It returns the copy as the target.
+func restoreDatabase(statusLabel *widgets.Paragraph, optionsList *widgets.List, f *flags, dbSvc rdsiface.RDSAPI,
+	source internal.DatabaseTarget) []internal.DatabaseTarget {
+	var point internal.RestorePoint
+	if f.restore == askRestore {
+		point = chooseRestorePoint(statusLabel, optionsList, dbSvc, source)
+	} else {
+		var err error
+		if point, err = internal.ParseRestorePoint(f.restore); err != nil {
+			fatal(statusLabel, "Invalid -restore", err)
+		}
+	}
+
+	// Restoring takes a while, so it runs in the background while this
+	// goroutine keeps the UI, and Ctrl-C cancels it
+	ctx, cancel := context.WithTimeout(context.Background(), dbRestoreTimeout)
+	defer cancel()
+	progress := make(chan string, 16)
+	type result struct {
+		restored *internal.RestoredDatabase
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		restored, err := internal.RestoreDatabase(ctx, dbSvc, source, point, func(status string) {
+			select {
+			case progress <- status:
+			default:
+			}
+		})
+		done <- result{restored, err}
+	}()
+	var restored *internal.RestoredDatabase
+	cancelled := false
+	evt := uiEvents()
+	for restored == nil {
+		select {
+		case status := <-progress:
+			if !cancelled {
+				showStatus(statusLabel, status+"\n\nPress Ctrl-C to cancel the restore and delete it")
+			}
+		case e := <-evt:
+			if e.ID == "<C-c>" && !cancelled {
+				cancelled = true
+				showStatus(statusLabel, "Cancelling the restore")
+				cancel()
+			}
+		case r := <-done:
+			if cancelled {
+				quit()
+			}
+			if r.err != nil {
+				fatal(statusLabel, "Could not restore the database", r.err)
+			}
+			restored = r.restored
+		}
+	}
+	onExit(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := restored.Delete(ctx); err != nil {
+			log.Warnf("Could not delete the restored database, run tunneller cleanup: %v", err)
+			return
+		}
+		log.Infof("Deleting %s", restored.Target.Name)
+	})
+	return []internal.DatabaseTarget{restored.Target}
+}
+
+// chooseRestorePoint lists the latest restorable time, a prompt for another
+// time and the instance's snapshots, and returns the one the user picks
+func chooseRestorePoint(statusLabel *widgets.Paragraph, optionsList *widgets.List, dbSvc rdsiface.RDSAPI,
+	source internal.DatabaseTarget) internal.RestorePoint {
+	showStatus(statusLabel, fmt.Sprintf("Fetching the snapshots of %s", source.Name))
+	snapshots, err := internal.ListSnapshots(context.Background(), dbSvc, source.Name)
+	if err != nil {
+		fatal(statusLabel, "Could not list snapshots", err)
+	}
+	latest := "the latest restorable time"
+	if t := source.Instance.LatestRestorableTime; t != nil {
+		latest = fmt.Sprintf("%s (%s)", latest, t.Local().Format(time.RFC3339))
+	}
+	optionsList.Rows = []string{"[0] Point in time: " + latest, "[1] Point in time: enter a time"}
+	for _, s := range snapshots {
+		optionsList.Rows = append(optionsList.Rows, fmt.Sprintf("[%d] Snapshot %s \t %s \t %s",
+			len(optionsList.Rows), aws.StringValue(s.DBSnapshotIdentifier),
+			aws.TimeValue(s.SnapshotCreateTime).Local().Format(time.RFC3339), aws.StringValue(s.SnapshotType)))
+	}
+	statusLabel.Text = fmt.Sprintf("Restore a temporary copy of %s from", source.Name)
+	for {
+		if handleListSelect(statusLabel, optionsList) {
+			quit()
+		}
+		switch row := optionsList.SelectedRow; row {
+		case 0:
+			return internal.RestorePoint{}
+		case 1:
+			answer, err := promptInput("Restore time, RFC 3339 e.g. 2020-05-01T09:30:00Z", false)
+			if err != nil {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, strings.TrimSpace(answer))
+			if err != nil {
+				statusLabel.Text = fmt.Sprintf("%q isn't an RFC 3339 time, try again", answer)
+				continue
+			}
+			return internal.RestorePoint{Time: t}
+		default:
+			return internal.RestorePoint{SnapshotID: aws.StringValue(snapshots[row-2].DBSnapshotIdentifier)}
+		}
+	}
+}
+
+// launchBastion launches a temporary bastion next to the database and
+// arranges for it to be terminated on exit
+func launchBastion(statusLabel *widgets.Paragraph, f *flags, prof internal.ProfileContainer, ecSvc ec2iface.EC2API,
+	db *rds.DBInstance, proxy *internal.Proxy) *ec2.Instance {
+	ssmSvc, err := prof.GetSSMService()
+	if err != nil {
+		fatal(statusLabel, "Could not initialise SSM service", err)
+	}
+	sshCIDR := f.ephemeralCIDR
+	if sshCIDR == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if sshCIDR, err = internal.EgressCIDR(ctx, proxy.HTTPClient()); err != nil {
+			fatal(statusLabel, "Could not work out which address to allow SSH from, set -ephemeral-ssh-cidr", err)
+		}
+		log.Debugf("Allowing SSH to the temporary bastion from %s", sshCIDR)
+	}
+	bastion, err := internal.LaunchEphemeralBastion(context.Background(), ecSvc, ssmSvc, db,
+		internal.EphemeralBastionConfig{
+			LaunchTemplate: f.ephemeralLT,
+			AMIParameter:   f.ephemeralAMI,
+			InstanceType:   f.ephemeralType,
+			SSHCIDR:        sshCIDR,
+		}, func(status string) {
+			showStatus(statusLabel, status)
+		})
+	if err != nil {
+		fatal(statusLabel, "Could not launch a temporary bastion", err)
+	}
+	onExit(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		err := bastion.Terminate(ctx, func(status string) {
+			log.Infof(status)
+		})
+		if err != nil {
+			log.Warnf("Could not remove the temporary bastion, run tunneller cleanup: %v", err)
+		}
+	})
+	return bastion.Instance
+}
+
+// leaseBastion marks the bastion as in use until tunneller exits, so other
+// sessions don't stop it, and on exit stops it if it is tagged to be
+// stopped when idle and nobody else is using it
+func leaseBastion(ecSvc ec2iface.EC2API, instanceID string) {
+	lease, err := internal.AcquireLease(context.Background(), ecSvc, instanceID, internal.DefaultLeaseTTL)
+	if err != nil {
+		log.Debugf("Could not tag %s with a lease: %v", instanceID, err)
+		return
+	}
+	onExit(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		stopped, err := lease.Release(ctx)
+		if err != nil {
+			log.Warnf("Could not release the lease on %s: %v", instanceID, err)
+		}
+		if stopped {
+			log.Infof("Stopped %s", instanceID)
+		}
+	})
+}
+
+// instanceName returns the value of the instance's Name tag
+func instanceName(inst *ec2.Instance) string {
+	for _, t := range inst.Tags {
+		if aws.StringValue(t.Key) == "Name" {
+			return aws.StringValue(t.Value)
+		}
+	}
+	return ""
+}
+
+func searchBastions(ecSvc ec2iface.EC2API, query string) ([]*ec2.Instance, error) {
+	filters, err := internal.BastionFilters(query)
+	if err != nil {
+		return nil, err
+	}
+	return internal.FindBastions(context.Background(), ecSvc, filters)
+}
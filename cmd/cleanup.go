@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/threetoes/tunneller/internal"
+)
+
+// cleanup implements tunneller cleanup, which removes the temporary AWS
+// resources left behind by sessions that didn't exit cleanly
+func cleanup(args []string) {
+	home, _ := os.UserHomeDir()
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	profile := fs.String("profile", "", "Name of the profile to use")
+	region := fs.String("region", "", "AWS Region to clean up. Defaults to all of them")
+	awsCredentials := fs.String("credentials", path.Join(home, ".aws/credentials"), "Path to AWS credentials file")
+	dryRun := fs.Bool("dry-run", false, "List what would be removed without removing it")
+	fs.Parse(args)
+	if *profile == "" {
+		log.Fatalf("tunneller cleanup needs -profile")
+	}
+
+	prof := internal.NewIniConfig(*awsCredentials)
+	if err := prof.Refresh(); err != nil {
+		log.Fatalf("Could not load profiles: %v%s", err, hintSuffix(err))
+	}
+	proxy, err := internal.ProxyFromEnvironment()
+	if err != nil {
+		log.Fatalf("Invalid proxy: %v", err)
+	}
+	if proxy != nil {
+		prof.SetHTTPClient(proxy.HTTPClient())
+	}
+	container := prof.GetProfile(*profile)
+	if container == nil {
+		log.Fatalf("No profile called %s in %s", *profile, *awsCredentials)
+	}
+
+	cleanupRegions := []string{*region}
+	if *region == "" {
+		cleanupRegions = enabledRegions(container)
+	}
+	failed := false
+	for _, r := range cleanupRegions {
+		err := cleanupRegion(container, r, *dryRun)
+		var awsErr awserr.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &awsErr) && awsErr.Code() == "OptInRequired":
+			log.Infof("%s: skipped, the region isn't enabled for this account", r)
+		default:
+			log.Errorf("%s: %v%s", r, err, hintSuffix(err))
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// enabledRegions lists the regions enabled for the account, falling back to
+// every region tunneller knows of if they can't be listed
+func enabledRegions(prof internal.ProfileContainer) []string {
+	var resp *ec2.DescribeRegionsOutput
+	err := prof.Connect(regions[0])
+	if err == nil {
+		var ecSvc ec2iface.EC2API
+		if ecSvc, err = prof.GetEC2Service(); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			resp, err = ecSvc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+		}
+	}
+	if err != nil {
+		log.Warnf("Could not list the account's regions, trying them all: %v", err)
+		return regions
+	}
+	var enabled []string
+	for _, r := range resp.Regions {
+		enabled = append(enabled, aws.StringValue(r.RegionName))
+	}
+	sort.Strings(enabled)
+	return enabled
+}
+
+func cleanupRegion(prof internal.ProfileContainer, region string, dryRun bool) error {
+	if err := prof.Connect(region); err != nil {
+		return err
+	}
+	ecSvc, err := prof.GetEC2Service()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	progress := func(status string) {
+		log.Infof("%s: %s", region, status)
+	}
+	removed, err := internal.CleanupEphemeral(ctx, ecSvc, dryRun, progress)
+	if err == nil {
+		var dbSvc rdsiface.RDSAPI
+		if dbSvc, err = prof.GetRDSService(); err == nil {
+			var restores []string
+			restores, err = internal.CleanupRestores(ctx, dbSvc, dryRun, progress)
+			removed = append(removed, restores...)
+		}
+	}
+	for _, r := range removed {
+		if dryRun {
+			log.Infof("%s: would remove %s", region, r)
+		} else {
+			log.Infof("%s: removed %s", region, r)
+		}
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/threetoes/tunneller/internal"
+)
+
+// autoClient is the -client value for picking the client from the engine
+const autoClient = "auto"
+
+// runClient closes the TUI and runs the database client against the first
+// target's tunnel in the foreground, returning its exit code once it exits
+func runClient(statusLabel *widgets.Paragraph, f *flags, targets []tunnelTarget, port int) int {
+	login := targets[0].login
+	if login == nil {
+		// -ssh-bastion targets have no engine, so -client names the client
+		login = &internal.DBLogin{User: f.dbUser}
+	}
+	client := f.client
+	if client == autoClient {
+		var err error
+		if client, err = internal.DefaultClient(login.Engine); err != nil {
+			fatal(statusLabel, "Could not pick a database client", err)
+		}
+	}
+	cmd, err := internal.ClientCommand(client, login, f.localAddress, port)
+	if err != nil {
+		fatal(statusLabel, fmt.Sprintf("Could not run %s", client), err)
+	}
+
+	ui.Clear()
+	ui.Close()
+	log.Infof("Tunnel started on %s port %d, running %s. The tunnel closes when it exits", f.localAddress, port, client)
+	// Ctrl-C is the client's, e.g. to cancel a query, and mustn't kill the
+	// tunnel under it
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		log.Errorf("Could not run %s: %v", client, err)
+		return 1
+	}
+	return 0
+}
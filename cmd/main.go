@@ -1,50 +1,262 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
-	"github.com/aws/aws-sdk-go/service/rds"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	ui "github.com/gizak/termui/v3"
 	"github.com/gizak/termui/v3/widgets"
 	log "github.com/sirupsen/logrus"
 	"github.com/threetoes/tunneller/internal"
 )
 
-func main() {
+// flags holds every command line option
+type flags struct {
+	profile        string
+	localPort      int
+	region         string
+	help           bool
+	osUser         string
+	awsCredentials string
+	keyType        string
+	auth           string
+	identityFiles  stringList
+	caKey          string
+	caAgentKey     string
+	certPrincipals string
+	certExtensions string
+	certKeyID      string
+	certValidity   time.Duration
+	hooks          stringList
+	sshBastion     string
+	target         string
+	sshConfig      string
+	bastionAddress string
+	targetFamily   string
+	localAddress   string
+	proxy          string
+	noProxy        string
+	proxyUser      string
+	sshOptions     string
+	sshTimeout     string
+	sshCiphers     string
+	sshKex         string
+	sshMACs        string
+	sshHostKeyAlgs string
+	sshVersion     string
+	sshRekey       string
+	verbose        bool
+	bastion        string
+	checkPath      bool
+	stopBastion    bool
+	ephemeral      bool
+	ephemeralLT    string
+	ephemeralAMI   string
+	ephemeralType  string
+	ephemeralCIDR  string
+	dbFilter       string
+	stopDB         bool
+	restore        string
+	dbUser         string
+	iamAuth        bool
+	dbSecret       string
+	secretsURL     string
+	client         string
+}
+
+func parseFlags() *flags {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		log.Println("Cannot find home directory")
 		home = ""
 	}
-	profileF := flag.String("profile", "", "Name of the profile to use")
-	localPortF := flag.Int("local-port", -1, "Port to use")
-	regionF := flag.String("region", "", "AWS Region")
-	helpF := flag.Bool("help", false, "Display help and exit")
-	ec2UserF := flag.String("os-user", "ec2-user", "OS username for the bastion")
-	awsCredentialsF := flag.String("credentials", path.Join(home, ".aws/credentials"), "Path to AWS credentials file")
+	f := &flags{}
+	flag.StringVar(&f.profile, "profile", "", "Name of the profile to use")
+	flag.IntVar(&f.localPort, "local-port", -1, "Port to use")
+	flag.StringVar(&f.region, "region", "", "AWS Region")
+	flag.BoolVar(&f.help, "help", false, "Display help and exit")
+	flag.StringVar(&f.osUser, "os-user", autoOSUser, "OS username for the EC2 bastion. auto uses its "+
+		internal.OSUserTagKey+" tag, or guesses from its AMI and tries the other usual users if that is rejected")
+	flag.StringVar(&f.awsCredentials, "credentials", path.Join(home, ".aws/credentials"), "Path to AWS credentials file")
+	flag.StringVar(&f.keyType, "key-type", string(internal.DefaultKeyType),
+		"Type of the temporary SSH key, one of ed25519, ecdsa or rsa. EC2 Instance Connect accepts ed25519 and rsa, "+
+			"any type can be used with -ca-key")
+	flag.StringVar(&f.auth, "auth", joinAuthOrder(internal.DefaultAuthOrder),
+		"Comma separated SSH authentication methods to try, in order. "+
+			"Any of ephemeral, agent, key, keyboard-interactive and password")
+	flag.Var(&f.identityFiles, "identity-file", "Private key file to use for the key authentication method. "+
+		"Can be repeated. Defaults to ~/.ssh/id_ed25519, id_ecdsa and id_rsa")
+	flag.StringVar(&f.caKey, "ca-key", "", "SSH CA private key file. If set, the ephemeral key is signed "+
+		"with a short lived certificate instead of being pushed with EC2 Instance Connect")
+	flag.StringVar(&f.caAgentKey, "ca-agent-key", "", "Use the ssh-agent key with this SHA256 fingerprint or comment as the SSH CA")
+	flag.StringVar(&f.certPrincipals, "cert-principals", "", "Comma separated certificate principals. Defaults to the OS user")
+	flag.StringVar(&f.certExtensions, "cert-extensions", "permit-port-forwarding,permit-pty",
+		"Comma separated certificate extensions, each name or name=value")
+	flag.StringVar(&f.certKeyID, "cert-key-id", internal.DefaultCertKeyID(), "Certificate key ID, identifying you in the bastion's logs")
+	flag.DurationVar(&f.certValidity, "cert-validity", internal.DefaultCertValidity, "How long each certificate is valid for")
+	flag.Var(&f.hooks, "on-event", "Run a shell command on tunnel events, as event[,event...]=command. "+
+		"Events are tunnel-up, client-connected, client-disconnected, bastion-dropped, tunnel-down or all. "+
+		"Can be repeated")
+	flag.StringVar(&f.sshBastion, "ssh-bastion", "", "Skip AWS and tunnel through this SSH bastion, "+
+		"given as user@host:port or a Host from the ssh config. Needs -target")
+	flag.StringVar(&f.target, "target", "", "host:port to tunnel to through -ssh-bastion")
+	flag.StringVar(&f.sshConfig, "ssh-config", path.Join(home, ".ssh/config"), "Path to the OpenSSH client config used by -ssh-bastion")
+
+	flag.StringVar(&f.dbFilter, "db-filter", "", "Only list the databases matching these comma separated terms: "+
+		"engine=pattern, status=pattern, tag:key=pattern or an identifier pattern, with * wildcards")
+	flag.BoolVar(&f.stopDB, "stop-db", false, "When starting a stopped database, stop it again on exit")
+	flag.StringVar(&f.restore, "restore", "", "Tunnel to a temporary copy of the chosen instance, deleted on exit, "+
+		"restored from a snapshot ID, an RFC 3339 time, latest, or ask to choose from a list")
+	flag.StringVar(&f.dbUser, "db-user", "", "Database user for connection strings and IAM auth tokens. "+
+		"Defaults to the master user")
+	flag.BoolVar(&f.iamAuth, "iam-auth", false, "Generate IAM database auth tokens for -db-user with the profile's credentials, "+
+		"refreshed before they expire")
+	flag.StringVar(&f.dbSecret, "db-secret", "", "Name or ARN of the Secrets Manager secret with the database's "+
+		"credentials. By default it is found from the database's tags, RDS, or the name rds/<identifier>")
+	flag.StringVar(&f.secretsURL, "secrets-endpoint", "", "Secrets Manager endpoint URL, e.g. for LocalStack")
+	flag.StringVar(&f.client, "client", "", "Run a database client once the tunnel is up, and close the tunnel "+
+		"when it exits: auto to pick it from the engine, or one of "+strings.Join(internal.Clients, ", "))
+	flag.StringVar(&f.bastion, "bastion", "", "EC2 bastion to use: an instance ID, a Name tag value or tag:key=value, "+
+		"with * wildcards. Comma separated terms must all match. Picked without asking if only one instance matches")
+	flag.BoolVar(&f.checkPath, "check-path", true, "Check the security groups, route tables and network ACLs "+
+		"between the bastion and the database before connecting")
+	flag.BoolVar(&f.stopBastion, "stop-bastion", false, "When starting a stopped bastion, stop it again on exit "+
+		"unless another session is still using it")
+	flag.BoolVar(&f.ephemeral, "ephemeral-bastion", false, "Launch a temporary bastion in one of the database's "+
+		"subnets instead of using an existing one, and terminate it on exit. Leftovers are removed with tunneller cleanup")
+	flag.StringVar(&f.ephemeralLT, "ephemeral-launch-template", "", "Name or ID of a launch template for the "+
+		"temporary bastion. Defaults to the Amazon Linux AMI from -ephemeral-ami-parameter")
+	flag.StringVar(&f.ephemeralAMI, "ephemeral-ami-parameter", internal.DefaultEphemeralAMIParameter,
+		"SSM parameter holding the AMI of the temporary bastion")
+	flag.StringVar(&f.ephemeralType, "ephemeral-instance-type", "", "Instance type of the temporary bastion. "+
+		"Defaults to the launch template's, or "+internal.DefaultEphemeralInstanceType)
+	flag.StringVar(&f.ephemeralCIDR, "ephemeral-ssh-cidr", "", "Addresses allowed to SSH to the temporary bastion. "+
+		"Defaults to this machine's public address, as seen by AWS")
+	flag.StringVar(&f.bastionAddress, "bastion-address", string(internal.AddressAuto),
+		"Which address of the EC2 bastion to connect to: public, private, ipv6, dns, "+
+			"auto for the first of those the instance has in the order public, ipv6, dns, private, "+
+			"or probe to use the first of them that accepts a connection")
+	flag.StringVar(&f.targetFamily, "target-family", string(internal.TargetFamilyAuto),
+		"Address family for the target: auto lets the bastion resolve it, ipv4 or ipv6 resolve it locally "+
+			"to an address of that family, e.g. for dual-stack RDS instances")
+	flag.StringVar(&f.localAddress, "local-address", "localhost", "Local address to listen on, e.g. 127.0.0.1 or ::1")
+	flag.StringVar(&f.proxy, "proxy", "", "HTTP CONNECT or SOCKS5 proxy for the bastion and AWS connections, "+
+		"e.g. http://proxy:3128 or socks5://proxy:1080. Defaults to HTTPS_PROXY or ALL_PROXY, none disables it")
+	flag.StringVar(&f.noProxy, "no-proxy", "", "Comma separated hosts, domains and CIDR ranges to connect to "+
+		"without the proxy. Defaults to NO_PROXY")
+	flag.StringVar(&f.proxyUser, "proxy-user", "", "User name for the proxy. The password is read from "+
+		"TUNNELLER_PROXY_PASSWORD or prompted for")
+	flag.StringVar(&f.sshOptions, "ssh-options", path.Join(home, ".tunneller/ssh-options.ini"),
+		"INI file of SSH options for all bastions ([default]) or one bastion (a section named after its host, "+
+			"instance ID or Name tag). The keys are the -ssh-* flag names without the prefix")
+	flag.StringVar(&f.sshTimeout, "ssh-timeout", "", "Timeout for connecting and the SSH handshake, e.g. 10s. Defaults to 30s")
+	flag.StringVar(&f.sshCiphers, "ssh-ciphers", "", "Comma separated SSH ciphers to offer, in order of preference")
+	flag.StringVar(&f.sshKex, "ssh-kex", "", "Comma separated SSH key exchange algorithms to offer")
+	flag.StringVar(&f.sshMACs, "ssh-macs", "", "Comma separated SSH MAC algorithms to offer")
+	flag.StringVar(&f.sshHostKeyAlgs, "ssh-host-key-algorithms", "", "Comma separated SSH host key algorithms to accept")
+	flag.StringVar(&f.sshVersion, "ssh-client-version", "", "SSH client version string, e.g. SSH-2.0-tunneller")
+	flag.StringVar(&f.sshRekey, "ssh-rekey-threshold", "", "Bytes to send before renegotiating SSH keys, e.g. 512M")
+	flag.BoolVar(&f.verbose, "verbose", false, "Log diagnostics, such as the SSH and proxy settings used, to stderr")
 
 	flag.Parse()
+	return f
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		cleanup(os.Args[2:])
+		return
+	}
+	f := parseFlags()
 
-	if *helpF {
+	if f.help {
 		flag.Usage()
 		return
 	}
+	if (f.sshBastion == "") != (f.target == "") {
+		log.Fatalf("-ssh-bastion and -target must be used together")
+	}
+	if f.verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	var hooks []*internal.CommandHook
+	for _, spec := range f.hooks {
+		hook, err := internal.ParseCommandHook(spec)
+		if err != nil {
+			log.Fatalf("Invalid -on-event value: %v", err)
+		}
+		hooks = append(hooks, hook)
+	}
+
+	authOrder, err := internal.ParseAuthOrder(f.auth)
+	if err != nil {
+		log.Fatalf("Invalid -auth value: %v", err)
+	}
+	authConfig := &internal.AuthConfig{
+		Order:         authOrder,
+		IdentityFiles: f.identityFiles,
+		Prompt:        promptInput,
+	}
+	if len(authConfig.IdentityFiles) == 0 {
+		authConfig.IdentityFiles = internal.DefaultIdentityFiles()
+	}
 
-	log.Printf("Reading config from %s\n", *awsCredentialsF)
+	if _, err := internal.ParseDatabaseFilter(f.dbFilter); err != nil {
+		log.Fatalf("Invalid -db-filter value: %v", err)
+	}
+	if f.client != "" && f.client != autoClient && !validClient(f.client) {
+		log.Fatalf("Invalid -client value %q, it should be %s or one of %s", f.client, autoClient,
+			strings.Join(internal.Clients, ", "))
+	}
+	if f.client == autoClient && f.sshBastion != "" {
+		log.Fatalf("-client auto needs the database's engine, so name the client with -ssh-bastion")
+	}
+	if f.dbSecret != "" && f.iamAuth {
+		log.Fatalf("-db-secret and -iam-auth can't be used together")
+	}
+	if f.restore != "" && f.restore != askRestore {
+		if _, err := internal.ParseRestorePoint(f.restore); err != nil {
+			log.Fatalf("Invalid -restore value: %v", err)
+		}
+	}
+	if _, err := internal.ParseAddressMode(f.bastionAddress); err != nil {
+		log.Fatalf("Invalid -bastion-address value: %v", err)
+	}
+	targetFamily, err := internal.ParseTargetFamily(f.targetFamily)
+	if err != nil {
+		log.Fatalf("Invalid -target-family value: %v", err)
+	}
 
-	prof := internal.NewIniConfig(*awsCredentialsF)
-	if err = prof.Refresh(); err != nil {
-		log.Fatalf("Could not load profiles: %v", err)
+	sshOpts, err := loadSSHOptions(f)
+	if err != nil {
+		log.Fatalf("Invalid SSH options: %v", err)
+	}
+
+	keyType, err := internal.ParseKeyType(f.keyType)
+	if err != nil {
+		log.Fatalf("Invalid -key-type value: %v", err)
+	}
+	// Generating keys can take a while, so get started while the user picks options
+	pendingKeys := internal.GenerateKeysAsync(keyType)
+
+	var prof internal.Profiles
+	if f.sshBastion == "" {
+		log.Printf("Reading config from %s\n", f.awsCredentials)
+
+		prof = internal.NewIniConfig(f.awsCredentials)
+		if err = prof.Refresh(); err != nil {
+			log.Fatalf("Could not load profiles: %v%s", err, hintSuffix(err))
+		}
 	}
 	if err := ui.Init(); err != nil {
 		log.Fatalf("failed to initialize termui: %v", err)
@@ -57,261 +269,386 @@ func main() {
 	statusLabel.Text = "Loading"
 	ui.Render(statusLabel)
 
-	statusLabel.Text = "Choose a region"
-	var options []string
-	options = []string{
-		"us-east-1",
-		"us-east-2",
-		"us-west-1",
-		"us-west-2",
-		"af-south-1",
-		"ap-east-1",
-		"ap-south-1",
-		"ap-northeast-2",
-		"ap-southeast-1",
-		"ap-southeast-2",
-		"ap-northeast-1",
-		"ca-central-1",
-		"eu-central-1",
-		"eu-west-1",
-		"eu-west-2",
-		"eu-south-1",
-		"eu-west-3",
-		"eu-north-1",
-		"me-south-1",
-		"sa-east-1",
-	}
-	var selectedRegion string
-	if *regionF == "" {
-		optionsList.Rows = options
-		if handleListSelect(statusLabel, optionsList) {
-			return
+	if f.caKey != "" || f.caAgentKey != "" {
+		var caSigner ssh.Signer
+		if f.caKey != "" {
+			caSigner, err = internal.LoadCAFromFile(f.caKey, promptInput)
+		} else {
+			caSigner, err = internal.LoadCAFromAgent(f.caAgentKey)
 		}
-		selectedRegion = options[optionsList.SelectedRow]
-	} else {
-		selectedRegion = *regionF
+		if err != nil {
+			fatal(statusLabel, "Could not load SSH CA key", err)
+		}
+		authConfig.CA = &internal.CertificateAuthority{
+			Signer:     caSigner,
+			Extensions: internal.ParseCertExtensions(f.certExtensions),
+			KeyID:      f.certKeyID,
+			Validity:   f.certValidity,
+		}
+		if f.certPrincipals != "" {
+			authConfig.CA.Principals = strings.Split(f.certPrincipals, ",")
+		}
+		defer authConfig.CA.Close()
+	}
+
+	proxy := configureProxy(statusLabel, f)
+	if proxy != nil && prof != nil {
+		prof.SetHTTPClient(proxy.HTTPClient())
 	}
 
 	var port int
-	if *localPortF == -1 {
+	if f.localPort == -1 {
 		port = 8888
 	} else {
-		port = *localPortF
+		port = f.localPort
 	}
 
-	options = nil
-	profileContainers := prof.GetProfiles()
-	var selectedProfile internal.ProfileContainer
-	for i, p := range profileContainers {
-		if p.GetName() == *profileF {
-			selectedProfile = p
-			break
-		}
-		options = append(options, fmt.Sprintf("[%d] %s", i, p.GetName()))
+	var bastion internal.EndpointIface
+	var targets []tunnelTarget
+	if f.sshBastion != "" {
+		var target internal.EndpointIface
+		bastion, target = sshEndpoints(statusLabel, f, authConfig, pendingKeys, proxy, sshOpts)
+		targets = []tunnelTarget{{endpoint: target}}
+	} else {
+		bastion, targets = awsEndpoints(statusLabel, optionsList, f, prof, authConfig, pendingKeys, proxy, sshOpts)
 	}
 
-	if selectedProfile == nil {
-		optionsList.Rows = options
-		statusLabel.Text = "Choose a profile"
-		if handleListSelect(statusLabel, optionsList) {
-			return
+	for _, t := range targets {
+		if e, ok := t.endpoint.(*internal.Endpoint); ok {
+			if err := internal.ResolveTarget(context.Background(), e, targetFamily); err != nil {
+				fatal(statusLabel, "Could not resolve target", err)
+			}
 		}
-		selectedProfile = profileContainers[optionsList.SelectedRow]
-		statusLabel.Text = fmt.Sprintf("Chose profile %s. Connecting", selectedProfile.GetName())
-		ui.Clear()
-		ui.Render(statusLabel)
 	}
 
-	if err = selectedProfile.Connect(selectedRegion); err != nil {
-		statusLabel.Text = fmt.Sprintf("Error connecting profile to region %s: %v", selectedRegion, err)
-		ui.Render(statusLabel)
-		ui.Close()
-		log.Fatalf(statusLabel.Text)
+	// Every tunnel's connections share this one connection to the bastion,
+	// so authenticating, and any prompts it needs, only happen here
+	dialBastion := func() *ssh.Client {
+		client, err := internal.DialBastionTryingUsers(context.Background(), bastion, func(status string) {
+			showStatus(statusLabel, status)
+		})
+		if err != nil {
+			fatal(statusLabel, "Could not dial bastion", err)
+		}
+		return client
 	}
+	sshSess := dialBastion()
+	defer func() {
+		sshSess.Close()
+	}()
 
-	statusLabel.Text = fmt.Sprintf("Connected, fetching EC2 instances...")
+	statusLabel.Text = "Connected to bastion, starting tunnel"
 	ui.Clear()
 	ui.Render(statusLabel)
-	ecSvc, err := selectedProfile.GetEC2Service()
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not get EC2 instances: %v", err)
-	}
-	var instances []*ec2.Instance
-	var nextToken string
-	for {
-		var nt *string
-		if nextToken != "" {
-			nt = aws.String(nextToken)
-		}
-		resp, err := ecSvc.DescribeInstances(&ec2.DescribeInstancesInput{
-			DryRun:     aws.Bool(false),
-			MaxResults: aws.Int64(20),
-			NextToken:  nt,
-			Filters: []*ec2.Filter{
-				{
-					Name: aws.String("instance-state-name"),
-					Values: []*string{aws.String("running")},
-				},
-			},
-		})
-
-		if err != nil {
-			statusLabel.Text = fmt.Sprintf("Could not describe instances: %v", err.Error())
-			ui.Render(statusLabel)
-			time.Sleep(3 * time.Second)
-			ui.Close()
-			log.Fatalf("Could not describe instances: %v", err.Error())
+	// Each target gets the next port up, so a cluster's writer and reader
+	// are on adjacent ports
+	var tunnels []*internal.Tunneller
+	var dones []chan int
+	var listening []string
+	failed := make(chan int, len(targets))
+	for i, t := range targets {
+		tunnel := internal.NewTunneller(t.endpoint, bastion)
+		tunnel.ListenAddress = f.localAddress
+		tunnel.SetClient(sshSess)
+		for _, hook := range hooks {
+			tunnel.Subscribe(hook, hook.Events...)
 		}
-		for _, res := range resp.Reservations {
-			for _, instance := range res.Instances {
-				instances = append(instances, instance)
+		i := i
+		tunnel.Subscribe(internal.ObserverFunc(func(e internal.Event) {
+			if e.Err != nil {
+				failed <- i
 			}
+		}), internal.EventTunnelDown)
+		done, err := tunnel.Tunnel(port + i)
+		if err != nil {
+			fatal(statusLabel, "Could not start local listener", err)
 		}
-		if resp.NextToken == nil {
-			break
+		tunnels = append(tunnels, tunnel)
+		dones = append(dones, done)
+		if t.label != "" {
+			listening = append(listening, fmt.Sprintf("%d (%s)", port+i, t.label))
+		} else {
+			listening = append(listening, strconv.Itoa(port+i))
 		}
-		nextToken = *resp.NextToken
 	}
-	statusLabel.Text = fmt.Sprintf("Got %d instances. Please choose below", len(instances))
-	options = nil
-
-	for i, inst := range instances {
-		var tags []string
-		for _, t := range inst.Tags {
-			tags = append(tags, fmt.Sprintf("%s=%s", *t.Key, *t.Value))
+	// stopTunnels shuts down every listener except the one at skip, and
+	// any that has already failed
+	stopTunnels := func(skip int) {
+		for i, tunnel := range tunnels {
+			if i != skip {
+				select {
+				case dones[i] <- 1:
+				case <-tunnel.Stopped():
+				}
+			}
+			<-tunnel.Stopped()
 		}
-		formatted := fmt.Sprintf("[%d] %s \t %s", i, *inst.InstanceId, strings.Join(tags, ","))
-		options = append(options, formatted)
-	}
-	optionsList.Rows = options
-	ui.Render(statusLabel, optionsList)
-	if handleListSelect(statusLabel, optionsList) {
-		return
-	}
-	selectedBastion := instances[optionsList.SelectedRow]
-	statusLabel.Text = fmt.Sprintf("Selected %s as the bastion. Getting RDS servers",
-		*selectedBastion.InstanceId)
-	ui.Clear()
-	ui.Render(statusLabel)
-	dbSvc, err := selectedProfile.GetRDSService()
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not initialise RDS service")
 	}
-	dbResp, err := dbSvc.DescribeDBInstances(&rds.DescribeDBInstancesInput{})
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not initialise RDS service")
-	}
-	dbs := dbResp.DBInstances
-	options = nil
-	for i, d := range dbs {
-		options = append(options, fmt.Sprintf("[%d] %s", i, *d.Endpoint.Address))
-	}
-	optionsList.Rows = options
-	if handleListSelect(statusLabel, optionsList) {
-		return
-	}
-	selectedDb := dbs[optionsList.SelectedRow]
-	ui.Clear()
-	statusLabel.Text = fmt.Sprintf("Chose %s. Tunnelling in", *selectedDb.Endpoint.Address)
-	ui.Render(statusLabel)
-	cnnct, err := selectedProfile.GetEC2InstanceConnectService()
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not get ec2instanceconnect session: %v", err)
+	if f.client != "" {
+		code := runClient(statusLabel, f, targets, port)
+		log.Infof("Shutting down listener thread")
+		// A tunnel that failed while the client ran has already stopped
+		skip := -1
+		select {
+		case skip = <-failed:
+			<-dones[skip]
+		default:
+		}
+		stopTunnels(skip)
+		waitForHooks(hooks)
+		runCleanups()
+		os.Exit(code)
 	}
 
-	ec2Endpoint, err := internal.NewEC2Endpoint(*selectedBastion.InstanceId, ecSvc, cnnct)
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not configure bastion endpoint: %v", err)
-	}
-	config, err := ec2Endpoint.GetSSHConfig()
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not get bastion config: %v", err)
-	}
-	sshSess, err := ssh.Dial("tcp", ec2Endpoint.String(), config)
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could not dial bastion: %v", err)
+	lastError := ""
+	reveal := false
+	// renderStatus shows how to connect, and the last error. The box fits
+	// the text, so long connection strings and IAM auth tokens wrap rather
+	// than being cut off, whether or not passwords are revealed.
+	renderStatus := func() {
+		statusLabel.Text = tunnelStatus(f, targets, port, listening, reveal) + lastError
+		fitStatus(statusLabel)
+		ui.Clear()
+		ui.Render(statusLabel)
 	}
-
-	defer sshSess.Close()
-
-	statusLabel.Text = "Connected to bastion, starting tunnel"
-	ui.Clear()
-	ui.Render(statusLabel)
-	dbEndpoint := internal.NewEndpoint(fmt.Sprintf("%s@%s:%d",
-		*ec2UserF, *selectedDb.Endpoint.Address, *selectedDb.Endpoint.Port))
-	done, err := internal.Tunnel(port, dbEndpoint, ec2Endpoint)
-	if err != nil {
-		ui.Close()
-		log.Fatalf("Could start local listener: %v", err)
+	// Tunnel errors happen on the tunnels' goroutines, and are handed to
+	// this one to be shown, so only it touches the UI. Losing the bastion
+	// is noticed, and shown, here.
+	tunnelErrors := make(chan error, 16)
+	for _, tunnel := range tunnels {
+		tunnel.Subscribe(internal.ObserverFunc(func(e internal.Event) {
+			if e.Err == nil {
+				return
+			}
+			select {
+			case tunnelErrors <- e.Err:
+			default:
+				// The UI is behind, and only shows the last error anyway
+			}
+		}), internal.EventClientDisconnected)
 	}
-	statusLabel.Text = fmt.Sprintf("Tunnel started. Connect on localhost port %d with your DB client using regular credentials. Press Ctrl-C to end", port)
-	termWidth, termHeight := ui.TerminalDimensions()
-	statusLabel.SetRect((termWidth / 2) - 10, (termHeight / 2) - 5,
-		(termWidth / 2) + 10, (termHeight / 2) + 5)
-	ui.Clear()
-	ui.Render(statusLabel)
-	evt := ui.PollEvents()
+	renderStatus()
+	dropped := bastionDropped(sshSess)
+	// Re-rendering refreshes IAM auth tokens before they expire
+	refresh := time.NewTicker(time.Minute)
+	defer refresh.Stop()
+	evt := uiEvents()
 	for {
 		select {
+		case <-refresh.C:
+			renderStatus()
+		case err := <-tunnelErrors:
+			lastError = fmt.Sprintf("\n\nLast error: %v%s", err, hintSuffix(err))
+			renderStatus()
+		case err := <-dropped:
+			log.Warnf("Lost the connection to the bastion, reconnecting: %v", err)
+			for _, tunnel := range tunnels {
+				tunnel.BastionDropped(err)
+			}
+			sshSess = dialBastion()
+			for _, tunnel := range tunnels {
+				tunnel.SetClient(sshSess)
+			}
+			dropped = bastionDropped(sshSess)
+			lastError = fmt.Sprintf("\n\nLast error: lost the connection to the bastion (%v), reconnected", err)
+			renderStatus()
 		case e := <-evt:
 			if e.ID == "<C-c>" {
 				ui.Clear()
 				ui.Close()
 				log.Infof("Shutting down listener thread")
-				done <- 1
+				stopTunnels(-1)
+				waitForHooks(hooks)
+				runCleanups()
 				log.Infof("Thanks, goodbye")
 				os.Exit(0)
 			}
-			ui.Clear()
-			termWidth, termHeight = ui.TerminalDimensions()
-			statusLabel.SetRect((termWidth / 2) - 10, (termHeight / 2) - 5,
-				(termWidth / 2) + 10, (termHeight / 2) + 5)
-			ui.Render(statusLabel)
-		case <-done:
+			if e.ID == "p" {
+				reveal = !reveal
+			}
+			renderStatus()
+		case i := <-failed:
 			log.Println("Tunnel server reports it's had an error. Exiting")
+			<-dones[i]
+			stopTunnels(i)
+			waitForHooks(hooks)
+			runCleanups()
 			os.Exit(1)
 		}
 	}
 }
 
-func handleListSelect(statusLabel *widgets.Paragraph, optionsList *widgets.List) bool {
-	optionsList.SelectedRow = 0
-	uiEvents := ui.PollEvents()
-	for {
-		termWidth, termHeight := ui.TerminalDimensions()
-		statusLabel.SetRect(0, 0, termWidth, 1)
-		optionsList.SetRect(0, 1, termWidth, termHeight)
-		ui.Render(statusLabel, optionsList)
-		e := <-uiEvents
-		switch e.ID {
-		case "<C-c>":
+// bastionDropped returns a channel that gets why client's connection to the
+// bastion ended, once it has
+func bastionDropped(client *ssh.Client) <-chan error {
+	dropped := make(chan error, 1)
+	go func() {
+		dropped <- client.Wait()
+	}()
+	return dropped
+}
+
+// tunnelTarget is where one tunnel goes
+type tunnelTarget struct {
+	endpoint internal.EndpointIface
+	// label names the target when several are opened at once, e.g. reader
+	label string
+	// login is how to log in to the database, if it is known
+	login *internal.DBLogin
+}
+
+// tunnelStatus tells the user where to connect, with a connection string
+// for each target whose login is known. Passwords are only shown if reveal
+// is set.
+func tunnelStatus(f *flags, targets []tunnelTarget, port int, listening []string, reveal bool) string {
+	var b strings.Builder
+	credentials := " using regular credentials"
+	for _, t := range targets {
+		if t.login != nil && t.login.Password != nil {
+			credentials = ""
+		}
+	}
+	fmt.Fprintf(&b, "Tunnel started. Connect on %s port %s with your DB client%s. Press Ctrl-C to end",
+		f.localAddress, strings.Join(listening, " and "), credentials)
+	hasPassword := false
+	for i, t := range targets {
+		if t.login == nil {
+			continue
+		}
+		connection, err := t.login.ConnectionString(f.localAddress, port+i, reveal)
+		if err != nil {
+			fmt.Fprintf(&b, "\n\n%v%s", err, hintSuffix(err))
+			continue
+		}
+		label := ""
+		if t.label != "" {
+			label = " (" + t.label + ")"
+		}
+		fmt.Fprintf(&b, "\n\nConnection%s: %s", label, connection)
+		if t.login.Password != nil {
+			hasPassword = true
+			// Getting the password refreshes IAM auth tokens, so the
+			// description of it is up to date
+			password, err := t.login.Password.Password()
+			switch {
+			case err != nil:
+				fmt.Fprintf(&b, "\nPassword: %v%s", err, hintSuffix(err))
+			case reveal:
+				fmt.Fprintf(&b, "\nPassword: %s", password)
+			default:
+				fmt.Fprintf(&b, "\nPassword: %s", t.login.Password)
+			}
+		}
+	}
+	if hasPassword && !reveal {
+		b.WriteString("\n\np: show passwords")
+	} else if reveal {
+		b.WriteString("\n\np: hide passwords")
+	}
+	return b.String()
+}
+
+func validClient(client string) bool {
+	for _, c := range internal.Clients {
+		if c == client {
 			return true
-		case "j", "<Down>":
-			optionsList.ScrollDown()
-		case "k", "<Up>":
-			optionsList.ScrollUp()
-		case "<C-d>":
-			optionsList.ScrollHalfPageDown()
-		case "<C-u>":
-			optionsList.ScrollHalfPageUp()
-		case "<C-f>":
-			optionsList.ScrollPageDown()
-		case "<C-b>":
-			optionsList.ScrollPageUp()
-		case "<Home>":
-			optionsList.ScrollTop()
-		case "G", "<End>":
-			optionsList.ScrollBottom()
-		case "<Enter>", "<Space>":
-			return false
 		}
 	}
 	return false
 }
+
+// stringList is a flag.Value that collects every occurrence of a repeated flag
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func joinAuthOrder(order []internal.AuthMethodType) string {
+	var names []string
+	for _, m := range order {
+		names = append(names, string(m))
+	}
+	return strings.Join(names, ",")
+}
+
+func waitForHooks(hooks []*internal.CommandHook) {
+	for _, hook := range hooks {
+		hook.Wait()
+	}
+}
+
+// configureProxy works out the proxy from -proxy or the environment, adding
+// -no-proxy and the -proxy-user credentials. Returns nil for a direct
+// connection.
+func configureProxy(statusLabel *widgets.Paragraph, f *flags) *internal.Proxy {
+	var proxy *internal.Proxy
+	var err error
+	switch f.proxy {
+	case "none":
+		return nil
+	case "":
+		proxy, err = internal.ProxyFromEnvironment()
+	default:
+		proxy, err = internal.ParseProxy(f.proxy, "")
+	}
+	if err != nil {
+		fatal(statusLabel, "Invalid proxy", err)
+	}
+	if proxy == nil {
+		return nil
+	}
+	if f.noProxy != "" {
+		proxy.NoProxy = f.noProxy
+	}
+	if f.proxyUser != "" {
+		password := os.Getenv("TUNNELLER_PROXY_PASSWORD")
+		if password == "" {
+			password, err = promptInput(fmt.Sprintf("Password for %s at proxy %s", f.proxyUser, proxy), true)
+			if err != nil {
+				fatal(statusLabel, "Could not read the proxy password", err)
+			}
+		}
+		proxy.URL.User = url.UserPassword(f.proxyUser, password)
+	}
+	log.Debugf("Using proxy %s", proxy)
+	return proxy
+}
+
+// sshOptions combines the -ssh-options file with the -ssh-* flags, which
+// win over it
+type sshOptions struct {
+	file  *internal.SSHOptionsFile
+	flags internal.SSHOptions
+}
+
+func loadSSHOptions(f *flags) (*sshOptions, error) {
+	flagOptions, err := internal.ParseSSHOptions(map[string]string{
+		"timeout":             f.sshTimeout,
+		"ciphers":             f.sshCiphers,
+		"kex":                 f.sshKex,
+		"macs":                f.sshMACs,
+		"host-key-algorithms": f.sshHostKeyAlgs,
+		"client-version":      f.sshVersion,
+		"rekey-threshold":     f.sshRekey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	file, err := internal.LoadSSHOptionsFile(f.sshOptions)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.sshOptions, err)
+	}
+	return &sshOptions{file: file, flags: flagOptions}, nil
+}
+
+// forBastion returns the options for a bastion known by any of names
+func (o *sshOptions) forBastion(names ...string) *internal.SSHOptions {
+	options := o.file.For(names...).Merge(o.flags)
+	return &options
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+	"github.com/threetoes/tunneller/internal"
+)
+
+// sshEndpoints resolves -ssh-bastion and -target for tunnelling without AWS
+func sshEndpoints(statusLabel *widgets.Paragraph, f *flags, authConfig *internal.AuthConfig,
+	pendingKeys *internal.PendingKeys, proxy *internal.Proxy, sshOpts *sshOptions) (internal.EndpointIface, internal.EndpointIface) {
+	statusLabel.Text = fmt.Sprintf("Connecting to %s", f.sshBastion)
+	ui.Clear()
+	ui.Render(statusLabel)
+
+	sshConfig, err := internal.LoadSSHConfig(f.sshConfig)
+	if err != nil {
+		fatal(statusLabel, fmt.Sprintf("Could not read %s", f.sshConfig), err)
+	}
+	bastion, err := internal.ResolveSSHEndpoint(f.sshBastion, sshConfig, authConfig)
+	if err != nil {
+		fatal(statusLabel, "Could not resolve the bastion", err)
+	}
+
+	// Only the first host in the ProxyJump chain is dialled directly, but it
+	// does no harm to set it on all of them
+	for e := bastion; e != nil; e = e.ProxyJump {
+		e.Proxy = proxy
+		e.Options = sshOpts.forBastion(e.Host)
+	}
+	bastion.Options = sshOpts.forBastion(f.sshBastion, bastion.Host)
+
+	// Without AWS the ephemeral key is only any use if a CA signs it
+	if authConfig.UsesCertificates() {
+		keys, err := pendingKeys.Wait()
+		if err != nil {
+			fatal(statusLabel, "Could not generate keys", err)
+		}
+		for e := bastion; e != nil; e = e.ProxyJump {
+			e.PrivateKey, e.PublicKey = keys.PrivateKey, keys.PublicKey
+		}
+	}
+
+	target, err := internal.ParseEndpoint(f.target)
+	if err != nil {
+		fatal(statusLabel, "Invalid -target", err)
+	}
+	return bastion, target
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	ui "github.com/gizak/termui/v3"
+	"github.com/gizak/termui/v3/widgets"
+	log "github.com/sirupsen/logrus"
+	"github.com/threetoes/tunneller/internal"
+)
+
+var (
+	eventsOnce sync.Once
+	events     <-chan ui.Event
+)
+
+// uiEvents returns the terminal event channel. termui starts a new polling
+// goroutine for every PollEvents call and they steal each other's events,
+// so everything has to share one.
+func uiEvents() <-chan ui.Event {
+	eventsOnce.Do(func() {
+		events = ui.PollEvents()
+	})
+	return events
+}
+
+func handleListSelect(statusLabel *widgets.Paragraph, optionsList *widgets.List) bool {
+	return handleListSelectKeys(statusLabel, optionsList, nil)
+}
+
+// handleListSelectKeys is handleListSelect with extra key bindings, called
+// with the list's current row
+func handleListSelectKeys(statusLabel *widgets.Paragraph, optionsList *widgets.List, keys map[string]func(row int)) bool {
+	optionsList.SelectedRow = 0
+	uiEvents := uiEvents()
+	for {
+		termWidth, termHeight := ui.TerminalDimensions()
+		statusLabel.SetRect(0, 0, termWidth, 1)
+		optionsList.SetRect(0, 1, termWidth, termHeight)
+		ui.Render(statusLabel, optionsList)
+		e := <-uiEvents
+		switch e.ID {
+		case "<C-c>":
+			return true
+		case "j", "<Down>":
+			optionsList.ScrollDown()
+		case "k", "<Up>":
+			optionsList.ScrollUp()
+		case "<C-d>":
+			optionsList.ScrollHalfPageDown()
+		case "<C-u>":
+			optionsList.ScrollHalfPageUp()
+		case "<C-f>":
+			optionsList.ScrollPageDown()
+		case "<C-b>":
+			optionsList.ScrollPageUp()
+		case "<Home>":
+			optionsList.ScrollTop()
+		case "G", "<End>":
+			optionsList.ScrollBottom()
+		case "<Enter>", "<Space>":
+			return false
+		default:
+			if handler, ok := keys[e.ID]; ok {
+				handler(optionsList.SelectedRow)
+			}
+		}
+	}
+}
+
+var (
+	cleanupMu sync.Mutex
+	cleanups  []func()
+)
+
+// onExit registers f to be run by runCleanups, e.g. to stop an instance
+// tunneller started. They run in reverse order.
+func onExit(f func()) {
+	cleanupMu.Lock()
+	defer cleanupMu.Unlock()
+	cleanups = append(cleanups, f)
+}
+
+// runCleanups runs everything registered with onExit, once
+func runCleanups() {
+	cleanupMu.Lock()
+	pending := cleanups
+	cleanups = nil
+	cleanupMu.Unlock()
+	for i := len(pending) - 1; i >= 0; i-- {
+		pending[i]()
+	}
+}
+
+// quit tears down the terminal UI and exits, for when the user cancels
+func quit() {
+	ui.Close()
+	runCleanups()
+	os.Exit(0)
+}
+
+// showStatus replaces the screen with a status message
+func showStatus(statusLabel *widgets.Paragraph, text string) {
+	statusLabel.Text = text
+	fitStatus(statusLabel)
+	ui.Clear()
+	ui.Render(statusLabel)
+}
+
+// fitStatus sizes the status label to the width of the terminal and the
+// height of its wrapped text, centred vertically, so none of it is cut off
+func fitStatus(statusLabel *widgets.Paragraph) {
+	termWidth, termHeight := ui.TerminalDimensions()
+	// The border takes a cell on each side
+	inner := termWidth - 2
+	if inner < 1 {
+		inner = 1
+	}
+	cells := ui.ParseStyles(statusLabel.Text, statusLabel.TextStyle)
+	height := len(ui.SplitCells(ui.WrapCells(cells, uint(inner)), '\n')) + 2
+	if height > termHeight {
+		height = termHeight
+	}
+	top := (termHeight - height) / 2
+	statusLabel.SetRect(0, top, termWidth, top+height)
+}
+
+// fatal shows msg, err and any remediation hint in the status label long
+// enough to be read, then exits
+func fatal(statusLabel *widgets.Paragraph, msg string, err error) {
+	statusLabel.Text = fmt.Sprintf("%s: %v%s", msg, err, hintSuffix(err))
+	termWidth, termHeight := ui.TerminalDimensions()
+	statusLabel.SetRect(0, 0, termWidth, termHeight)
+	ui.Clear()
+	ui.Render(statusLabel)
+	time.Sleep(3 * time.Second)
+	ui.Close()
+	runCleanups()
+	log.Fatalf("%s: %v%s", msg, err, hintSuffix(err))
+}
+
+func hintSuffix(err error) string {
+	if hint := internal.Hint(err); hint != "" {
+		return "\n\nHint: " + hint
+	}
+	return ""
+}
+
+// promptInput asks a question in the terminal UI and returns what was typed.
+// Secret input is masked.
+func promptInput(question string, secret bool) (string, error) {
+	label := widgets.NewParagraph()
+	label.Title = "Ctrl-C to cancel, Enter to accept"
+	var input []rune
+	render := func() {
+		shown := string(input)
+		if secret {
+			shown = strings.Repeat("*", len(input))
+		}
+		label.Text = fmt.Sprintf("%s\n> %s", question, shown)
+		termWidth, _ := ui.TerminalDimensions()
+		label.SetRect(0, 0, termWidth, strings.Count(question, "\n")+4)
+		ui.Clear()
+		ui.Render(label)
+	}
+	for {
+		render()
+		e := <-uiEvents()
+		if e.Type != ui.KeyboardEvent {
+			continue
+		}
+		switch e.ID {
+		case "<C-c>":
+			return "", fmt.Errorf("cancelled by user")
+		case "<Enter>":
+			ui.Clear()
+			return string(input), nil
+		case "<Backspace>", "<C-<Backspace>>":
+			if len(input) > 0 {
+				input = input[:len(input)-1]
+			}
+		case "<Space>":
+			input = append(input, ' ')
+		default:
+			if r := []rune(e.ID); len(r) == 1 {
+				input = append(input, r[0])
+			}
+		}
+	}
+}
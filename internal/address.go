@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	hostnamePattern   = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]*[A-Za-z0-9_])?$`)
+	instanceIDPattern = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+)
+
+// formatAddress joins a user, host and port into user@host:port, with IPv6
+// hosts in brackets, so that parseAddress gives them back. The user is left
+// out if it is empty.
+func formatAddress(user, host string, port int) string {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if user == "" {
+		return address
+	}
+	return user + "@" + address
+}
+
+// parseAddress splits an address into its user, host and port. It accepts
+// user@host:port, bracketed IPv6 literals like user@[fd00::1]:22 and
+// ssh://user@host:port URIs. The user and port are optional, and a missing
+// port is returned as 0. The user is everything before the last @, so it can
+// contain @ itself.
+func parseAddress(s string) (user string, host string, port int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", "", 0, fmt.Errorf("empty address")
+	}
+	if strings.Contains(s, "://") {
+		return parseAddressURI(s)
+	}
+
+	rest := s
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		user = rest[:i]
+		rest = rest[i+1:]
+		if user == "" {
+			return "", "", 0, fmt.Errorf("empty user in %q", s)
+		}
+	}
+
+	var portStr string
+	switch {
+	case strings.HasPrefix(rest, "["):
+		end := strings.Index(rest, "]")
+		if end < 0 {
+			return "", "", 0, fmt.Errorf("missing ] in %q", s)
+		}
+		host = rest[1:end]
+		after := rest[end+1:]
+		if after != "" {
+			if !strings.HasPrefix(after, ":") {
+				return "", "", 0, fmt.Errorf("unexpected %q after ] in %q", after, s)
+			}
+			portStr = after[1:]
+			if portStr == "" {
+				return "", "", 0, fmt.Errorf("empty port in %q", s)
+			}
+		}
+		if ip := net.ParseIP(stripZone(host)); ip == nil || ip.To4() != nil {
+			return "", "", 0, fmt.Errorf("%q in brackets is not an IPv6 address", host)
+		}
+	case strings.Count(rest, ":") > 1:
+		// A bare IPv6 literal can't have a port, it would be ambiguous
+		if net.ParseIP(stripZone(rest)) == nil {
+			return "", "", 0, fmt.Errorf("%q is not a valid IPv6 address, IPv6 addresses with a port must be "+
+				"written as [address]:port", rest)
+		}
+		host = rest
+	case strings.Contains(rest, ":"):
+		i := strings.Index(rest, ":")
+		host, portStr = rest[:i], rest[i+1:]
+		if portStr == "" {
+			return "", "", 0, fmt.Errorf("empty port in %q", s)
+		}
+	default:
+		host = rest
+	}
+
+	if err := validateHost(host); err != nil {
+		return "", "", 0, err
+	}
+	if portStr != "" {
+		if port, err = parsePort(portStr); err != nil {
+			return "", "", 0, err
+		}
+	}
+	return user, host, port, nil
+}
+
+func parseAddressURI(s string) (user string, host string, port int, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid URI %q: %v", s, err)
+	}
+	if u.Scheme != "ssh" {
+		return "", "", 0, fmt.Errorf("unsupported scheme %q, only ssh:// is supported", u.Scheme)
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" || u.Fragment != "" {
+		return "", "", 0, fmt.Errorf("unexpected path, query or fragment in %q", s)
+	}
+	if u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return "", "", 0, fmt.Errorf("passwords in URIs are not supported")
+		}
+		user = u.User.Username()
+	}
+	host = u.Hostname()
+	if err := validateHost(host); err != nil {
+		return "", "", 0, err
+	}
+	if u.Port() != "" {
+		if port, err = parsePort(u.Port()); err != nil {
+			return "", "", 0, err
+		}
+	} else if strings.HasSuffix(u.Host, ":") {
+		return "", "", 0, fmt.Errorf("empty port in %q", s)
+	}
+	return user, host, port, nil
+}
+
+func validateHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if net.ParseIP(stripZone(host)) != nil {
+		return nil
+	}
+	if !hostnamePattern.MatchString(host) {
+		return fmt.Errorf("%q is not a valid host name or IP address", host)
+	}
+	return nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q, it must be a number from 1 to 65535", s)
+	}
+	return port, nil
+}
+
+func stripZone(host string) string {
+	if i := strings.Index(host, "%"); i >= 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// EC2Target identifies an EC2 instance by its ID or by the value of its Name
+// tag, with an optional OS user and SSH port
+type EC2Target struct {
+	User       string
+	InstanceID string
+	Name       string
+	Port       int
+}
+
+// ParseEC2Target parses [user@]i-0123456789abcdef0[:port] or
+// [user@]name:tag-value[:port]. A trailing :port is only taken as a port if
+// it is numeric, so Name tags containing colons still work. A missing port
+// is returned as 0.
+func ParseEC2Target(s string) (EC2Target, error) {
+	target := EC2Target{}
+	rest := strings.TrimSpace(s)
+	if strings.HasPrefix(rest, "ssh://") {
+		rest = strings.TrimSuffix(strings.TrimPrefix(rest, "ssh://"), "/")
+	}
+	if i := strings.LastIndex(rest, "@"); i >= 0 {
+		target.User = rest[:i]
+		rest = rest[i+1:]
+		if target.User == "" {
+			return target, fmt.Errorf("empty user in %q", s)
+		}
+	}
+
+	if strings.HasPrefix(rest, "name:") {
+		name := strings.TrimPrefix(rest, "name:")
+		if i := strings.LastIndex(name, ":"); i >= 0 && isDigits(name[i+1:]) {
+			port, err := parsePort(name[i+1:])
+			if err != nil {
+				return target, err
+			}
+			target.Port = port
+			name = name[:i]
+		}
+		if name == "" {
+			return target, fmt.Errorf("empty Name tag value in %q", s)
+		}
+		target.Name = name
+		return target, nil
+	}
+
+	if i := strings.LastIndex(rest, ":"); i >= 0 {
+		port, err := parsePort(rest[i+1:])
+		if err != nil {
+			return target, err
+		}
+		target.Port = port
+		rest = rest[:i]
+	}
+	if !instanceIDPattern.MatchString(rest) {
+		return target, fmt.Errorf("%q is not an instance ID (i-...) or name:tag-value", rest)
+	}
+	target.InstanceID = rest
+	return target, nil
+}
+
+// String formats the target as ParseEC2Target accepts it, leaving out an
+// empty user and a zero port. Name tags that contain @ or end in :digits
+// don't parse back the same.
+func (t EC2Target) String() string {
+	s := t.InstanceID
+	if s == "" {
+		s = "name:" + t.Name
+	}
+	if t.User != "" {
+		s = t.User + "@" + s
+	}
+	if t.Port != 0 {
+		s += ":" + strconv.Itoa(t.Port)
+	}
+	return s
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,478 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// AuthMethodType is a way of authenticating to a bastion
+type AuthMethodType string
+
+const (
+	// AuthEphemeral uses the temporary key generated at startup. For EC2
+	// bastions it is pushed with EC2 Instance Connect before authenticating.
+	AuthEphemeral AuthMethodType = "ephemeral"
+	// AuthAgent uses the keys held by the agent listening on SSH_AUTH_SOCK
+	AuthAgent AuthMethodType = "agent"
+	// AuthKey uses private key files in OpenSSH or PEM format
+	AuthKey AuthMethodType = "key"
+	// AuthKeyboardInteractive answers the server's keyboard-interactive challenges
+	AuthKeyboardInteractive AuthMethodType = "keyboard-interactive"
+	// AuthPassword sends a password
+	AuthPassword AuthMethodType = "password"
+)
+
+// DefaultAuthOrder is the order authentication methods are tried in when none is configured
+var DefaultAuthOrder = []AuthMethodType{
+	AuthEphemeral,
+	AuthAgent,
+	AuthKey,
+	AuthKeyboardInteractive,
+	AuthPassword,
+}
+
+// ParseAuthOrder parses a comma separated list of authentication methods
+func ParseAuthOrder(s string) ([]AuthMethodType, error) {
+	var order []AuthMethodType
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, m := range DefaultAuthOrder {
+			if string(m) == name {
+				order = append(order, m)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown authentication method %q", name)
+		}
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("no authentication methods given")
+	}
+	return order, nil
+}
+
+// DefaultIdentityFiles returns the standard OpenSSH private key files that
+// exist in the user's ~/.ssh directory
+func DefaultIdentityFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		p := path.Join(home, ".ssh", name)
+		if _, err := os.Stat(p); err == nil {
+			files = append(files, p)
+		}
+	}
+	return files
+}
+
+// Prompter asks the user a question. secret is set for passphrases and
+// passwords, which must not be echoed.
+type Prompter func(question string, secret bool) (string, error)
+
+// AuthConfig describes how to authenticate to a bastion beyond a single
+// in-memory key. Anything asked of the user is remembered, so later
+// connections don't prompt again.
+type AuthConfig struct {
+	// Order lists the methods to try, first to last. Empty means DefaultAuthOrder.
+	Order         []AuthMethodType
+	IdentityFiles []string
+	Prompt        Prompter
+	// CA, if set, signs the ephemeral key with a certificate instead of it
+	// being pushed with EC2 Instance Connect
+	CA *CertificateAuthority
+
+	cacheOnce sync.Once
+	cache     *authCache
+}
+
+// authCache remembers keys, passwords and answers. It is shared by every
+// config derived from the same AuthConfig, so a jump host and the bastion
+// behind it don't prompt separately.
+type authCache struct {
+	mu          sync.Mutex
+	fileSigners map[string]ssh.Signer
+	fileErrors  map[string]error
+	password    string
+	answers     map[string]string
+	agentClient agent.Agent
+}
+
+func (a *AuthConfig) cached() *authCache {
+	a.cacheOnce.Do(func() {
+		if a.cache == nil {
+			a.cache = &authCache{}
+		}
+	})
+	return a.cache
+}
+
+// Uses reports whether method is one of the configured methods. A nil
+// AuthConfig only uses the in-memory key.
+func (a *AuthConfig) Uses(method AuthMethodType) bool {
+	if a == nil {
+		return method == AuthEphemeral
+	}
+	for _, m := range a.order() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// usesOtherThan reports whether any method besides method is configured
+func (a *AuthConfig) usesOtherThan(method AuthMethodType) bool {
+	if a == nil {
+		return false
+	}
+	for _, m := range a.order() {
+		if m != method {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesCertificates reports whether the ephemeral key is presented with a
+// certificate signed by a CA
+func (a *AuthConfig) UsesCertificates() bool {
+	return a != nil && a.CA != nil && a.Uses(AuthEphemeral)
+}
+
+// withIdentityFiles returns a copy of the config that tries files before
+// its own identity files
+func (a *AuthConfig) withIdentityFiles(files []string) *AuthConfig {
+	if a == nil || len(files) == 0 {
+		return a
+	}
+	return &AuthConfig{
+		Order:         a.Order,
+		IdentityFiles: append(append([]string{}, files...), a.IdentityFiles...),
+		Prompt:        a.Prompt,
+		CA:            a.CA,
+		cache:         a.cached(),
+	}
+}
+
+func (a *AuthConfig) order() []AuthMethodType {
+	if len(a.Order) == 0 {
+		return DefaultAuthOrder
+	}
+	return a.Order
+}
+
+// clientConfig builds the SSH config for user. key is the in-memory private
+// key, if there is one, used as the ephemeral method.
+func (a *AuthConfig) clientConfig(user string, key string) (*ssh.ClientConfig, error) {
+	var keySigner ssh.Signer
+	if key != "" {
+		var err error
+		keySigner, err = ssh.ParsePrivateKey([]byte(key))
+		if err != nil {
+			return nil, err
+		}
+	}
+	config := &ssh.ClientConfig{
+		User:            user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	if a == nil {
+		if keySigner == nil {
+			return nil, fmt.Errorf("no private key or authentication methods configured")
+		}
+		config.Auth = []ssh.AuthMethod{ssh.PublicKeys(keySigner)}
+		return config, nil
+	}
+
+	// ssh only tries each kind of method once, so every key based method
+	// is folded into a single publickey method where the first of them sits
+	addedKeys := false
+	for _, m := range a.order() {
+		switch m {
+		case AuthEphemeral, AuthAgent, AuthKey:
+			if !addedKeys {
+				config.Auth = append(config.Auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+					return a.signers(keySigner, user)
+				}))
+				addedKeys = true
+			}
+		case AuthKeyboardInteractive:
+			config.Auth = append(config.Auth, ssh.KeyboardInteractive(a.challenge))
+		case AuthPassword:
+			config.Auth = append(config.Auth, ssh.PasswordCallback(a.getPassword))
+		}
+	}
+	return config, nil
+}
+
+func (a *AuthConfig) signers(keySigner ssh.Signer, user string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, m := range a.order() {
+		switch m {
+		case AuthEphemeral:
+			if keySigner == nil {
+				continue
+			}
+			if a.CA == nil {
+				signers = append(signers, keySigner)
+				continue
+			}
+			certSigner, err := a.CA.certSigner(keySigner, user)
+			if err != nil {
+				log.Warnf("Not using the ephemeral key: %v", err)
+				continue
+			}
+			signers = append(signers, certSigner)
+		case AuthAgent:
+			agentSigners, err := a.agentSigners()
+			if err != nil {
+				log.Warnf("Not using ssh-agent: %v", err)
+				continue
+			}
+			signers = append(signers, agentSigners...)
+		case AuthKey:
+			for _, f := range a.IdentityFiles {
+				s, err := a.fileSigner(f)
+				if err != nil {
+					log.Warnf("Not using key %s: %v", f, err)
+					continue
+				}
+				signers = append(signers, s)
+			}
+		}
+	}
+	if len(signers) == 0 {
+		// Not an error, which would stop the methods after this one being
+		// tried
+		log.Debugf("No usable keys found")
+	}
+	return signers, nil
+}
+
+func (a *AuthConfig) agentSigners() ([]ssh.Signer, error) {
+	c := a.cached()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.agentClient == nil {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not connect to ssh-agent")
+		}
+		c.agentClient = agent.NewClient(conn)
+	}
+	return c.agentClient.Signers()
+}
+
+// fileSigner returns the signer for a private key file. Failures are
+// remembered too, so a wrong passphrase isn't asked for again on every
+// connection.
+func (a *AuthConfig) fileSigner(file string) (ssh.Signer, error) {
+	c := a.cached()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.fileSigners[file]; ok {
+		return s, nil
+	}
+	if err, ok := c.fileErrors[file]; ok {
+		return nil, err
+	}
+	s, err := a.loadFileSigner(file)
+	if err != nil {
+		c.failFile(file, err)
+		return nil, err
+	}
+	if c.fileSigners == nil {
+		c.fileSigners = make(map[string]ssh.Signer)
+	}
+	c.fileSigners[file] = s
+	return s, nil
+}
+
+// loadFileSigner reads a private key file. A passphrase protected key whose
+// public half can be read without the passphrase is only decrypted once a
+// server accepts it, so connections that get in with another key, such as
+// the ephemeral one, never ask for it.
+func (a *AuthConfig) loadFileSigner(file string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return s, err
+	}
+	pub := missing.PublicKey
+	if pub == nil {
+		// PEM keys don't carry their public half, but there is usually a
+		// .pub file next to them
+		if pubData, err := ioutil.ReadFile(file + ".pub"); err == nil {
+			pub, _, _, _, _ = ssh.ParseAuthorizedKey(pubData)
+		}
+	}
+	if pub == nil {
+		return a.decryptPrivateKey(file, data)
+	}
+	return &lazySigner{pub: pub, decrypt: func() (ssh.Signer, error) {
+		s, err := a.decryptPrivateKey(file, data)
+		if err != nil {
+			c := a.cached()
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			delete(c.fileSigners, file)
+			c.failFile(file, err)
+		}
+		return s, err
+	}}, nil
+}
+
+func (c *authCache) failFile(file string, err error) {
+	if c.fileErrors == nil {
+		c.fileErrors = make(map[string]error)
+	}
+	c.fileErrors[file] = err
+}
+
+func (a *AuthConfig) parsePrivateKey(file string, data []byte) (ssh.Signer, error) {
+	s, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return s, err
+	}
+	return a.decryptPrivateKey(file, data)
+}
+
+func (a *AuthConfig) decryptPrivateKey(file string, data []byte) (ssh.Signer, error) {
+	if a.Prompt == nil {
+		return nil, fmt.Errorf("key is passphrase protected and there is no way to ask for it")
+	}
+	passphrase, err := a.Prompt(fmt.Sprintf("Passphrase for %s", file), true)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+}
+
+func (a *AuthConfig) getPassword() (string, error) {
+	c := a.cached()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.password != "" {
+		return c.password, nil
+	}
+	if a.Prompt == nil {
+		return "", fmt.Errorf("no way to ask for a password")
+	}
+	password, err := a.Prompt("Password", true)
+	if err != nil {
+		return "", err
+	}
+	c.password = password
+	return password, nil
+}
+
+func (a *AuthConfig) challenge(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	c := a.cached()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.answers == nil {
+		c.answers = make(map[string]string)
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if answer, ok := c.answers[q]; ok {
+			answers[i] = answer
+			continue
+		}
+		// Only passwords are remembered, one time codes have to be asked for every time
+		isPassword := !echos[i] && strings.Contains(strings.ToLower(q), "password")
+		if isPassword && c.password != "" {
+			answers[i] = c.password
+			continue
+		}
+		if a.Prompt == nil {
+			return nil, fmt.Errorf("no way to answer %q", q)
+		}
+		question := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(q), ":"))
+		if instruction != "" {
+			question = instruction + "\n" + question
+		}
+		answer, err := a.Prompt(question, !echos[i])
+		if err != nil {
+			return nil, err
+		}
+		if isPassword {
+			c.answers[q] = answer
+		}
+		answers[i] = answer
+	}
+	return answers, nil
+}
+
+// lazySigner holds the public half of a passphrase protected key and only
+// decrypts the private half the first time it has to sign
+type lazySigner struct {
+	pub     ssh.PublicKey
+	decrypt func() (ssh.Signer, error)
+
+	mu     sync.Mutex
+	signer ssh.Signer
+	err    error
+}
+
+func (l *lazySigner) PublicKey() ssh.PublicKey {
+	return l.pub
+}
+
+func (l *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	return s.Sign(rand, data)
+}
+
+func (l *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	as, ok := s.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("key can't sign with %s", algorithm)
+	}
+	return as.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func (l *lazySigner) load() (ssh.Signer, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.signer == nil && l.err == nil {
+		l.signer, l.err = l.decrypt()
+	}
+	return l.signer, l.err
+}
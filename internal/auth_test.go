@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func writePassphraseKey(t *testing.T, passphrase string) string {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFileSignerPassphrase(t *testing.T) {
+	tests := []struct {
+		name    string
+		answer  string
+		wantErr bool
+	}{
+		{name: "right passphrase", answer: "secret"},
+		{name: "wrong passphrase", answer: "guess", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writePassphraseKey(t, "secret")
+			prompts := 0
+			a := &AuthConfig{Order: []AuthMethodType{AuthKey}, Prompt: func(string, bool) (string, error) {
+				prompts++
+				return tt.answer, nil
+			}}
+			jump := a.withIdentityFiles([]string{file})
+
+			s, err := jump.fileSigner(file)
+			if err != nil {
+				t.Fatalf("fileSigner() error = %v", err)
+			}
+			if prompts != 0 {
+				t.Fatalf("asked for the passphrase %d times before signing", prompts)
+			}
+			sig, err := s.Sign(rand.Reader, []byte("data"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Sign() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := s.PublicKey().Verify([]byte("data"), sig); err != nil {
+					t.Fatalf("signature doesn't verify: %v", err)
+				}
+			}
+
+			// The bastion shares the jump host's cache, so it doesn't ask again
+			bastion := a.withIdentityFiles([]string{file})
+			s, err = bastion.fileSigner(file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("second fileSigner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if _, err := s.Sign(rand.Reader, []byte("data")); err != nil {
+					t.Fatalf("second Sign() error = %v", err)
+				}
+			}
+			if prompts != 1 {
+				t.Fatalf("asked for the passphrase %d times, want 1", prompts)
+			}
+		})
+	}
+}
+
+func TestParseAuthOrder(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []AuthMethodType
+		wantErr bool
+	}{
+		{in: "agent", want: []AuthMethodType{AuthAgent}},
+		{in: "key,ephemeral", want: []AuthMethodType{AuthKey, AuthEphemeral}},
+		{in: " password , keyboard-interactive ", want: []AuthMethodType{AuthPassword, AuthKeyboardInteractive}},
+		{in: "agent,,key,", want: []AuthMethodType{AuthAgent, AuthKey}},
+		{in: "ephemeral,agent,key,keyboard-interactive,password", want: DefaultAuthOrder},
+		{in: "", wantErr: true},
+		{in: " , ", wantErr: true},
+		{in: "agent,publickey", wantErr: true},
+		{in: "Agent", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAuthOrder(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAuthOrder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseAuthOrder() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
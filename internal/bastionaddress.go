@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+)
+
+// AddressMode picks which of an instance's addresses to connect to
+type AddressMode string
+
+const (
+	// AddressAuto uses the first address the instance has, in the order of AutoAddressOrder
+	AddressAuto        AddressMode = "auto"
+	AddressPublicIPv4  AddressMode = "public"
+	AddressPrivateIPv4 AddressMode = "private"
+	AddressIPv6        AddressMode = "ipv6"
+	AddressPublicDNS   AddressMode = "dns"
+	// AddressProbe tries every address the instance has at once and uses the
+	// most preferred one that accepts a connection
+	AddressProbe AddressMode = "probe"
+)
+
+// AddressModes lists every AddressMode, in the order the TUI cycles through them
+var AddressModes = []AddressMode{
+	AddressAuto,
+	AddressPublicIPv4,
+	AddressPrivateIPv4,
+	AddressIPv6,
+	AddressPublicDNS,
+	AddressProbe,
+}
+
+// DefaultProbeTimeout is how long ProbeAddresses waits for connections
+const DefaultProbeTimeout = 2 * time.Second
+
+// AutoAddressOrder is the order addresses are preferred in by AddressAuto
+var AutoAddressOrder = []AddressMode{
+	AddressPublicIPv4,
+	AddressIPv6,
+	AddressPublicDNS,
+	AddressPrivateIPv4,
+}
+
+// ParseAddressMode turns a name like "ipv6" into an AddressMode
+func ParseAddressMode(s string) (AddressMode, error) {
+	switch AddressMode(s) {
+	case AddressAuto, AddressPublicIPv4, AddressPrivateIPv4, AddressIPv6, AddressPublicDNS, AddressProbe:
+		return AddressMode(s), nil
+	}
+	return "", fmt.Errorf("unknown address mode %q, expected one of auto, public, private, ipv6, dns or probe", s)
+}
+
+// InstanceAddress is one way of reaching an instance
+type InstanceAddress struct {
+	Mode AddressMode
+	Host string
+}
+
+func (a InstanceAddress) String() string {
+	return fmt.Sprintf("%s (%s)", a.Host, a.Mode)
+}
+
+// InstanceAddresses lists the addresses an instance has, in AutoAddressOrder
+func InstanceAddresses(instance *ec2.Instance) []InstanceAddress {
+	var addresses []InstanceAddress
+	for _, mode := range AutoAddressOrder {
+		if host := instanceAddress(instance, mode); host != "" {
+			addresses = append(addresses, InstanceAddress{Mode: mode, Host: host})
+		}
+	}
+	return addresses
+}
+
+func instanceAddress(instance *ec2.Instance, mode AddressMode) string {
+	switch mode {
+	case AddressPublicIPv4:
+		return aws.StringValue(instance.PublicIpAddress)
+	case AddressPrivateIPv4:
+		return aws.StringValue(instance.PrivateIpAddress)
+	case AddressPublicDNS:
+		return aws.StringValue(instance.PublicDnsName)
+	case AddressIPv6:
+		for _, ni := range instance.NetworkInterfaces {
+			for _, a := range ni.Ipv6Addresses {
+				if v := aws.StringValue(a.Ipv6Address); v != "" {
+					return v
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// ProbeAddresses tries to open a TCP connection to port on every address at
+// the same time, through proxy if it isn't nil, and returns the first
+// address in the list that accepted one within timeout
+func ProbeAddresses(ctx context.Context, proxy *Proxy, addresses []InstanceAddress, port int, timeout time.Duration) (InstanceAddress, error) {
+	if len(addresses) == 0 {
+		return InstanceAddress{}, fmt.Errorf("no addresses to probe")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]error, len(addresses))
+	var wg sync.WaitGroup
+	for i, a := range addresses {
+		wg.Add(1)
+		go func(i int, a InstanceAddress) {
+			defer wg.Done()
+			conn, err := proxy.DialContext(ctx, "tcp", net.JoinHostPort(a.Host, strconv.Itoa(port)))
+			if err == nil {
+				conn.Close()
+			}
+			results[i] = err
+		}(i, a)
+	}
+	wg.Wait()
+
+	var failures []string
+	for i, a := range addresses {
+		if results[i] == nil {
+			log.Debugf("Probe picked %s", a)
+			return a, nil
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", a, results[i]))
+	}
+	return InstanceAddress{}, fmt.Errorf("no address accepted a connection on port %d (%s)", port, strings.Join(failures, "; "))
+}
+
+// TargetFamily picks whether a target host name is handed to the bastion to
+// resolve, or resolved locally to an address of a particular family. RDS
+// endpoint names resolve to their private addresses from anywhere, so
+// resolving locally is a way to force IPv6 for dual-stack databases.
+type TargetFamily string
+
+const (
+	TargetFamilyAuto TargetFamily = "auto"
+	TargetFamilyIPv4 TargetFamily = "ipv4"
+	TargetFamilyIPv6 TargetFamily = "ipv6"
+)
+
+// ParseTargetFamily turns a name like "ipv6" into a TargetFamily
+func ParseTargetFamily(s string) (TargetFamily, error) {
+	switch TargetFamily(s) {
+	case TargetFamilyAuto, TargetFamilyIPv4, TargetFamilyIPv6:
+		return TargetFamily(s), nil
+	}
+	return "", fmt.Errorf("unknown address family %q, expected one of auto, ipv4 or ipv6", s)
+}
+
+// ResolveTarget replaces the endpoint's host name with one of its addresses
+// in the given family. TargetFamilyAuto leaves it to the bastion to resolve.
+func ResolveTarget(ctx context.Context, e *Endpoint, family TargetFamily) error {
+	if family == TargetFamilyAuto || net.ParseIP(stripZone(e.Host)) != nil {
+		return nil
+	}
+	network := "ip4"
+	if family == TargetFamilyIPv6 {
+		network = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, e.Host)
+	if err != nil {
+		return fmt.Errorf("could not resolve an %s address for %s: %v", family, e.Host, err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("%s has no %s addresses", e.Host, family)
+	}
+	e.Host = ips[0].String()
+	return nil
+}
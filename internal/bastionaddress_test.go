@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func TestParseAddressMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    AddressMode
+		wantErr bool
+	}{
+		{in: "auto", want: AddressAuto},
+		{in: "public", want: AddressPublicIPv4},
+		{in: "private", want: AddressPrivateIPv4},
+		{in: "ipv6", want: AddressIPv6},
+		{in: "dns", want: AddressPublicDNS},
+		{in: "probe", want: AddressProbe},
+		{in: "", wantErr: true},
+		{in: "IPv6", wantErr: true},
+		{in: "ipv4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseAddressMode(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseAddressMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseAddressMode() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func addressedInstance(public, private, dns, ipv6 string) *ec2.Instance {
+	inst := &ec2.Instance{}
+	if public != "" {
+		inst.PublicIpAddress = aws.String(public)
+	}
+	if private != "" {
+		inst.PrivateIpAddress = aws.String(private)
+	}
+	if dns != "" {
+		inst.PublicDnsName = aws.String(dns)
+	}
+	if ipv6 != "" {
+		inst.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+			{},
+			{Ipv6Addresses: []*ec2.InstanceIpv6Address{{Ipv6Address: aws.String("")}, {Ipv6Address: aws.String(ipv6)}}},
+		}
+	}
+	return inst
+}
+
+func TestEC2EndpointHost(t *testing.T) {
+	everything := addressedInstance("203.0.113.10", "10.0.1.10", "ec2-203-0-113-10.compute.amazonaws.com", "2001:db8::10")
+	privateOnly := addressedInstance("", "10.0.1.10", "", "")
+	ipv6Only := addressedInstance("", "10.0.1.10", "", "2001:db8::10")
+	tests := []struct {
+		name          string
+		instance      *ec2.Instance
+		mode          AddressMode
+		usePrivate    bool
+		want          string
+		wantAddresses []AddressMode
+	}{
+		{name: "default", instance: everything, want: "203.0.113.10",
+			wantAddresses: []AddressMode{AddressPublicIPv4, AddressIPv6, AddressPublicDNS, AddressPrivateIPv4}},
+		{name: "auto", instance: ipv6Only, mode: AddressAuto, want: "2001:db8::10",
+			wantAddresses: []AddressMode{AddressIPv6, AddressPrivateIPv4}},
+		{name: "auto falls back to private", instance: privateOnly, mode: AddressAuto, want: "10.0.1.10",
+			wantAddresses: []AddressMode{AddressPrivateIPv4}},
+		{name: "public", instance: everything, mode: AddressPublicIPv4, want: "203.0.113.10"},
+		{name: "private", instance: everything, mode: AddressPrivateIPv4, want: "10.0.1.10"},
+		{name: "ipv6", instance: everything, mode: AddressIPv6, want: "2001:db8::10"},
+		{name: "dns", instance: everything, mode: AddressPublicDNS, want: "ec2-203-0-113-10.compute.amazonaws.com"},
+		{name: "UsePrivate wins", instance: everything, mode: AddressIPv6, usePrivate: true, want: "10.0.1.10"},
+		{name: "missing address", instance: privateOnly, mode: AddressPublicIPv4, want: ""},
+		{name: "no addresses", instance: &ec2.Instance{}, mode: AddressAuto, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &EC2Endpoint{Instance: tt.instance, AddressMode: tt.mode, UsePrivate: tt.usePrivate}
+			if got := e.Host(); got != tt.want {
+				t.Errorf("Host() = %q, want %q", got, tt.want)
+			}
+			if tt.wantAddresses == nil {
+				return
+			}
+			var modes []AddressMode
+			for _, a := range InstanceAddresses(tt.instance) {
+				modes = append(modes, a.Mode)
+			}
+			if !reflect.DeepEqual(modes, tt.wantAddresses) {
+				t.Errorf("InstanceAddresses() modes = %v, want %v", modes, tt.wantAddresses)
+			}
+		})
+	}
+}
+
+func TestProbeAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	listening := InstanceAddress{Mode: AddressPrivateIPv4, Host: "127.0.0.1"}
+	unreachable := InstanceAddress{Mode: AddressIPv6, Host: "::1"}
+	tests := []struct {
+		name      string
+		addresses []InstanceAddress
+		port      int
+		want      InstanceAddress
+		wantErr   bool
+	}{
+		{name: "first that accepts", addresses: []InstanceAddress{unreachable, listening}, port: port, want: listening},
+		{name: "none accept", addresses: []InstanceAddress{unreachable, listening}, port: closedPort, wantErr: true},
+		{name: "no addresses", port: port, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProbeAddresses(context.Background(), nil, tt.addresses, tt.port, time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProbeAddresses() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ProbeAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		host   string
+		family TargetFamily
+		want   string
+	}{
+		{name: "auto leaves it to the bastion", host: "localhost", family: TargetFamilyAuto, want: "localhost"},
+		{name: "IPv4", host: "localhost", family: TargetFamilyIPv4, want: "127.0.0.1"},
+		{name: "IPv4 literal", host: "10.0.0.5", family: TargetFamilyIPv6, want: "10.0.0.5"},
+		{name: "IPv6 literal", host: "fd00::5", family: TargetFamilyIPv4, want: "fd00::5"},
+		{name: "IPv6 literal with a zone", host: "fe80::1%eth0", family: TargetFamilyIPv4, want: "fe80::1%eth0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Endpoint{Host: tt.host, Port: 5432}
+			if err := ResolveTarget(context.Background(), e, tt.family); err != nil {
+				t.Fatalf("ResolveTarget() error = %v", err)
+			}
+			if e.Host != tt.want {
+				t.Fatalf("host = %q, want %q", e.Host, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	log "github.com/sirupsen/logrus"
+)
+
+// BastionCandidate is an instance scored on how likely it is to be able to
+// reach a database
+type BastionCandidate struct {
+	Instance *ec2.Instance
+	Score    int
+	// Reasons are what counts in the instance's favour
+	Reasons []string
+	// Problems are what counts against it
+	Problems []string
+	// Rejected is set when the instance almost certainly can't reach the
+	// database
+	Rejected bool
+}
+
+// Weights of each check, chosen so a failed network check always outweighs
+// every convenience one
+const (
+	scoreSameVPC       = 100
+	scoreSecurityGroup = 50
+	scoreReachable     = 20
+	scoreTagged        = 10
+	scoreSameAZ        = 5
+)
+
+// BastionRanker scores instances against the network placement of a
+// database: its VPC, security groups, port and availability zone
+type BastionRanker struct {
+	vpcID  string
+	az     string
+	port   int64
+	groups []*ec2.SecurityGroup
+	// groupsErr is set if the database's security groups couldn't be read
+	groupsErr error
+}
+
+// NewBastionRanker looks up the security groups of db. Failing to read them
+// isn't an error, the security group check is just skipped.
+func NewBastionRanker(ctx context.Context, ec2Client ec2iface.EC2API, db *rds.DBInstance) *BastionRanker {
+	r := &BastionRanker{
+		az: aws.StringValue(db.AvailabilityZone),
+	}
+	if db.DBSubnetGroup != nil {
+		r.vpcID = aws.StringValue(db.DBSubnetGroup.VpcId)
+	}
+	if db.Endpoint != nil {
+		r.port = aws.Int64Value(db.Endpoint.Port)
+	} else {
+		r.port = aws.Int64Value(db.DbInstancePort)
+	}
+
+	var ids []*string
+	for _, g := range db.VpcSecurityGroups {
+		ids = append(ids, g.VpcSecurityGroupId)
+	}
+	if len(ids) > 0 {
+		resp, err := ec2Client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: ids})
+		if err != nil {
+			log.Debugf("Could not describe the database's security groups: %v", err)
+			r.groupsErr = err
+		} else {
+			r.groups = resp.SecurityGroups
+		}
+	}
+	return r
+}
+
+// Rank scores every instance and sorts them best first
+func (r *BastionRanker) Rank(instances []*ec2.Instance) []BastionCandidate {
+	candidates := make([]BastionCandidate, 0, len(instances))
+	for _, inst := range instances {
+		candidates = append(candidates, r.score(inst))
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
+
+func (r *BastionRanker) score(inst *ec2.Instance) BastionCandidate {
+	c := BastionCandidate{Instance: inst}
+	good := func(score int, format string, args ...interface{}) {
+		c.Score += score
+		c.Reasons = append(c.Reasons, fmt.Sprintf(format, args...))
+	}
+	bad := func(reject bool, format string, args ...interface{}) {
+		c.Rejected = c.Rejected || reject
+		c.Problems = append(c.Problems, fmt.Sprintf(format, args...))
+	}
+
+	vpc := aws.StringValue(inst.VpcId)
+	switch {
+	case r.vpcID == "":
+	case vpc == r.vpcID:
+		good(scoreSameVPC, "same VPC")
+	default:
+		bad(true, "in %s but the database is in %s", vpc, r.vpcID)
+	}
+
+	switch {
+	case r.groupsErr != nil:
+		bad(false, "could not check the database's security groups")
+	case len(r.groups) > 0:
+		instanceGroups := make(map[string]bool)
+		for _, g := range inst.SecurityGroups {
+			instanceGroups[aws.StringValue(g.GroupId)] = true
+		}
+		privateIP := net.ParseIP(aws.StringValue(inst.PrivateIpAddress))
+		if group := allowingGroup(r.groups, false, r.port, instanceGroups, privateIP); group != "" {
+			good(scoreSecurityGroup, "%s allows port %d", group, r.port)
+		} else {
+			bad(true, "no database security group rule allows port %d from it", r.port)
+		}
+	}
+
+	switch {
+	case IsStopped(inst):
+		// Stopped instances lose their public IPv4 address, so don't hold
+		// that against them
+		bad(false, "stopped, it will have to be started")
+	case instanceAddress(inst, AddressPublicIPv4) != "" || instanceAddress(inst, AddressIPv6) != "":
+		good(scoreReachable, "public address")
+	default:
+		bad(false, "no public address, needs a VPN or Direct Connect")
+	}
+
+	if IsTaggedBastion(inst) {
+		good(scoreTagged, "tagged %s", BastionTagKey)
+	}
+
+	if inst.Placement != nil && r.az != "" && aws.StringValue(inst.Placement.AvailabilityZone) == r.az {
+		good(scoreSameAZ, "same AZ")
+	}
+	return c
+}
+
+func permissionCoversPort(perm *ec2.IpPermission, port int64) bool {
+	if aws.StringValue(perm.IpProtocol) == "-1" {
+		return true
+	}
+	if aws.StringValue(perm.IpProtocol) != "tcp" && aws.StringValue(perm.IpProtocol) != "6" {
+		return false
+	}
+	from, to := aws.Int64Value(perm.FromPort), aws.Int64Value(perm.ToPort)
+	// A port of -1 means every port
+	if from == -1 || to == -1 {
+		return true
+	}
+	return from <= port && port <= to
+}
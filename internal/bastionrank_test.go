@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// securityGroupsAPI is a fake EC2 API that only describes security groups
+type securityGroupsAPI struct {
+	ec2iface.EC2API
+	groups []*ec2.SecurityGroup
+	err    error
+}
+
+func (a *securityGroupsAPI) DescribeSecurityGroupsWithContext(_ aws.Context, in *ec2.DescribeSecurityGroupsInput,
+	_ ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &ec2.DescribeSecurityGroupsOutput{SecurityGroups: a.groups}, nil
+}
+
+func rankedDB() *rds.DBInstance {
+	return &rds.DBInstance{
+		AvailabilityZone:  aws.String("eu-west-1a"),
+		DBSubnetGroup:     &rds.DBSubnetGroup{VpcId: aws.String("vpc-db")},
+		Endpoint:          &rds.Endpoint{Port: aws.Int64(5432)},
+		VpcSecurityGroups: []*rds.VpcSecurityGroupMembership{{VpcSecurityGroupId: aws.String("sg-db")}},
+	}
+}
+
+// rankedInstance is a running instance in the database's VPC and AZ, with
+// a public address and the bastion security group
+func rankedInstance(change func(*ec2.Instance)) *ec2.Instance {
+	inst := &ec2.Instance{
+		InstanceId:       aws.String("i-0123abcd"),
+		VpcId:            aws.String("vpc-db"),
+		PrivateIpAddress: aws.String("10.0.1.10"),
+		PublicIpAddress:  aws.String("203.0.113.10"),
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String("eu-west-1a")},
+		State:            &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)},
+		SecurityGroups:   []*ec2.GroupIdentifier{{GroupId: aws.String("sg-bastion")}},
+	}
+	if change != nil {
+		change(inst)
+	}
+	return inst
+}
+
+func dbGroup(perms ...*ec2.IpPermission) []*ec2.SecurityGroup {
+	return []*ec2.SecurityGroup{{GroupId: aws.String("sg-db"), IpPermissions: perms}}
+}
+
+func TestBastionRankerScore(t *testing.T) {
+	allPorts := &ec2.IpPermission{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(-1), ToPort: aws.Int64(-1),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String("sg-bastion")}}}
+	portRange := &ec2.IpPermission{IpProtocol: aws.String("6"), FromPort: aws.Int64(5000), ToPort: aws.Int64(6000),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String("sg-bastion")}}}
+	udp := &ec2.IpPermission{IpProtocol: aws.String("udp"), FromPort: aws.Int64(5432), ToPort: aws.Int64(5432),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String("sg-bastion")}}}
+
+	tests := []struct {
+		name         string
+		groups       []*ec2.SecurityGroup
+		groupsErr    error
+		instance     *ec2.Instance
+		wantScore    int
+		wantRejected bool
+	}{
+		{name: "everything in its favour", groups: dbGroup(tcpPermission(5432, "sg-bastion")),
+			instance: rankedInstance(func(i *ec2.Instance) {
+				i.Tags = []*ec2.Tag{{Key: aws.String(BastionTagKey), Value: aws.String("true")}}
+			}),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreReachable + scoreTagged + scoreSameAZ},
+		{name: "other VPC", groups: dbGroup(tcpPermission(5432, "sg-bastion")),
+			instance:  rankedInstance(func(i *ec2.Instance) { i.VpcId = aws.String("vpc-other") }),
+			wantScore: scoreSecurityGroup + scoreReachable + scoreSameAZ, wantRejected: true},
+		{name: "no rule for its group", groups: dbGroup(tcpPermission(5432, "sg-other")),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreReachable + scoreSameAZ, wantRejected: true},
+		{name: "rule for another port", groups: dbGroup(tcpPermission(3306, "sg-bastion")),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreReachable + scoreSameAZ, wantRejected: true},
+		{name: "rule for another protocol", groups: dbGroup(udp),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreReachable + scoreSameAZ, wantRejected: true},
+		{name: "CIDR rule covering its private IP", groups: dbGroup(tcpPermission(5432, "10.0.1.0/24")),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreReachable + scoreSameAZ},
+		{name: "CIDR rule for another subnet", groups: dbGroup(tcpPermission(5432, "10.0.2.0/24")),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreReachable + scoreSameAZ, wantRejected: true},
+		{name: "all traffic rule", groups: dbGroup(allTraffic), instance: rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreReachable + scoreSameAZ},
+		{name: "tcp rule for every port", groups: dbGroup(allPorts), instance: rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreReachable + scoreSameAZ},
+		{name: "port range by protocol number", groups: dbGroup(portRange), instance: rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreReachable + scoreSameAZ},
+		{name: "security groups unreadable", groupsErr: awserr.New("UnauthorizedOperation", "denied", nil),
+			instance:  rankedInstance(nil),
+			wantScore: scoreSameVPC + scoreReachable + scoreSameAZ},
+		{name: "stopped", groups: dbGroup(tcpPermission(5432, "sg-bastion")),
+			instance: rankedInstance(func(i *ec2.Instance) {
+				i.State.Name = aws.String(ec2.InstanceStateNameStopped)
+				i.PublicIpAddress = nil
+			}),
+			wantScore: scoreSameVPC + scoreSecurityGroup + scoreSameAZ},
+		{name: "private only in another AZ", groups: dbGroup(tcpPermission(5432, "sg-bastion")),
+			instance: rankedInstance(func(i *ec2.Instance) {
+				i.PublicIpAddress = nil
+				i.Placement.AvailabilityZone = aws.String("eu-west-1b")
+			}),
+			wantScore: scoreSameVPC + scoreSecurityGroup},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &securityGroupsAPI{groups: tt.groups, err: tt.groupsErr}
+			ranker := NewBastionRanker(context.Background(), api, rankedDB())
+			c := ranker.score(tt.instance)
+			if c.Score != tt.wantScore || c.Rejected != tt.wantRejected {
+				t.Fatalf("got score %d rejected %v, want score %d rejected %v (reasons %v, problems %v)",
+					c.Score, c.Rejected, tt.wantScore, tt.wantRejected, c.Reasons, c.Problems)
+			}
+			if c.Rejected && len(c.Problems) == 0 {
+				t.Fatalf("rejected without saying why")
+			}
+		})
+	}
+}
+
+func TestBastionRankerRank(t *testing.T) {
+	api := &securityGroupsAPI{groups: dbGroup(tcpPermission(5432, "sg-bastion"))}
+	ranker := NewBastionRanker(context.Background(), api, rankedDB())
+	instances := []*ec2.Instance{
+		rankedInstance(func(i *ec2.Instance) { i.InstanceId = aws.String("i-other-vpc"); i.VpcId = aws.String("vpc-other") }),
+		rankedInstance(func(i *ec2.Instance) { i.InstanceId = aws.String("i-private"); i.PublicIpAddress = nil }),
+		rankedInstance(func(i *ec2.Instance) { i.InstanceId = aws.String("i-best") }),
+	}
+	var got []string
+	for _, c := range ranker.Rank(instances) {
+		got = append(got, aws.StringValue(c.Instance.InstanceId))
+	}
+	want := []string{"i-best", "i-private", "i-other-vpc"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("ranked %v, want %v", got, want)
+		}
+	}
+}
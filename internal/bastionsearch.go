@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// BastionTagKey marks instances meant to be used as bastions. Instances
+// with it set to true are listed first.
+const BastionTagKey = "tunneller:bastion"
+
+// BastionFilters turns a bastion search into DescribeInstances filters. spec
+// is a comma separated list of terms which must all match: an instance ID,
+// tag:key=value, or anything else as the value of the Name tag. Tag values
+// can use the * and ? wildcards.
+func BastionFilters(spec string) ([]*ec2.Filter, error) {
+	var filters []*ec2.Filter
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "":
+			continue
+		case instanceIDPattern.MatchString(term):
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("instance-id"),
+				Values: []*string{aws.String(term)},
+			})
+		case strings.HasPrefix(term, "tag:"):
+			kv := strings.TrimPrefix(term, "tag:")
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("%q should be tag:key=value", term)
+			}
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag:" + kv[:i]),
+				Values: []*string{aws.String(kv[i+1:])},
+			})
+		default:
+			filters = append(filters, &ec2.Filter{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(strings.TrimPrefix(term, "name:"))},
+			})
+		}
+	}
+	return filters, nil
+}
+
+// FindBastions lists the running and stopped instances matching filters,
+// with those tagged as bastions first
+func FindBastions(ctx context.Context, ec2Client ec2iface.EC2API, filters []*ec2.Filter) ([]*ec2.Instance, error) {
+	input := &ec2.DescribeInstancesInput{
+		Filters: append([]*ec2.Filter{{
+			Name:   aws.String("instance-state-name"),
+			Values: []*string{aws.String(ec2.InstanceStateNameRunning), aws.String(ec2.InstanceStateNameStopped)},
+		}}, filters...),
+	}
+	var instances []*ec2.Instance
+	err := ec2Client.DescribeInstancesPagesWithContext(ctx, input, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, res := range page.Reservations {
+			instances = append(instances, res.Instances...)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		return IsTaggedBastion(instances[i]) && !IsTaggedBastion(instances[j])
+	})
+	return instances, nil
+}
+
+// IsTaggedBastion reports whether the instance has BastionTagKey set to true
+func IsTaggedBastion(instance *ec2.Instance) bool {
+	for _, t := range instance.Tags {
+		if aws.StringValue(t.Key) == BastionTagKey {
+			return strings.EqualFold(aws.StringValue(t.Value), "true")
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestBastionFilters(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		// want lists each filter as name=value
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", input: ""},
+		{name: "instance ID", input: "i-0123456789abcdef0", want: []string{"instance-id=i-0123456789abcdef0"}},
+		{name: "tag", input: "tag:team=data", want: []string{"tag:team=data"}},
+		{name: "tag with an empty value", input: "tag:bastion=", want: []string{"tag:bastion="}},
+		{name: "tag value containing =", input: "tag:query=a=b", want: []string{"tag:query=a=b"}},
+		{name: "Name tag", input: "prod-bastion", want: []string{"tag:Name=prod-bastion"}},
+		{name: "name: prefix", input: "name:prod-*", want: []string{"tag:Name=prod-*"}},
+		{name: "name: prefix on an instance ID", input: "name:i-0123abcd", want: []string{"tag:Name=i-0123abcd"}},
+		{name: "every term must match", input: " tag:env=prod , bastion-?, ,i-0123abcd",
+			want: []string{"tag:env=prod", "tag:Name=bastion-?", "instance-id=i-0123abcd"}},
+		{name: "tag without a key", input: "tag:=x", wantErr: true},
+		{name: "tag without a value", input: "tag:team", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filters, err := BastionFilters(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", filters)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range filters {
+				got = append(got, aws.StringValue(f.Name)+"="+strings.Join(aws.StringValueSlice(f.Values), ","))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// OSUserTagKey overrides the OS user worked out from an instance's AMI
+const OSUserTagKey = "tunneller:os-user"
+
+// DefaultOSUser is the user of Amazon Linux, RHEL and SUSE AMIs, and the
+// guess when nothing better is known
+const DefaultOSUser = "ec2-user"
+
+// FallbackOSUsers are tried in turn when the bastion rejects the detected
+// user. Between them they cover the common AMIs.
+var FallbackOSUsers = []string{"ec2-user", "ubuntu", "admin", "centos", "rocky", "fedora", "bitnami"}
+
+// amiUsers maps distributions, as found in AMI names and descriptions, to
+// their default user. The first match wins.
+var amiUsers = []struct {
+	match string
+	user  string
+}{
+	{"ubuntu", "ubuntu"},
+	{"debian", "admin"},
+	{"centos", "centos"},
+	{"rocky", "rocky"},
+	{"fedora", "fedora"},
+	{"bitnami", "bitnami"},
+	{"amzn", DefaultOSUser},
+	{"amazon linux", DefaultOSUser},
+	{"al2023", DefaultOSUser},
+	{"rhel", DefaultOSUser},
+	{"red hat", DefaultOSUser},
+	{"suse", DefaultOSUser},
+}
+
+// amiOwnerUsers maps the account IDs of distributions' official AMIs to
+// their default user, for AMIs with unhelpful names
+var amiOwnerUsers = map[string]string{
+	"099720109477": "ubuntu",
+	"136693071363": "admin",
+	"125523088429": "centos",
+	"792107900819": "rocky",
+}
+
+// OSUser is the user to log in to a bastion as, and where it came from
+type OSUser struct {
+	User string
+	// Source explains how User was chosen, e.g. "AMI ubuntu/images/..."
+	Source string
+	// Guessed is set if User is a guess, in which case the other
+	// FallbackOSUsers are worth trying
+	Guessed bool
+}
+
+func (u OSUser) String() string {
+	return fmt.Sprintf("%s (%s)", u.User, u.Source)
+}
+
+// Fallbacks returns the users to try if User is rejected: the other
+// FallbackOSUsers if User is a guess, otherwise none
+func (u OSUser) Fallbacks() []string {
+	if !u.Guessed {
+		return nil
+	}
+	var users []string
+	for _, user := range FallbackOSUsers {
+		if user != u.User {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// DetectOSUser works out which user to log in to the instance as, from its
+// OSUserTagKey tag or else from its AMI's name, description and owner.
+// Failing to describe the AMI isn't an error, the default user is guessed.
+func DetectOSUser(ctx context.Context, ec2Client ec2iface.EC2API, instance *ec2.Instance) OSUser {
+	for _, t := range instance.Tags {
+		if aws.StringValue(t.Key) == OSUserTagKey && aws.StringValue(t.Value) != "" {
+			return OSUser{User: aws.StringValue(t.Value), Source: OSUserTagKey + " tag"}
+		}
+	}
+	guess := OSUser{User: DefaultOSUser, Source: "default", Guessed: true}
+	if instance.ImageId == nil {
+		return guess
+	}
+	resp, err := ec2Client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{
+		ImageIds: []*string{instance.ImageId},
+	})
+	if err != nil {
+		log.Debugf("Could not describe %s: %v", aws.StringValue(instance.ImageId), err)
+		return guess
+	}
+	if len(resp.Images) == 0 {
+		// The AMI has been deregistered or isn't shared with us any more
+		return guess
+	}
+	return osUserForImage(resp.Images[0])
+}
+
+func osUserForImage(image *ec2.Image) OSUser {
+	name := aws.StringValue(image.Name)
+	if name == "" {
+		name = aws.StringValue(image.ImageId)
+	}
+	source := "AMI " + name
+	if strings.EqualFold(aws.StringValue(image.Platform), ec2.PlatformValuesWindows) {
+		// Windows bastions don't run sshd or EC2 Instance Connect, so this
+		// only gets as far as a clear authentication failure
+		return OSUser{User: "Administrator", Source: source + ", Windows"}
+	}
+	text := strings.ToLower(strings.Join([]string{
+		aws.StringValue(image.Name),
+		aws.StringValue(image.Description),
+		aws.StringValue(image.PlatformDetails),
+	}, " "))
+	for _, u := range amiUsers {
+		if strings.Contains(text, u.match) {
+			return OSUser{User: u.user, Source: source, Guessed: true}
+		}
+	}
+	if user, ok := amiOwnerUsers[aws.StringValue(image.OwnerId)]; ok {
+		return OSUser{User: user, Source: source + " owner " + aws.StringValue(image.OwnerId), Guessed: true}
+	}
+	return OSUser{User: DefaultOSUser, Source: source + ", unrecognised", Guessed: true}
+}
+
+// UserFallback is implemented by endpoints that can retry SSH authentication
+// as another user
+type UserFallback interface {
+	// NextUser switches to the next user to try, returning false when
+	// there are none left
+	NextUser() (string, bool)
+}
+
+// KeyFallback is implemented by endpoints that can retry SSH
+// authentication with a key of another type
+type KeyFallback interface {
+	// NextKey switches to the fallback key, returning false if there isn't
+	// one
+	NextKey() (KeyType, bool)
+}
+
+// DialBastionTryingUsers dials the bastion like DialBastion, but when it
+// rejects authentication and the bastion is a KeyFallback, tries again once
+// with its fallback key, and if it is a UserFallback, as each of its other
+// users. progress is told about each retry, and the error lists every user
+// tried, and is an ErrAllUsersRejected if there was more than one.
+func DialBastionTryingUsers(ctx context.Context, bastionHost EndpointIface, progress Progress) (*ssh.Client, error) {
+	fallback, ok := bastionHost.(UserFallback)
+	keyFallback, hasKeyFallback := bastionHost.(KeyFallback)
+	var tried []string
+	for {
+		client, err := DialBastion(ctx, bastionHost)
+		if err == nil || !errors.Is(err, ErrSSHAuth) {
+			return client, err
+		}
+		if hasKeyFallback {
+			if keyType, more := keyFallback.NextKey(); more {
+				progress(fmt.Sprintf("%s rejected the key, trying an %s key", bastionHost, keyType))
+				hasKeyFallback = false
+				continue
+			}
+		}
+		if !ok {
+			return nil, err
+		}
+		config, cfgErr := bastionHost.GetSSHConfig()
+		if cfgErr == nil {
+			tried = append(tried, config.User)
+		}
+		next, more := fallback.NextUser()
+		if !more && len(tried) <= 1 {
+			return nil, err
+		}
+		if !more {
+			return nil, withCause(err, ErrAllUsersRejected, "tried %s", strings.Join(tried, ", "))
+		}
+		progress(fmt.Sprintf("%s rejected %s, trying %s", bastionHost, strings.Join(tried, ", "), next))
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// imagesAPI is a fake EC2 API that only describes images
+type imagesAPI struct {
+	ec2iface.EC2API
+	images []*ec2.Image
+	err    error
+}
+
+func (a *imagesAPI) DescribeImagesWithContext(_ aws.Context, _ *ec2.DescribeImagesInput,
+	_ ...request.Option) (*ec2.DescribeImagesOutput, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &ec2.DescribeImagesOutput{Images: a.images}, nil
+}
+
+func TestDetectOSUser(t *testing.T) {
+	image := func(name, description, owner string) []*ec2.Image {
+		return []*ec2.Image{{ImageId: aws.String("ami-0123"), Name: aws.String(name),
+			Description: aws.String(description), OwnerId: aws.String(owner)}}
+	}
+	tests := []struct {
+		name     string
+		tags     []*ec2.Tag
+		noImage  bool
+		images   []*ec2.Image
+		err      error
+		want     string
+		wantFrom string
+		guessed  bool
+	}{
+		{name: "tag", tags: []*ec2.Tag{{Key: aws.String(OSUserTagKey), Value: aws.String("deploy")}},
+			images: image("ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server", "", "099720109477"),
+			want:   "deploy", wantFrom: "tunneller:os-user tag"},
+		{name: "empty tag", tags: []*ec2.Tag{{Key: aws.String(OSUserTagKey), Value: aws.String("")}},
+			images: image("debian-12-amd64-20240101", "", "136693071363"),
+			want:   "admin", wantFrom: "AMI debian-12-amd64-20240101", guessed: true},
+		{name: "Ubuntu", images: image("ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server", "", "099720109477"),
+			want: "ubuntu", wantFrom: "AMI ubuntu/images/hvm-ssd/ubuntu-jammy-22.04-amd64-server", guessed: true},
+		{name: "Amazon Linux", images: image("al2023-ami-2023.3.20240108.0-kernel-6.1-x86_64", "", "137112412989"),
+			want: "ec2-user", wantFrom: "AMI al2023-ami-2023.3.20240108.0-kernel-6.1-x86_64", guessed: true},
+		{name: "description", images: image("hardened-base-v7", "Rocky Linux 9 with CIS hardening", "111122223333"),
+			want: "rocky", wantFrom: "AMI hardened-base-v7", guessed: true},
+		{name: "owner", images: image("golden-image-42", "", "125523088429"),
+			want: "centos", wantFrom: "AMI golden-image-42 owner 125523088429", guessed: true},
+		{name: "unrecognised", images: image("golden-image-42", "", "111122223333"),
+			want: "ec2-user", wantFrom: "AMI golden-image-42, unrecognised", guessed: true},
+		{name: "Windows", images: []*ec2.Image{{Name: aws.String("Windows_Server-2022-English-Full-Base"),
+			Platform: aws.String("windows")}},
+			want: "Administrator", wantFrom: "AMI Windows_Server-2022-English-Full-Base, Windows"},
+		{name: "unnamed AMI", images: []*ec2.Image{{ImageId: aws.String("ami-0123")}},
+			want: "ec2-user", wantFrom: "AMI ami-0123, unrecognised", guessed: true},
+		{name: "no AMI", noImage: true, want: "ec2-user", wantFrom: "default", guessed: true},
+		{name: "deregistered AMI", want: "ec2-user", wantFrom: "default", guessed: true},
+		{name: "describe fails", err: errors.New("UnauthorizedOperation"),
+			want: "ec2-user", wantFrom: "default", guessed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := &ec2.Instance{ImageId: aws.String("ami-0123"), Tags: tt.tags}
+			if tt.noImage {
+				instance.ImageId = nil
+			}
+			got := DetectOSUser(context.Background(), &imagesAPI{images: tt.images, err: tt.err}, instance)
+			want := OSUser{User: tt.want, Source: tt.wantFrom, Guessed: tt.guessed}
+			if got != want {
+				t.Fatalf("DetectOSUser() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestOSUserFallbacks(t *testing.T) {
+	tests := []struct {
+		name string
+		user OSUser
+		want []string
+	}{
+		{name: "guessed", user: OSUser{User: "ubuntu", Guessed: true},
+			want: []string{"ec2-user", "admin", "centos", "rocky", "fedora", "bitnami"}},
+		{name: "guessed outside the list", user: OSUser{User: "Administrator", Guessed: true}, want: FallbackOSUsers},
+		{name: "from a tag", user: OSUser{User: "deploy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.user.Fallbacks(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Fallbacks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultCertValidity is how long signed certificates are valid for. They
+// are re-signed when a new connection needs one after they expire.
+const DefaultCertValidity = 10 * time.Minute
+
+// DefaultCertExtensions are the certificate extensions a tunnel needs
+var DefaultCertExtensions = map[string]string{
+	"permit-port-forwarding": "",
+	"permit-pty":             "",
+}
+
+// CertificateAuthority signs short lived SSH user certificates for the
+// ephemeral key, for bastions that trust a CA with TrustedUserCAKeys. It is
+// an alternative to pushing the key with EC2 Instance Connect.
+type CertificateAuthority struct {
+	Signer ssh.Signer
+	// Principals defaults to the user being logged in as
+	Principals []string
+	// Extensions defaults to DefaultCertExtensions
+	Extensions map[string]string
+	// KeyID defaults to DefaultCertKeyID()
+	KeyID string
+	// Validity defaults to DefaultCertValidity
+	Validity time.Duration
+
+	mu        sync.Mutex
+	cached    ssh.Signer
+	cachedFor string
+	expires   time.Time
+}
+
+// DefaultCertKeyID identifies the developer running tunneller, as
+// tunneller:user@hostname
+func DefaultCertKeyID() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("tunneller:%s@%s", name, host)
+}
+
+// ParseCertExtensions parses a comma separated list of extensions, each
+// either a name or name=value
+func ParseCertExtensions(s string) map[string]string {
+	extensions := make(map[string]string)
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			extensions[parts[0]] = parts[1]
+		} else {
+			extensions[parts[0]] = ""
+		}
+	}
+	return extensions
+}
+
+// LoadCAFromFile reads a CA private key, asking for its passphrase with
+// prompt if it has one
+func LoadCAFromFile(file string, prompt Prompter) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuthConfig{Prompt: prompt}
+	return a.parsePrivateKey(file, data)
+}
+
+// agentCA is a CA key held by ssh-agent, signing over the connection it was
+// found on until it is closed
+type agentCA struct {
+	ssh.AlgorithmSigner
+	conn net.Conn
+}
+
+func (a *agentCA) Close() error {
+	return a.conn.Close()
+}
+
+// LoadCAFromAgent finds the CA key in the ssh-agent on SSH_AUTH_SOCK. key is
+// matched against each key's SHA256 fingerprint and comment. The agent
+// connection stays open for signing until CertificateAuthority.Close.
+func LoadCAFromAgent(key string) (ssh.Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to ssh-agent")
+	}
+	return loadCAFromAgentConn(conn, key)
+}
+
+func loadCAFromAgentConn(conn net.Conn, key string) (ssh.Signer, error) {
+	signer, err := findAgentKey(agent.NewClient(conn), key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &agentCA{AlgorithmSigner: signer, conn: conn}, nil
+}
+
+func findAgentKey(client agent.Agent, key string) (ssh.AlgorithmSigner, error) {
+	keys, err := client.List()
+	if err != nil {
+		return nil, err
+	}
+	var match *agent.Key
+	for _, k := range keys {
+		if k.Comment == key || ssh.FingerprintSHA256(k) == key {
+			match = k
+			break
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("no key matching %q in ssh-agent", key)
+	}
+	signers, err := client.Signers()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range signers {
+		if !bytes.Equal(s.PublicKey().Marshal(), match.Marshal()) {
+			continue
+		}
+		if as, ok := s.(ssh.AlgorithmSigner); ok {
+			return as, nil
+		}
+	}
+	return nil, fmt.Errorf("ssh-agent listed key %q but can't sign with it", key)
+}
+
+// Close releases the CA key's ssh-agent connection, if it has one
+func (c *CertificateAuthority) Close() error {
+	if closer, ok := c.Signer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Sign issues a certificate for key valid for logging in as user
+func (c *CertificateAuthority) Sign(key ssh.PublicKey, user string) (*ssh.Certificate, error) {
+	principals := c.Principals
+	if len(principals) == 0 {
+		principals = []string{user}
+	}
+	extensions := c.Extensions
+	if extensions == nil {
+		extensions = DefaultCertExtensions
+	}
+	keyID := c.KeyID
+	if keyID == "" {
+		keyID = DefaultCertKeyID()
+	}
+	validity := c.Validity
+	if validity == 0 {
+		validity = DefaultCertValidity
+	}
+
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		// Allow for a little clock skew between us and the bastion
+		ValidAfter:  uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore: uint64(now.Add(validity).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: extensions,
+		},
+	}
+	// SignCert uses rsa-sha2-256 or rsa-sha2-512 for RSA CAs, never SHA-1
+	// ssh-rsa, which OpenSSH 8.8 and later reject
+	if err := cert.SignCert(rand.Reader, c.Signer); err != nil {
+		return nil, errors.Wrap(err, "could not sign certificate")
+	}
+	log.Debugf("Signed certificate %q for %v, valid until %s", keyID, principals, now.Add(validity))
+	return cert, nil
+}
+
+// certSigner returns a signer presenting a certificate for key, signing a
+// new certificate if there isn't one for user or it is about to expire
+func (c *CertificateAuthority) certSigner(key ssh.Signer, user string) (ssh.Signer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cacheKey := user + " " + string(key.PublicKey().Marshal())
+	if c.cached != nil && c.cachedFor == cacheKey && time.Until(c.expires) > 30*time.Second {
+		return c.cached, nil
+	}
+	cert, err := c.Sign(key.PublicKey(), user)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	c.cached = signer
+	c.cachedFor = cacheKey
+	c.expires = time.Unix(int64(cert.ValidBefore), 0)
+	return signer, nil
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func fileCASigner(t *testing.T, key interface{}) ssh.Signer {
+	t.Helper()
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func agentCASigner(t *testing.T, key interface{}) ssh.Signer {
+	t.Helper()
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "ca"}); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go agent.ServeAgent(keyring, server)
+	signer, err := loadCAFromAgentConn(client, "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { (&CertificateAuthority{Signer: signer}).Close() })
+	return signer
+}
+
+func TestCertificateAuthoritySign(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		signer         ssh.Signer
+		principals     []string
+		extensions     map[string]string
+		user           string
+		wantPrincipals []string
+		wantExtensions map[string]string
+		wantFormat     string
+	}{
+		{name: "ED25519 CA with defaults", signer: fileCASigner(t, edKey), user: "ec2-user",
+			wantPrincipals: []string{"ec2-user"}, wantExtensions: DefaultCertExtensions, wantFormat: ssh.KeyAlgoED25519},
+		{name: "RSA CA key file", signer: fileCASigner(t, rsaKey), user: "ubuntu",
+			wantPrincipals: []string{"ubuntu"}, wantExtensions: DefaultCertExtensions, wantFormat: ssh.KeyAlgoRSASHA256},
+		{name: "RSA CA in ssh-agent", signer: agentCASigner(t, rsaKey), user: "ubuntu",
+			wantPrincipals: []string{"ubuntu"}, wantExtensions: DefaultCertExtensions, wantFormat: ssh.KeyAlgoRSASHA512},
+		{name: "configured principals and extensions", signer: fileCASigner(t, edKey), user: "ec2-user",
+			principals: []string{"bastion", "ops"}, extensions: map[string]string{"permit-port-forwarding": ""},
+			wantPrincipals: []string{"bastion", "ops"}, wantExtensions: map[string]string{"permit-port-forwarding": ""},
+			wantFormat: ssh.KeyAlgoED25519},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := GenerateKeysOfType(KeyTypeED25519)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := ssh.ParsePrivateKey([]byte(keys.PrivateKey))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ca := &CertificateAuthority{
+				Signer:     tt.signer,
+				Principals: tt.principals,
+				Extensions: tt.extensions,
+				KeyID:      "tunneller:test",
+				Validity:   5 * time.Minute,
+			}
+			cert, err := ca.Sign(key.PublicKey(), tt.user)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+
+			if cert.Signature.Format != tt.wantFormat {
+				t.Errorf("signed with %s, want %s", cert.Signature.Format, tt.wantFormat)
+			}
+			if !reflect.DeepEqual(cert.ValidPrincipals, tt.wantPrincipals) {
+				t.Errorf("principals = %v, want %v", cert.ValidPrincipals, tt.wantPrincipals)
+			}
+			if !reflect.DeepEqual(cert.Extensions, tt.wantExtensions) {
+				t.Errorf("extensions = %v, want %v", cert.Extensions, tt.wantExtensions)
+			}
+
+			now := time.Now()
+			checker := &ssh.CertChecker{
+				IsUserAuthority: func(auth ssh.PublicKey) bool {
+					return bytes.Equal(auth.Marshal(), tt.signer.PublicKey().Marshal())
+				},
+				Clock: func() time.Time { return now },
+			}
+			if !checker.IsUserAuthority(cert.SignatureKey) {
+				t.Fatalf("certificate isn't signed by the CA")
+			}
+			for _, p := range tt.wantPrincipals {
+				if err := checker.CheckCert(p, cert); err != nil {
+					t.Errorf("CheckCert(%q) error = %v", p, err)
+				}
+			}
+			if err := checker.CheckCert("root", cert); err == nil {
+				t.Errorf("CheckCert accepted a principal the certificate wasn't issued for")
+			}
+
+			// Valid from a minute ago, for clock skew, until Validity from now
+			for _, at := range []time.Duration{-2 * time.Minute, 6 * time.Minute} {
+				now = time.Now().Add(at)
+				if err := checker.CheckCert(tt.wantPrincipals[0], cert); err == nil {
+					t.Errorf("CheckCert accepted the certificate %s from now", at)
+				}
+			}
+			now = time.Now().Add(4 * time.Minute)
+			if err := checker.CheckCert(tt.wantPrincipals[0], cert); err != nil {
+				t.Errorf("CheckCert 4m from now error = %v", err)
+			}
+		})
+	}
+}
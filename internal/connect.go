@@ -3,9 +3,14 @@ package internal
 import (
 	"context"
 	"fmt"
-	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
 	"io"
 	"net"
 	"os"
@@ -14,30 +19,133 @@ import (
 )
 
 type Tunneller struct {
-	remoteHost EndpointIface
+	remoteHost  EndpointIface
 	bastionHost EndpointIface
+	// ListenAddress is the local address to listen on, "localhost" by
+	// default. IPv6 addresses like "::1" are fine.
+	ListenAddress string
+	localPort     int
+	ctx           context.Context
+
+	// client carries every forwarded connection, if set. Otherwise each
+	// one dials the bastion itself.
+	clientMu sync.Mutex
+	client   *ssh.Client
+
+	events  eventBus
+	stopped chan struct{}
+}
+
+func NewTunneller(remoteHost, bastionHost EndpointIface) *Tunneller {
+	return &Tunneller{
+		remoteHost:    remoteHost,
+		bastionHost:   bastionHost,
+		ListenAddress: "localhost",
+		ctx:           context.Background(),
+		stopped:       make(chan struct{}),
+	}
+}
+
+// SetClient makes every new forwarded connection a channel over client,
+// rather than a connection of its own. Authentication, and any prompts it
+// needs, then only happen when client is dialled, and not on the tunnel's
+// goroutines. It can be replaced if the bastion drops the connection.
+func (t *Tunneller) SetClient(client *ssh.Client) {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+	t.client = client
+}
+
+func (t *Tunneller) sharedClient() *ssh.Client {
+	t.clientMu.Lock()
+	defer t.clientMu.Unlock()
+	return t.client
+}
+
+// Subscribe registers an observer for the given event types, or for every
+// event if none are given. Calling the returned function unsubscribes it.
+func (t *Tunneller) Subscribe(o Observer, types ...EventType) func() {
+	return t.events.subscribe(o, types)
+}
+
+// BastionDropped publishes a bastion-dropped event, for when the client set
+// with SetClient has lost its connection to the bastion
+func (t *Tunneller) BastionDropped(err error) {
+	t.publish(Event{Type: EventBastionDropped, Err: err})
+}
+
+// Stopped is closed once the listener has shut down and the tunnel-down
+// event has been handed to every observer
+func (t *Tunneller) Stopped() <-chan struct{} {
+	return t.stopped
 }
 
 func (t *Tunneller) TunnelWithContext(ctx context.Context, cancel context.CancelFunc, localPort int) {
-	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", localPort))
+	t.ctx = ctx
+	listener, err := t.listen(localPort)
 	if err != nil {
+		log.Errorf("Could not start listener: %v", err)
+		cancel()
 		return
 	}
+	t.serve(listener, func() bool {
+		select {
+		case _ = <-ctx.Done():
+			return true
+		default:
+			return false
+		}
+	}, cancel)
+}
+
+// Tunnel starts listening on localPort in the background. Sending on the
+// returned channel shuts the listener down, and the listener sends on it
+// if it fails. It's buffered, so neither side blocks on the other.
+func (t *Tunneller) Tunnel(localPort int) (chan int, error) {
+	listener, err := t.listen(localPort)
+	if err != nil {
+		return nil, err
+	}
+	doneChannel := make(chan int, 1)
+	go t.serve(listener, func() bool {
+		select {
+		case _ = <-doneChannel:
+			return true
+		default:
+			return false
+		}
+	}, func() {
+		doneChannel <- 1
+	})
+	return doneChannel, nil
+}
+
+func (t *Tunneller) listen(localPort int) (*net.TCPListener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(t.ListenAddress, strconv.Itoa(localPort)))
+	if err != nil {
+		return nil, NewTunnelError(ErrListenerBind, err)
+	}
 	listener, ok := l.(*net.TCPListener)
 	if !ok {
-		log.Errorf("Could not cast listener")
-		return
+		l.Close()
+		return nil, fmt.Errorf("could not cast listener")
 	}
+	t.localPort = localPort
+	return listener, nil
+}
+
+func (t *Tunneller) serve(listener *net.TCPListener, shutdown func() bool, fail func()) {
+	defer close(t.stopped)
+	defer t.events.flush()
 	defer listener.Close()
+	t.publish(Event{Type: EventTunnelUp})
 	for {
 		deadline := time.Now().Add(time.Second)
 		listener.SetDeadline(deadline)
-		select {
-		case _=<-ctx.Done():
+		if shutdown() {
 			log.Infof("Listener received shutdown signal")
+			t.publish(Event{Type: EventTunnelDown})
 			return
-		default:
-			// do nothing
 		}
 		conn, err := listener.Accept()
 		if err != nil {
@@ -45,7 +153,8 @@ func (t *Tunneller) TunnelWithContext(ctx context.Context, cancel context.Cancel
 				continue
 			}
 			log.Infof("Encountered unrecoverable error while attempting to accept a connection: %v", err)
-			cancel()
+			t.publish(Event{Type: EventTunnelDown, Err: err})
+			fail()
 			return
 		}
 		log.Debug("accepted connection")
@@ -53,102 +162,203 @@ func (t *Tunneller) TunnelWithContext(ctx context.Context, cancel context.Cancel
 	}
 }
 
+func (t *Tunneller) publish(e Event) {
+	e.LocalPort = t.localPort
+	e.Bastion = t.bastionHost.String()
+	e.Remote = t.remoteHost.String()
+	t.events.publish(e)
+}
+
 func (t *Tunneller) forward(localConn net.Conn) {
-	sshConfig, err := t.bastionHost.GetSSHConfig()
-	if err != nil {
-		log.Error(err)
-	}
+	client := localConn.RemoteAddr().String()
+	t.publish(Event{Type: EventClientConnected, Client: client})
 
-	serverConn, err := ssh.Dial("tcp", t.bastionHost.String(), sshConfig)
+	serverConn, remoteConn, shared, err := t.dial()
 	if err != nil {
-		log.Errorf("server dial error: %s", err)
+		localConn.Close()
+		t.publish(Event{Type: EventClientDisconnected, Client: client, Err: err})
 		return
 	}
-	log.Debugf("connected to %s (1 of 2)", t.bastionHost.String())
 
-	remoteConn, err := serverConn.Dial("tcp", t.remoteHost.String())
-	if err != nil {
-		log.Errorf("remote dial error: %s", err)
-		return
+	var once sync.Once
+	closeBoth := func() {
+		localConn.Close()
+		remoteConn.Close()
 	}
-	log.Debugf("connected to %s (2 of 2)", t.remoteHost.String())
-
+	var wg sync.WaitGroup
 	copyConn := func(writer, reader net.Conn) {
+		defer wg.Done()
 		_, err := io.Copy(writer, reader)
 		if err != nil {
-			log.Errorf("io.Copy error: %s", err)
+			log.Debugf("io.Copy error: %s", err)
 		}
+		once.Do(closeBoth)
 	}
+	wg.Add(2)
 	go copyConn(localConn, remoteConn)
 	go copyConn(remoteConn, localConn)
-}
+	wg.Wait()
 
+	// If the bastion no longer answers a keepalive, it went away underneath
+	// us. Whoever set a shared client watches it, and calls BastionDropped.
+	if !shared {
+		if _, _, err := serverConn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			log.Errorf("bastion connection dropped: %s", err)
+			t.publish(Event{Type: EventBastionDropped, Client: client, Err: err})
+		}
+		serverConn.Close()
+	}
+	t.publish(Event{Type: EventClientDisconnected, Client: client})
+}
 
-func Tunnel(localPort int, remoteHost EndpointIface, bastionHost EndpointIface) (chan int, error) {
-	doneChannel := make(chan int)
-	go func() {
-		l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", "localhost", localPort))
+// dial opens a connection to the remote host through the bastion, over the
+// shared client if there is one. shared reports whether it was.
+func (t *Tunneller) dial() (serverConn *ssh.Client, remoteConn net.Conn, shared bool, err error) {
+	serverConn = t.sharedClient()
+	shared = serverConn != nil
+	if !shared {
+		serverConn, err = DialBastion(t.ctx, t.bastionHost)
 		if err != nil {
-			return
-		}
-		listener, ok := l.(*net.TCPListener)
-		if !ok {
-			log.Errorf("Could not cast listener")
-			return
+			log.Errorf("server dial error: %s", err)
+			return nil, nil, false, err
 		}
-		defer listener.Close()
-		for {
-			deadline := time.Now().Add(time.Second)
-			listener.SetDeadline(deadline)
-			select {
-			case _=<-doneChannel:
-				log.Infof("Listener received shutdown signal")
-				return
-			default:
-				// do nothing
-			}
-		    conn, err := listener.Accept()
-			if err != nil {
-				if os.IsTimeout(err) {
-					continue
-				}
-				log.Infof("Encountered unrecoverable error while attempting to accept a connection: %v", err)
-				doneChannel <- 1
-				return
-			}
-			log.Debug("accepted connection")
-			go forward(remoteHost, bastionHost, conn)
+		log.Debugf("connected to %s (1 of 2)", t.bastionHost.String())
+	}
+
+	remoteConn, err = serverConn.Dial("tcp", t.remoteHost.String())
+	if err != nil {
+		err = NewTunnelError(ErrTargetDial, err)
+		log.Errorf("remote dial error: %s", err)
+		if !shared {
+			serverConn.Close()
 		}
-	}()
-	return doneChannel, nil
+		return nil, nil, false, err
+	}
+	log.Debugf("connected to %s (2 of 2)", t.remoteHost.String())
+	return serverConn, remoteConn, shared, nil
 }
 
-func forward(remoteHost, bastionEndpoint EndpointIface, localConn net.Conn) {
-	sshConfig, err := bastionEndpoint.GetSSHConfig()
+// DialBastion opens an SSH connection to the bastion, first giving it the
+// chance to prepare for authentication. Failures are returned as
+// ErrBastionDial or ErrSSHAuth TunnelErrors, or the preparer's own error.
+func DialBastion(ctx context.Context, bastionHost EndpointIface) (*ssh.Client, error) {
+	if p, ok := bastionHost.(AuthPreparer); ok {
+		if err := p.PrepareAuth(ctx); err != nil {
+			return nil, err
+		}
+	}
+	sshConfig, err := bastionHost.GetSSHConfig()
 	if err != nil {
-		log.Error(err)
+		return nil, NewTunnelError(ErrSSHAuth, err)
 	}
-
-	serverConn, err := ssh.Dial("tcp", bastionEndpoint.String(), sshConfig)
+	log.Debugf("SSH to %s: %s", bastionHost.String(), describeSSHConfig(sshConfig))
+	if j, ok := bastionHost.(Jumper); ok && j.JumpHost() != nil {
+		return dialThroughJump(ctx, j.JumpHost(), bastionHost.String(), sshConfig)
+	}
+	var proxy *Proxy
+	if p, ok := bastionHost.(Proxied); ok {
+		proxy = p.GetProxy()
+	}
+	addr := bastionHost.String()
+	dialCtx := ctx
+	if sshConfig.Timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, sshConfig.Timeout)
+		defer cancel()
+	}
+	log.Debugf("Dialling %s via %s", addr, proxy)
+	conn, err := proxy.DialContext(dialCtx, "tcp", addr)
 	if err != nil {
-		log.Errorf("server dial error: %s", err)
-		return
+		return nil, NewTunnelError(ErrBastionDial, err)
 	}
-	log.Debugf("connected to %s (1 of 2)", bastionEndpoint.String())
-
-	remoteConn, err := serverConn.Dial("tcp", remoteHost.String())
+	client, err := sshHandshake(conn, addr, sshConfig)
 	if err != nil {
-		log.Errorf("remote dial error: %s", err)
-		return
+		return nil, withSkippedAuth(bastionHost, err)
 	}
-	log.Debugf("connected to %s (2 of 2)", remoteHost.String())
+	return client, nil
+}
 
-	copyConn := func(writer, reader net.Conn) {
-		_, err := io.Copy(writer, reader)
-		if err != nil {
-			log.Errorf("io.Copy error: %s", err)
+// withSkippedAuth marks authentication failures on bastions the ephemeral
+// key is pushed to, so they get a hint about EC2 Instance Connect, and adds
+// why the key was left out if it was, as it is often the reason for it
+func withSkippedAuth(bastionHost EndpointIface, err error) error {
+	e, ok := bastionHost.(*EC2Endpoint)
+	if !ok || !errors.Is(err, ErrSSHAuth) || !e.Auth.Uses(AuthEphemeral) || e.Auth.UsesCertificates() {
+		return err
+	}
+	if skipped := e.skippedAuth(); skipped != nil {
+		return withCause(err, ErrInstanceConnectAuth, "ephemeral key not pushed (%v)", skipped)
+	}
+	return withCause(err, ErrInstanceConnectAuth, "")
+}
+
+// sshHandshake starts an SSH client on conn, giving up after the config's
+// timeout. conn is closed if it fails. Failures after the bastion's host key
+// has been accepted happen while authenticating and are returned as
+// ErrSSHAuth, anything before that as ErrBastionDial.
+func sshHandshake(conn net.Conn, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	var timedOut, authenticating int32
+	config := *sshConfig
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if sshConfig.HostKeyCallback != nil {
+			if err := sshConfig.HostKeyCallback(hostname, remote, key); err != nil {
+				return err
+			}
 		}
+		atomic.StoreInt32(&authenticating, 1)
+		return nil
 	}
-	go copyConn(localConn, remoteConn)
-	go copyConn(remoteConn, localConn)
+	if sshConfig.Timeout > 0 {
+		// Channels through a jump host don't support deadlines, so close
+		// the connection instead
+		timer := time.AfterFunc(sshConfig.Timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			conn.Close()
+		})
+		defer timer.Stop()
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &config)
+	if err != nil {
+		conn.Close()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, NewTunnelError(ErrBastionDial, &net.OpError{Op: "handshake", Net: "tcp",
+				Err: fmt.Errorf("SSH handshake with %s timed out after %s", addr, sshConfig.Timeout)})
+		}
+		var netErr net.Error
+		if atomic.LoadInt32(&authenticating) == 1 && !errors.As(err, &netErr) {
+			return nil, NewTunnelError(ErrSSHAuth, err)
+		}
+		return nil, NewTunnelError(ErrBastionDial, err)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialThroughJump opens an SSH connection to addr tunnelled through the jump
+// host. The jump connection is closed along with the returned client.
+func dialThroughJump(ctx context.Context, jumpHost EndpointIface, addr string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	jumpClient, err := DialBastion(ctx, jumpHost)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("connected to jump host %s", jumpHost.String())
+	conn, err := jumpClient.Dial("tcp", addr)
+	if err != nil {
+		jumpClient.Close()
+		return nil, NewTunnelError(ErrBastionDial, err)
+	}
+	client, err := sshHandshake(conn, addr, sshConfig)
+	if err != nil {
+		jumpClient.Close()
+		return nil, err
+	}
+	go func() {
+		client.Wait()
+		jumpClient.Close()
+	}()
+	return client, nil
+}
+
+// Tunnel is shorthand for NewTunneller(remoteHost, bastionHost).Tunnel(localPort)
+func Tunnel(localPort int, remoteHost EndpointIface, bastionHost EndpointIface) (chan int, error) {
+	return NewTunneller(remoteHost, bastionHost).Tunnel(localPort)
 }
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHHandshake(t *testing.T) {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "right" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	tests := []struct {
+		name      string
+		password  string
+		hostKey   ssh.HostKeyCallback
+		hangUp    bool
+		wantStage error
+	}{
+		{name: "accepted", password: "right"},
+		{name: "wrong password", password: "wrong", wantStage: ErrSSHAuth},
+		{name: "host key rejected", password: "right", wantStage: ErrBastionDial,
+			hostKey: func(string, net.Addr, ssh.PublicKey) error { return errors.New("unknown host key") }},
+		{name: "hung up before the key exchange", password: "right", hangUp: true, wantStage: ErrBastionDial},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// net.Pipe would deadlock with both ends sending their version
+			// first, so this uses a real connection
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			go func() {
+				server, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				if tt.hangUp {
+					server.Close()
+					return
+				}
+				c, _, _, err := ssh.NewServerConn(server, serverConfig)
+				if err == nil {
+					c.Close()
+				}
+			}()
+			client, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			hostKeyCallback := tt.hostKey
+			if hostKeyCallback == nil {
+				hostKeyCallback = ssh.InsecureIgnoreHostKey()
+			}
+			sshClient, err := sshHandshake(client, listener.Addr().String(), &ssh.ClientConfig{
+				User:            "ec2-user",
+				Auth:            []ssh.AuthMethod{ssh.Password(tt.password)},
+				HostKeyCallback: hostKeyCallback,
+			})
+			if tt.wantStage == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				sshClient.Close()
+				return
+			}
+			if err == nil {
+				sshClient.Close()
+				t.Fatalf("expected a %v error", tt.wantStage)
+			}
+			if !errors.Is(err, tt.wantStage) {
+				t.Fatalf("got %v, want a %v error", err, tt.wantStage)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Clients are the database clients tunneller knows how to pass a login to
+var Clients = []string{"psql", "mysql", "redis-cli", "sqlcmd"}
+
+// DefaultClient returns the client for an RDS engine
+func DefaultClient(engine string) (string, error) {
+	switch FamilyOf(engine) {
+	case FamilyPostgres:
+		return "psql", nil
+	case FamilyMySQL:
+		return "mysql", nil
+	case FamilySQLServer:
+		return "sqlcmd", nil
+	}
+	return "", fmt.Errorf("no client is known for engine %q, choose one of %v", engine, Clients)
+}
+
+// ClientCommand builds the command to run client against a tunnel on host
+// and port. The password goes in an environment variable rather than the
+// arguments, so other users can't see it in the process list, as do the
+// other details where the client reads them from the environment.
+func ClientCommand(client string, login *DBLogin, host string, port int) (*exec.Cmd, error) {
+	password := ""
+	if login.Password != nil {
+		var err error
+		if password, err = login.Password.Password(); err != nil {
+			return nil, err
+		}
+	}
+	_, iamAuth := login.Password.(*IAMAuthToken)
+	var args, env []string
+	// Empty values are left out, as clients take them literally rather
+	// than falling back to their defaults
+	setenv := func(key, value string) {
+		if value != "" {
+			env = append(env, key+"="+value)
+		}
+	}
+	switch client {
+	case "psql":
+		setenv("PGHOST", host)
+		setenv("PGPORT", strconv.Itoa(port))
+		setenv("PGUSER", login.User)
+		setenv("PGDATABASE", login.Database)
+		setenv("PGPASSWORD", password)
+		if iamAuth {
+			setenv("PGSSLMODE", "require")
+		}
+	case "mysql":
+		// mysql has no environment variable for the user or database. It
+		// takes localhost to mean its socket, hence --protocol.
+		setenv("MYSQL_HOST", host)
+		setenv("MYSQL_TCP_PORT", strconv.Itoa(port))
+		setenv("MYSQL_PWD", password)
+		args = []string{"--protocol=TCP"}
+		if login.User != "" {
+			args = append(args, "--user="+login.User)
+		}
+		if iamAuth {
+			args = append(args, "--enable-cleartext-plugin", "--ssl-mode=REQUIRED")
+		}
+		if login.Database != "" {
+			args = append(args, login.Database)
+		}
+	case "redis-cli":
+		args = []string{"-h", host, "-p", strconv.Itoa(port)}
+		if login.User != "" {
+			args = append(args, "--user", login.User)
+		}
+		setenv("REDISCLI_AUTH", password)
+	case "sqlcmd":
+		setenv("SQLCMDSERVER", "tcp:"+host+","+strconv.Itoa(port))
+		setenv("SQLCMDUSER", login.User)
+		setenv("SQLCMDDBNAME", login.Database)
+		setenv("SQLCMDPASSWORD", password)
+	default:
+		return nil, fmt.Errorf("unknown client %q, choose one of %v", client, Clients)
+	}
+	path, err := exec.LookPath(client)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd, nil
+}
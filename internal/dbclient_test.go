@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientCommand(t *testing.T) {
+	// The clients only have to be found on the PATH, not run
+	bin := t.TempDir()
+	for _, client := range Clients {
+		if err := ioutil.WriteFile(filepath.Join(bin, client), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+
+	const password = "s3cret pass"
+	secret := staticPassword{password: password}
+	iam := &IAMAuthToken{User: "iam_user", token: password, generated: time.Now()}
+	tests := []struct {
+		name     string
+		client   string
+		login    DBLogin
+		wantArgs []string
+		wantEnv  []string
+		wantErr  bool
+	}{
+		{name: "psql", client: "psql", login: DBLogin{User: "app", Database: "orders", Password: secret},
+			wantEnv: []string{"PGHOST=localhost", "PGPORT=5433", "PGUSER=app", "PGDATABASE=orders",
+				"PGPASSWORD=" + password}},
+		{name: "psql with IAM auth", client: "psql", login: DBLogin{User: "iam_user", Password: iam},
+			wantEnv: []string{"PGHOST=localhost", "PGPORT=5433", "PGUSER=iam_user", "PGPASSWORD=" + password,
+				"PGSSLMODE=require"}},
+		{name: "psql without a password", client: "psql", login: DBLogin{User: "app"},
+			wantEnv: []string{"PGHOST=localhost", "PGPORT=5433", "PGUSER=app"}},
+		{name: "mysql", client: "mysql", login: DBLogin{User: "admin", Database: "shop", Password: secret},
+			wantArgs: []string{"--protocol=TCP", "--user=admin", "shop"},
+			wantEnv:  []string{"MYSQL_HOST=localhost", "MYSQL_TCP_PORT=5433", "MYSQL_PWD=" + password}},
+		{name: "mysql with IAM auth", client: "mysql", login: DBLogin{User: "iam_user", Password: iam},
+			wantArgs: []string{"--protocol=TCP", "--user=iam_user", "--enable-cleartext-plugin", "--ssl-mode=REQUIRED"},
+			wantEnv:  []string{"MYSQL_HOST=localhost", "MYSQL_TCP_PORT=5433", "MYSQL_PWD=" + password}},
+		{name: "redis-cli", client: "redis-cli", login: DBLogin{User: "default", Password: secret},
+			wantArgs: []string{"-h", "localhost", "-p", "5433", "--user", "default"},
+			wantEnv:  []string{"REDISCLI_AUTH=" + password}},
+		{name: "sqlcmd", client: "sqlcmd", login: DBLogin{User: "sa", Database: "crm", Password: secret},
+			wantEnv: []string{"SQLCMDSERVER=tcp:localhost,5433", "SQLCMDUSER=sa", "SQLCMDDBNAME=crm",
+				"SQLCMDPASSWORD=" + password}},
+		{name: "unknown client", client: "pgcli", login: DBLogin{User: "app"}, wantErr: true},
+		{name: "password fails", client: "psql", login: DBLogin{User: "app",
+			Password: staticPassword{err: os.ErrDeadlineExceeded}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			login := tt.login
+			cmd, err := ClientCommand(tt.client, &login, "localhost", 5433)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ClientCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cmd.Path != filepath.Join(bin, tt.client) {
+				t.Errorf("path = %s, want the client on the PATH", cmd.Path)
+			}
+			if args := append([]string(nil), cmd.Args[1:]...); !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("args = %q, want %q", args, tt.wantArgs)
+			}
+			for _, arg := range cmd.Args {
+				if strings.Contains(arg, password) {
+					t.Errorf("the password is in the arguments: %q", cmd.Args)
+				}
+			}
+			// The environment is inherited, with the client's settings added
+			if env := cmd.Env[len(os.Environ()):]; !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("env = %q, want %q", env, tt.wantEnv)
+			}
+		})
+	}
+
+	t.Run("client not installed", func(t *testing.T) {
+		t.Setenv("PATH", t.TempDir())
+		if _, err := ClientCommand("psql", &DBLogin{User: "app"}, "localhost", 5433); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+	"github.com/pkg/errors"
+)
+
+// EngineFamily groups RDS engines by the clients and connection strings
+// they take
+type EngineFamily string
+
+const (
+	FamilyPostgres  EngineFamily = "postgres"
+	FamilyMySQL     EngineFamily = "mysql"
+	FamilySQLServer EngineFamily = "sqlserver"
+	FamilyOracle    EngineFamily = "oracle"
+	FamilyUnknown   EngineFamily = ""
+)
+
+// FamilyOf returns the family of an RDS Engine value, e.g. aurora-postgresql
+// is postgres and mariadb is mysql
+func FamilyOf(engine string) EngineFamily {
+	switch {
+	case strings.Contains(engine, "postgres"):
+		return FamilyPostgres
+	case engine == "aurora" || strings.Contains(engine, "mysql") || engine == "mariadb":
+		return FamilyMySQL
+	case strings.HasPrefix(engine, "sqlserver"):
+		return FamilySQLServer
+	case strings.HasPrefix(engine, "oracle"):
+		return FamilyOracle
+	}
+	return FamilyUnknown
+}
+
+// MasterUsername returns the master user of the target's cluster or instance
+func (t DatabaseTarget) MasterUsername() string {
+	if t.Cluster != nil {
+		return aws.StringValue(t.Cluster.MasterUsername)
+	}
+	if t.Instance != nil {
+		return aws.StringValue(t.Instance.MasterUsername)
+	}
+	return ""
+}
+
+// DatabaseName returns the database created with the cluster or instance,
+// if any
+func (t DatabaseTarget) DatabaseName() string {
+	if t.Cluster != nil {
+		return aws.StringValue(t.Cluster.DatabaseName)
+	}
+	if t.Instance != nil {
+		return aws.StringValue(t.Instance.DBName)
+	}
+	return ""
+}
+
+// IAMAuthEnabled reports whether the target accepts IAM auth tokens
+func (t DatabaseTarget) IAMAuthEnabled() bool {
+	if t.Cluster != nil {
+		return aws.BoolValue(t.Cluster.IAMDatabaseAuthenticationEnabled)
+	}
+	return t.Instance != nil && aws.BoolValue(t.Instance.IAMDatabaseAuthenticationEnabled)
+}
+
+// PasswordSource provides the password to log in to a database with
+type PasswordSource interface {
+	Password() (string, error)
+	// String says where the password comes from without revealing it
+	String() string
+}
+
+// DBLogin is what a client needs to log in to a database through a tunnel
+type DBLogin struct {
+	Engine   string
+	User     string
+	Database string
+	// Password is nil if the password isn't known
+	Password PasswordSource
+}
+
+// ConnectionString returns a URL for connecting to the database on the
+// tunnel's local host and port. The password is left out unless reveal is
+// set.
+func (l *DBLogin) ConnectionString(host string, port int, reveal bool) (string, error) {
+	u := &url.URL{
+		Host: net.JoinHostPort(host, strconv.Itoa(port)),
+		Path: "/" + l.Database,
+	}
+	switch FamilyOf(l.Engine) {
+	case FamilyPostgres:
+		u.Scheme = "postgres"
+		// IAM auth needs TLS, and the certificate can't match localhost
+		u.RawQuery = "sslmode=require"
+	case FamilyMySQL:
+		u.Scheme = "mysql"
+	case FamilySQLServer:
+		u.Scheme, u.Path = "sqlserver", ""
+		if l.Database != "" {
+			u.RawQuery = url.Values{"database": {l.Database}}.Encode()
+		}
+	case FamilyOracle:
+		u.Scheme = "oracle"
+	default:
+		return u.Host, nil
+	}
+	u.User = url.User(l.User)
+	if reveal && l.Password != nil {
+		password, err := l.Password.Password()
+		if err != nil {
+			return "", err
+		}
+		u.User = url.UserPassword(l.User, password)
+	}
+	return u.String(), nil
+}
+
+// iamTokenRefresh is how old an IAM auth token gets before it's replaced.
+// Tokens are valid for 15 minutes, and only need to be when connecting.
+const iamTokenRefresh = 10 * time.Minute
+
+// IAMAuthToken is a PasswordSource of RDS IAM auth tokens for one user and
+// endpoint, generated with a profile's credentials. Tokens are signed
+// locally, so refreshing one doesn't call AWS.
+type IAMAuthToken struct {
+	// Endpoint is the database's own host:port, which the token is signed
+	// for, rather than the tunnel's
+	Endpoint string
+	Region   string
+	User     string
+
+	creds     *credentials.Credentials
+	mu        sync.Mutex
+	token     string
+	generated time.Time
+}
+
+// NewIAMAuthToken generates a first token, to check it can be done
+func NewIAMAuthToken(endpoint, region, user string, creds *credentials.Credentials) (*IAMAuthToken, error) {
+	t := &IAMAuthToken{Endpoint: endpoint, Region: region, User: user, creds: creds}
+	if _, err := t.Password(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Password returns the current token, generating a new one if it is close
+// to expiring
+func (t *IAMAuthToken) Password() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Since(t.generated) < iamTokenRefresh {
+		return t.token, nil
+	}
+	token, err := rdsutils.BuildAuthToken(t.Endpoint, t.Region, t.User, t.creds)
+	if err != nil {
+		return "", NewTunnelError(ErrDatabaseAuth, errors.Wrapf(err, "generating an IAM auth token for %s", t.User))
+	}
+	t.token, t.generated = token, time.Now()
+	return token, nil
+}
+
+// Expires returns when the current token stops being accepted
+func (t *IAMAuthToken) Expires() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.generated.Add(15 * time.Minute)
+}
+
+func (t *IAMAuthToken) String() string {
+	return fmt.Sprintf("IAM auth token for %s, valid until %s", t.User, t.Expires().Format("15:04"))
+}
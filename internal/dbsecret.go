@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/pkg/errors"
+)
+
+// SecretTagKey on an RDS instance or cluster names the Secrets Manager
+// secret holding its credentials
+const SecretTagKey = "tunneller:secret"
+
+// secretNamePrefix is the naming convention for secrets of databases that
+// are neither tagged nor managed by RDS: rds/<cluster or instance identifier>
+const secretNamePrefix = "rds/"
+
+// DatabaseSecret is a PasswordSource holding credentials from a Secrets
+// Manager secret in the format RDS uses
+type DatabaseSecret struct {
+	// Name is the secret's name
+	Name     string
+	Username string
+	DBName   string
+	// Source says how the secret was found
+	Source string
+
+	password string
+}
+
+// Password returns the secret's password
+func (s *DatabaseSecret) Password() (string, error) {
+	return s.password, nil
+}
+
+func (s *DatabaseSecret) String() string {
+	return fmt.Sprintf("from secret %s (%s)", s.Name, s.Source)
+}
+
+// FindDatabaseSecret looks up the credentials of the target's cluster or
+// instance: the secret named by secretID if it is set, otherwise the one
+// named by its SecretTagKey tag, the one RDS manages for it, or one named
+// rds/<identifier>, in that order. Returns nil if none is found.
+func FindDatabaseSecret(ctx context.Context, rdsClient rdsiface.RDSAPI, sm secretsmanageriface.SecretsManagerAPI,
+	target DatabaseTarget, secretID string) (*DatabaseSecret, error) {
+	if secretID != "" {
+		return GetDatabaseSecret(ctx, sm, secretID, "-db-secret")
+	}
+	var arn *string
+	var name string
+	var managed *rds.MasterUserSecret
+	switch {
+	case target.Cluster != nil:
+		arn, name = target.Cluster.DBClusterArn, aws.StringValue(target.Cluster.DBClusterIdentifier)
+		managed = target.Cluster.MasterUserSecret
+	case target.Instance != nil:
+		arn, name = target.Instance.DBInstanceArn, target.Name
+		managed = target.Instance.MasterUserSecret
+	default:
+		return nil, nil
+	}
+
+	resp, err := rdsClient.ListTagsForResourceWithContext(ctx, &rds.ListTagsForResourceInput{ResourceName: arn})
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	for _, t := range resp.TagList {
+		if aws.StringValue(t.Key) == SecretTagKey {
+			return GetDatabaseSecret(ctx, sm, aws.StringValue(t.Value), SecretTagKey+" tag")
+		}
+	}
+
+	if managed != nil && managed.SecretArn != nil {
+		return GetDatabaseSecret(ctx, sm, aws.StringValue(managed.SecretArn), "managed by RDS")
+	}
+
+	secret, err := GetDatabaseSecret(ctx, sm, secretNamePrefix+name, "named "+secretNamePrefix+name)
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return nil, nil
+	}
+	return secret, err
+}
+
+// GetDatabaseSecret fetches a secret's current value, which has to be JSON
+// with at least a password, as RDS and its rotation functions store them
+func GetDatabaseSecret(ctx context.Context, sm secretsmanageriface.SecretsManagerAPI, secretID,
+	source string) (*DatabaseSecret, error) {
+	resp, err := sm.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return nil, NewTunnelError(ErrDatabaseSecret, errors.Wrapf(err, "reading secret %s", secretID))
+	}
+	var value struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		DBName   string `json:"dbname"`
+	}
+	if err := json.Unmarshal([]byte(aws.StringValue(resp.SecretString)), &value); err != nil || value.Password == "" {
+		// The error might quote the secret, so it isn't passed on
+		return nil, NewTunnelError(ErrDatabaseSecret,
+			fmt.Errorf("secret %s isn't JSON with a username and password", secretID))
+	}
+	return &DatabaseSecret{
+		Name:     aws.StringValue(resp.Name),
+		Username: value.Username,
+		DBName:   value.DBName,
+		Source:   source,
+		password: value.Password,
+	}, nil
+}
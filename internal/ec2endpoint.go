@@ -1,9 +1,12 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 
@@ -18,20 +21,52 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// instanceConnectWindow is how long a key pushed with EC2 Instance Connect
+// stays usable. Keys are re-pushed a little early so the window can't close
+// part way through an SSH handshake.
+const (
+	instanceConnectWindow = 60 * time.Second
+	keyPushMargin         = 5 * time.Second
+)
+
 type EC2Endpoint struct {
 	InstanceID string
 	Port       int
 	User       string
 	PrivateKey string
 	PublicKey  string
+	KeyType    KeyType
 	UsePrivate bool
+	// AddressMode picks which of the instance's addresses to connect to.
+	// UsePrivate overrides it with AddressPrivateIPv4.
+	AddressMode AddressMode
+	Auth        *AuthConfig
+	Proxy       *Proxy
+	Options     *SSHOptions
+	// FallbackUsers are tried by NextUser if the bastion rejects User
+	FallbackUsers []string
+	// FallbackKeyType is generated and switched to by NextKey if the bastion
+	// rejects the key, e.g. RSA for an sshd too old for ED25519
+	FallbackKeyType KeyType
+	// selectedHost pins the address chosen by SelectAddress
+	selectedHost string
 
 	Instance      *ec2.Instance
 	EC2Client     ec2iface.EC2API
 	ConnectClient ec2instanceconnectiface.EC2InstanceConnectAPI
+
+	keyMu       sync.Mutex
+	keyPushedAt time.Time
+	// pushErr is why the key couldn't be pushed, while the other methods
+	// are tried without it
+	pushErr error
 }
 
-func NewEC2Endpoint(InstanceID string, ec2Client ec2iface.EC2API, connectClient ec2instanceconnectiface.EC2InstanceConnectAPI) (*EC2Endpoint, error) {
+// NewEC2Endpoint creates an endpoint for the instance, which may be given in
+// any of the forms accepted by ParseEC2Target. The key pair is taken from keys, which is
+// usually started with GenerateKeysAsync while the user picks options. If
+// keys is nil a key of the default type is generated.
+func NewEC2Endpoint(InstanceID string, keys *PendingKeys, ec2Client ec2iface.EC2API, connectClient ec2instanceconnectiface.EC2InstanceConnectAPI) (*EC2Endpoint, error) {
 	endpoint := EC2Endpoint{
 		InstanceID:    InstanceID,
 		User:          "ec2-user",
@@ -39,61 +74,220 @@ func NewEC2Endpoint(InstanceID string, ec2Client ec2iface.EC2API, connectClient
 		EC2Client:     ec2Client,
 		ConnectClient: connectClient,
 	}
-	var err error
 
-	if parts := strings.Split(endpoint.InstanceID, "@"); len(parts) > 1 {
-		endpoint.User = parts[0]
-		endpoint.InstanceID = parts[1]
+	target, err := ParseEC2Target(InstanceID)
+	if err != nil {
+		return &endpoint, err
 	}
-
-	if parts := strings.Split(endpoint.InstanceID, ":"); len(parts) > 1 {
-		endpoint.InstanceID = parts[0]
-		endpoint.Port, _ = strconv.Atoi(parts[1])
+	endpoint.InstanceID = target.InstanceID
+	if target.User != "" {
+		endpoint.User = target.User
+	}
+	if target.Port != 0 {
+		endpoint.Port = target.Port
 	}
 
-	endpoint.PrivateKey, endpoint.PublicKey, err = GenerateKeys()
+	if keys == nil {
+		keys = GenerateKeysAsync(DefaultKeyType)
+	}
+	keyPair, err := keys.Wait()
 	if err != nil {
 		return &endpoint, err
 	}
+	endpoint.PrivateKey, endpoint.PublicKey, endpoint.KeyType = keyPair.PrivateKey, keyPair.PublicKey, keyPair.Type
 
-	endpoint.Instance, err = getEC2Instance(endpoint.InstanceID, endpoint.EC2Client)
+	if target.Name != "" {
+		endpoint.Instance, err = getEC2InstanceByName(target.Name, endpoint.EC2Client)
+	} else {
+		endpoint.Instance, err = getEC2Instance(endpoint.InstanceID, endpoint.EC2Client)
+	}
 	if err != nil {
 		return &endpoint, err
 	}
+	endpoint.InstanceID = aws.StringValue(endpoint.Instance.InstanceId)
 
 	return &endpoint, nil
 }
 
 func (e *EC2Endpoint) String() string {
-	err := sendPublicKey(e.Instance, e.User, e.PublicKey, e.ConnectClient)
-	if err != nil {
-		log.Fatal(err)
+	return net.JoinHostPort(e.Host(), strconv.Itoa(e.Port))
+}
+
+// Host returns the address of the instance chosen by AddressMode, or an
+// empty string if it doesn't have one
+func (e *EC2Endpoint) Host() string {
+	if e.selectedHost != "" {
+		return e.selectedHost
 	}
+	mode := e.AddressMode
 	if e.UsePrivate {
-		return fmt.Sprintf("%s:%d", aws.StringValue(e.Instance.PrivateIpAddress), e.Port)
+		mode = AddressPrivateIPv4
+	}
+	if mode == "" || mode == AddressAuto || mode == AddressProbe {
+		if addresses := InstanceAddresses(e.Instance); len(addresses) > 0 {
+			return addresses[0].Host
+		}
+		return ""
+	}
+	return instanceAddress(e.Instance, mode)
+}
+
+func (e *EC2Endpoint) GetProxy() *Proxy {
+	return e.Proxy
+}
+
+// SelectAddress decides which address to connect to and pins it, probing
+// the instance's addresses if AddressMode is AddressProbe. It returns an
+// ErrBastionDial TunnelError if there is no usable address, which is an
+// ErrNoAddress if the instance has none of the kind asked for.
+func (e *EC2Endpoint) SelectAddress(ctx context.Context) error {
+	e.selectedHost = ""
+	if e.AddressMode == AddressProbe && !e.UsePrivate {
+		a, err := ProbeAddresses(ctx, e.Proxy, InstanceAddresses(e.Instance), e.Port, DefaultProbeTimeout)
+		if err != nil {
+			return NewTunnelError(ErrBastionDial, err)
+		}
+		e.selectedHost = a.Host
+		return nil
+	}
+	host := e.Host()
+	if host == "" {
+		mode := e.AddressMode
+		if e.UsePrivate {
+			mode = AddressPrivateIPv4
+		}
+		return NewTunnelError(ErrBastionDial, &causeError{ErrNoAddress,
+			errors.Errorf("instance %s has no %s address", e.InstanceID, mode)})
+	}
+	e.selectedHost = host
+	return nil
+}
+
+// NextUser switches User to the next of FallbackUsers. The key has to be
+// pushed again for the new user.
+func (e *EC2Endpoint) NextUser() (string, bool) {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	if len(e.FallbackUsers) == 0 {
+		return "", false
+	}
+	e.User, e.FallbackUsers = e.FallbackUsers[0], e.FallbackUsers[1:]
+	e.keyPushedAt = time.Time{}
+	return e.User, true
+}
+
+// NextKey generates a FallbackKeyType key and switches to it, once. The new
+// key has to be pushed again. It returns false if there is no fallback key
+// type, or the ephemeral key isn't pushed with EC2 Instance Connect.
+func (e *EC2Endpoint) NextKey() (KeyType, bool) {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	if e.FallbackKeyType == "" || !e.Auth.Uses(AuthEphemeral) || e.Auth.UsesCertificates() {
+		return "", false
+	}
+	keys, err := GenerateKeysOfType(e.FallbackKeyType)
+	e.FallbackKeyType = ""
+	if err != nil {
+		log.Debugf("No fallback key for %s: %v", e.InstanceID, err)
+		return "", false
+	}
+	e.PrivateKey, e.PublicKey, e.KeyType = keys.PrivateKey, keys.PublicKey, keys.Type
+	e.keyPushedAt, e.pushErr = time.Time{}, nil
+	return e.KeyType, true
+}
+
+// PushKey sends the public key to the instance with EC2 Instance Connect and
+// records when its 60 second window started
+func (e *EC2Endpoint) PushKey(ctx context.Context) error {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	return e.pushKeyLocked(ctx)
+}
+
+// KeyExpiry returns when the last pushed key stops being accepted, or the
+// zero time if the key has never been pushed
+func (e *EC2Endpoint) KeyExpiry() time.Time {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	if e.keyPushedAt.IsZero() {
+		return time.Time{}
 	}
+	return e.keyPushedAt.Add(instanceConnectWindow)
+}
 
-	return fmt.Sprintf("%s:%d", aws.StringValue(e.Instance.PublicIpAddress), e.Port)
+// PrepareAuth pushes the public key if it hasn't been pushed yet or its
+// window has expired. It is called right before each SSH authentication.
+// Nothing is pushed if the ephemeral key isn't one of the auth methods, or
+// if it is presented with a CA signed certificate instead. If the push
+// fails, the ephemeral key is left out and the other methods are tried,
+// unless there aren't any.
+func (e *EC2Endpoint) PrepareAuth(ctx context.Context) error {
+	if !e.Auth.Uses(AuthEphemeral) || e.Auth.UsesCertificates() {
+		return nil
+	}
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	if !e.keyPushedAt.IsZero() && time.Since(e.keyPushedAt) < instanceConnectWindow-keyPushMargin {
+		log.Debugf("Key for %s still valid, not pushing", e.InstanceID)
+		return nil
+	}
+	e.pushErr = e.pushKeyLocked(ctx)
+	if e.pushErr != nil && !e.Auth.usesOtherThan(AuthEphemeral) {
+		return e.pushErr
+	}
+	if e.pushErr != nil {
+		log.Debugf("Not using the ephemeral key for %s: %v", e.InstanceID, e.pushErr)
+	}
+	return nil
+}
+
+// skippedAuth returns why the ephemeral key was left out of the last
+// authentication, if it was
+func (e *EC2Endpoint) skippedAuth() error {
+	e.keyMu.Lock()
+	defer e.keyMu.Unlock()
+	return e.pushErr
+}
+
+func (e *EC2Endpoint) pushKeyLocked(ctx context.Context) error {
+	if e.KeyType != "" && !supportsKeyType(InstanceConnectKeyTypes, e.KeyType) {
+		return NewTunnelError(ErrKeyPush,
+			fmt.Errorf("EC2 Instance Connect does not accept %s keys, use ed25519 or rsa", e.KeyType))
+	}
+	started := time.Now()
+	if err := sendPublicKey(ctx, e.Instance, e.User, e.PublicKey, e.ConnectClient); err != nil {
+		return err
+	}
+	e.keyPushedAt = started
+	log.Debugf("Pushed key for %s@%s", e.User, e.InstanceID)
+	return nil
 }
 
 func (e *EC2Endpoint) GetSSHConfig() (*ssh.ClientConfig, error) {
-	key, err := ssh.ParsePrivateKey([]byte(e.PrivateKey))
+	key := e.PrivateKey
+	if !e.Auth.Uses(AuthEphemeral) || e.skippedAuth() != nil {
+		key = ""
+	}
+	config, err := e.Auth.clientConfig(e.User, key)
 	if err != nil {
 		return nil, err
 	}
+	e.Options.apply(config)
+	return config, nil
+}
 
-	return &ssh.ClientConfig{
-		User: e.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}, nil
+func supportsKeyType(supported []KeyType, keyType KeyType) bool {
+	for _, t := range supported {
+		if t == keyType {
+			return true
+		}
+	}
+	return false
 }
 
-func sendPublicKey(instance *ec2.Instance, user, publicKey string, client ec2instanceconnectiface.EC2InstanceConnectAPI) error {
+func sendPublicKey(ctx context.Context, instance *ec2.Instance, user, publicKey string, client ec2instanceconnectiface.EC2InstanceConnectAPI) error {
 
-	out, err := client.SendSSHPublicKey(&ec2instanceconnect.SendSSHPublicKeyInput{
+	out, err := client.SendSSHPublicKeyWithContext(ctx, &ec2instanceconnect.SendSSHPublicKeyInput{
 		AvailabilityZone: instance.Placement.AvailabilityZone,
 		InstanceId:       instance.InstanceId,
 		InstanceOSUser:   aws.String(user),
@@ -108,11 +302,12 @@ func sendPublicKey(instance *ec2.Instance, user, publicKey string, client ec2ins
 			}
 		}
 
-		return errors.Wrap(err, "send public key error")
+		return NewTunnelError(ErrKeyPush, err)
 	}
 
 	if !*out.Success {
-		return fmt.Errorf("request failed but no error was returned. Request ID: %s", aws.StringValue(out.RequestId))
+		return NewTunnelError(ErrKeyPush,
+			fmt.Errorf("request failed but no error was returned. Request ID: %s", aws.StringValue(out.RequestId)))
 	}
 
 	return nil
@@ -124,12 +319,44 @@ func getEC2Instance(id string, client ec2iface.EC2API) (*ec2.Instance, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, NewTunnelError(ErrDiscovery, err)
 	}
 
 	if len(instanceOutput.Reservations) == 0 || len(instanceOutput.Reservations[0].Instances) == 0 {
-		return nil, errors.New("instance not found")
+		return nil, NewTunnelError(ErrDiscovery, errors.Errorf("instance %s not found", id))
 	}
 
 	return instanceOutput.Reservations[0].Instances[0], nil
 }
+
+func getEC2InstanceByName(name string, client ec2iface.EC2API) (*ec2.Instance, error) {
+	instanceOutput, err := client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name:   aws.String("tag:Name"),
+				Values: []*string{aws.String(name)},
+			},
+			{
+				Name:   aws.String("instance-state-name"),
+				Values: []*string{aws.String("running")},
+			},
+		},
+	})
+
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+
+	var instances []*ec2.Instance
+	for _, r := range instanceOutput.Reservations {
+		instances = append(instances, r.Instances...)
+	}
+	switch len(instances) {
+	case 0:
+		return nil, NewTunnelError(ErrDiscovery, errors.Errorf("no running instance has the Name tag %q", name))
+	case 1:
+		return instances[0], nil
+	}
+	return nil, NewTunnelError(ErrDiscovery,
+		errors.Errorf("%d running instances have the Name tag %q, use an instance ID instead", len(instances), name))
+}
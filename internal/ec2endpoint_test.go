@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect/ec2instanceconnectiface"
+	"github.com/pkg/errors"
+)
+
+// instanceConnectAPI is a fake EC2 Instance Connect API that counts the
+// keys pushed
+type instanceConnectAPI struct {
+	ec2instanceconnectiface.EC2InstanceConnectAPI
+	err    error
+	pushes int
+}
+
+func (a *instanceConnectAPI) SendSSHPublicKeyWithContext(_ aws.Context, _ *ec2instanceconnect.SendSSHPublicKeyInput,
+	_ ...request.Option) (*ec2instanceconnect.SendSSHPublicKeyOutput, error) {
+	a.pushes++
+	if a.err != nil {
+		return nil, a.err
+	}
+	return &ec2instanceconnect.SendSSHPublicKeyOutput{Success: aws.Bool(true)}, nil
+}
+
+func TestEC2EndpointPrepareAuth(t *testing.T) {
+	ephemeralOnly := &AuthConfig{Order: []AuthMethodType{AuthEphemeral}}
+	withAgent := &AuthConfig{Order: []AuthMethodType{AuthEphemeral, AuthAgent}}
+	tests := []struct {
+		name       string
+		auth       *AuthConfig
+		keyType    KeyType
+		pushedAgo  time.Duration
+		err        error
+		wantPushes int
+		wantErr    bool
+		// wantSkipped is set if the ephemeral key is left out of
+		// authentication
+		wantSkipped bool
+	}{
+		{name: "first push", wantPushes: 1},
+		{name: "key still valid", pushedAgo: 30 * time.Second},
+		{name: "key about to expire", pushedAgo: 58 * time.Second, wantPushes: 1},
+		{name: "ephemeral not used", auth: &AuthConfig{Order: []AuthMethodType{AuthAgent}}},
+		{name: "throttled", err: awserr.New(ec2instanceconnect.ErrCodeThrottlingException, "slow down", nil),
+			wantPushes: 1},
+		{name: "push fails", auth: ephemeralOnly, err: awserr.New("AccessDeniedException", "denied", nil),
+			wantPushes: 1, wantErr: true, wantSkipped: true},
+		{name: "push fails with other methods", auth: withAgent, err: awserr.New("AccessDeniedException", "denied", nil),
+			wantPushes: 1, wantSkipped: true},
+		{name: "key type Instance Connect rejects", auth: ephemeralOnly, keyType: KeyTypeECDSA,
+			wantErr: true, wantSkipped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &instanceConnectAPI{err: tt.err}
+			e := &EC2Endpoint{
+				InstanceID:    "i-0123abcd",
+				Port:          22,
+				User:          "ec2-user",
+				KeyType:       tt.keyType,
+				Auth:          tt.auth,
+				Instance:      rankedInstance(nil),
+				ConnectClient: api,
+			}
+			if tt.pushedAgo != 0 {
+				e.keyPushedAt = time.Now().Add(-tt.pushedAgo)
+			}
+
+			// Formatting the endpoint, as logging and the UI do, mustn't push
+			if got := e.String(); got != "203.0.113.10:22" {
+				t.Fatalf("String() = %s", got)
+			}
+			if api.pushes != 0 {
+				t.Fatalf("String() pushed the key")
+			}
+
+			err := e.PrepareAuth(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrepareAuth() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrKeyPush) {
+				t.Errorf("PrepareAuth() error = %v, want an ErrKeyPush", err)
+			}
+			if api.pushes != tt.wantPushes {
+				t.Errorf("pushed %d times, want %d", api.pushes, tt.wantPushes)
+			}
+			if skipped := e.skippedAuth() != nil; skipped != tt.wantSkipped {
+				t.Errorf("ephemeral key skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
@@ -1,10 +1,9 @@
 package internal
 
 import (
-	"fmt"
-
+	"context"
+	"net"
 	"strconv"
-	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -14,51 +13,84 @@ type EndpointIface interface {
 	GetSSHConfig() (*ssh.ClientConfig, error)
 }
 
+// Jumper is implemented by endpoints that have to be reached through another
+// SSH host, like OpenSSH's ProxyJump
+type Jumper interface {
+	JumpHost() EndpointIface
+}
+
+// AuthPreparer is implemented by endpoints that need to do some work, such
+// as pushing a temporary key, before each SSH authentication
+type AuthPreparer interface {
+	PrepareAuth(ctx context.Context) error
+}
+
+// Proxied is implemented by endpoints that are connected to through a proxy
+type Proxied interface {
+	GetProxy() *Proxy
+}
+
 type Endpoint struct {
 	Host       string
 	Port       int
 	User       string
 	PrivateKey string
 	PublicKey  string
+	Auth       *AuthConfig
+	// ProxyJump, if set, is the host this one is reached through
+	ProxyJump *Endpoint
+	// Proxy is used to connect when there is no ProxyJump
+	Proxy   *Proxy
+	Options *SSHOptions
 }
 
-func NewEndpoint(s string) *Endpoint {
-	endpoint := Endpoint{
-		Host: s,
-	}
-
-	if parts := strings.Split(endpoint.Host, "@"); len(parts) > 1 {
-		endpoint.User = parts[0]
-		endpoint.Host = parts[1]
+// ParseEndpoint parses user@host:port, user@[ipv6]:port or
+// ssh://user@host:port. The user and port are optional, the port defaults
+// to 22.
+func ParseEndpoint(s string) (*Endpoint, error) {
+	user, host, port, err := parseAddress(s)
+	if err != nil {
+		return nil, err
 	}
-
-	if parts := strings.Split(endpoint.Host, ":"); len(parts) > 1 {
-		endpoint.Host = parts[0]
-		endpoint.Port, _ = strconv.Atoi(parts[1])
+	endpoint := Endpoint{
+		Host: host,
+		Port: port,
+		User: user,
 	}
 
 	if endpoint.Port == 0 {
 		endpoint.Port = 22
 	}
 
-	return &endpoint
+	return &endpoint, nil
 }
 
 func (e *Endpoint) String() string {
-	return fmt.Sprintf("%s:%d", e.Host, e.Port)
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+// Address formats the endpoint as user@host:port, which ParseEndpoint
+// parses back into the same user, host and port
+func (e *Endpoint) Address() string {
+	return formatAddress(e.User, e.Host, e.Port)
+}
+
+func (e *Endpoint) JumpHost() EndpointIface {
+	if e.ProxyJump == nil {
+		return nil
+	}
+	return e.ProxyJump
+}
+
+func (e *Endpoint) GetProxy() *Proxy {
+	return e.Proxy
 }
 
 func (e *Endpoint) GetSSHConfig() (*ssh.ClientConfig, error) {
-	key, err := ssh.ParsePrivateKey([]byte(e.PrivateKey))
+	config, err := e.Auth.clientConfig(e.User, e.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
-
-	return &ssh.ClientConfig{
-		User: e.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(key),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}, nil
+	e.Options.apply(config)
+	return config, nil
 }
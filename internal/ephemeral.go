@@ -0,0 +1,511 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// EphemeralTagKey marks the AWS resources tunneller creates for a single
+// session. The value is the session that created them.
+const EphemeralTagKey = "tunneller:ephemeral"
+
+// DefaultEphemeralAMIParameter is the public SSM parameter holding the
+// latest Amazon Linux AMI, which comes with EC2 Instance Connect
+const DefaultEphemeralAMIParameter = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+
+// DefaultEphemeralInstanceType is about the smallest instance that copes
+// with forwarding a database connection
+const DefaultEphemeralInstanceType = "t3.micro"
+
+// egressIPURL answers with the address a request to it comes from
+const egressIPURL = "https://checkip.amazonaws.com"
+
+// EgressCIDR returns the public IPv4 address AWS sees this machine's
+// connections come from, as a /32, for allowing SSH from only there. client
+// should connect the way SSH does, e.g. through the same proxy.
+func EgressCIDR(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, egressIPURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "finding this machine's public address")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "finding this machine's public address")
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if resp.StatusCode != http.StatusOK || ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("%s did not answer with an IPv4 address (%s)", egressIPURL, resp.Status)
+	}
+	return ip.String() + "/32", nil
+}
+
+// EphemeralBastionConfig says how to launch a temporary bastion
+type EphemeralBastionConfig struct {
+	// LaunchTemplate is the name or ID of a launch template to launch from.
+	// If it is empty the instance is launched from the AMI in AMIParameter.
+	LaunchTemplate string
+	AMIParameter   string
+	// InstanceType overrides the launch template's
+	InstanceType string
+	// SSHCIDR is the range allowed to SSH to the bastion
+	SSHCIDR string
+}
+
+// EphemeralBastion is an instance launched next to a database for one
+// session, along with the security group and rule letting it reach the
+// database
+type EphemeralBastion struct {
+	Instance *ec2.Instance
+
+	ec2Client ec2iface.EC2API
+	// groupID is the bastion's own security group
+	groupID string
+	// dbGroupID is the database's security group that was given a rule
+	// allowing groupID, and dbPort the port it allows. It is empty if the
+	// bastion joined a group the database already allows instead.
+	dbGroupID string
+	dbPort    int64
+}
+
+// LaunchEphemeralBastion launches a bastion in one of db's subnets and waits
+// for it to be running. It gets a new security group allowing SSH, and also
+// joins a group db's security groups already allow in, if there is one.
+// Only if there isn't is db's first security group told to allow the new
+// group. Everything it creates is tagged with EphemeralTagKey, and is
+// removed again if launching fails.
+func LaunchEphemeralBastion(ctx context.Context, ec2Client ec2iface.EC2API, ssmClient ssmiface.SSMAPI,
+	db *rds.DBInstance, config EphemeralBastionConfig, progress Progress) (*EphemeralBastion, error) {
+	b := &EphemeralBastion{ec2Client: ec2Client}
+	instance, err := b.launch(ctx, ssmClient, db, config, progress)
+	if err != nil {
+		if termErr := b.Terminate(context.Background(), progress); termErr != nil {
+			log.Warnf("Could not remove the temporary bastion's resources: %v", termErr)
+		}
+		return nil, NewTunnelError(ErrBastionLaunch, err)
+	}
+	b.Instance = instance
+	return b, nil
+}
+
+func (b *EphemeralBastion) launch(ctx context.Context, ssmClient ssmiface.SSMAPI, db *rds.DBInstance,
+	config EphemeralBastionConfig, progress Progress) (*ec2.Instance, error) {
+	if db.DBSubnetGroup == nil || len(db.VpcSecurityGroups) == 0 {
+		return nil, fmt.Errorf("%s is not in a VPC", aws.StringValue(db.DBInstanceIdentifier))
+	}
+	subnet, err := pickSubnet(ctx, b.ec2Client, db)
+	if err != nil {
+		return nil, err
+	}
+	session := sessionID()
+	tags := []*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("tunneller-" + aws.StringValue(db.DBInstanceIdentifier))},
+		{Key: aws.String(EphemeralTagKey), Value: aws.String(session)},
+	}
+
+	progress("Creating a security group for the temporary bastion")
+	group, err := b.ec2Client.CreateSecurityGroupWithContext(ctx, &ec2.CreateSecurityGroupInput{
+		GroupName:   aws.String(fmt.Sprintf("tunneller-%d", time.Now().UnixNano())),
+		Description: aws.String("Temporary tunneller bastion for " + session),
+		VpcId:       db.DBSubnetGroup.VpcId,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the security group")
+	}
+	b.groupID = aws.StringValue(group.GroupId)
+	_, err = b.ec2Client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{group.GroupId},
+		Tags:      tags,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "tagging the security group")
+	}
+	_, err = b.ec2Client.AuthorizeSecurityGroupIngressWithContext(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: group.GroupId,
+		IpPermissions: []*ec2.IpPermission{{
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(22),
+			ToPort:     aws.Int64(22),
+			IpRanges:   []*ec2.IpRange{{CidrIp: aws.String(config.SSHCIDR)}},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "allowing SSH to the bastion")
+	}
+
+	port := aws.Int64Value(db.DbInstancePort)
+	if db.Endpoint != nil {
+		port = aws.Int64Value(db.Endpoint.Port)
+	}
+	groups := []*string{group.GroupId}
+	allowed, err := allowedGroup(ctx, b.ec2Client, db, port)
+	if err != nil {
+		return nil, err
+	}
+	if allowed != "" {
+		progress(fmt.Sprintf("The database already allows %s, the temporary bastion joins it", allowed))
+		groups = append(groups, aws.String(allowed))
+	} else {
+		dbGroupID := db.VpcSecurityGroups[0].VpcSecurityGroupId
+		progress(fmt.Sprintf("Allowing the temporary bastion in %s", aws.StringValue(dbGroupID)))
+		_, err = b.ec2Client.AuthorizeSecurityGroupIngressWithContext(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:       dbGroupID,
+			IpPermissions: dbPermission(port, b.groupID),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "allowing the bastion in %s", aws.StringValue(dbGroupID))
+		}
+		b.dbGroupID, b.dbPort = aws.StringValue(dbGroupID), port
+	}
+
+	input := &ec2.RunInstancesInput{
+		MinCount:                          aws.Int64(1),
+		MaxCount:                          aws.Int64(1),
+		InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{{
+			DeviceIndex:              aws.Int64(0),
+			SubnetId:                 subnet.SubnetId,
+			Groups:                   groups,
+			AssociatePublicIpAddress: aws.Bool(true),
+			DeleteOnTermination:      aws.Bool(true),
+		}},
+		TagSpecifications: []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: tags},
+			{ResourceType: aws.String(ec2.ResourceTypeVolume), Tags: tags},
+		},
+	}
+	if config.InstanceType != "" {
+		input.InstanceType = aws.String(config.InstanceType)
+	}
+	if config.LaunchTemplate != "" {
+		input.LaunchTemplate = &ec2.LaunchTemplateSpecification{}
+		if strings.HasPrefix(config.LaunchTemplate, "lt-") {
+			input.LaunchTemplate.LaunchTemplateId = aws.String(config.LaunchTemplate)
+		} else {
+			input.LaunchTemplate.LaunchTemplateName = aws.String(config.LaunchTemplate)
+		}
+	} else {
+		param, err := ssmClient.GetParameterWithContext(ctx, &ssm.GetParameterInput{Name: aws.String(config.AMIParameter)})
+		if err != nil {
+			return nil, errors.Wrapf(err, "looking up the AMI in %s", config.AMIParameter)
+		}
+		input.ImageId = param.Parameter.Value
+		if input.InstanceType == nil {
+			input.InstanceType = aws.String(DefaultEphemeralInstanceType)
+		}
+	}
+
+	progress(fmt.Sprintf("Launching a temporary bastion in %s", aws.StringValue(subnet.SubnetId)))
+	reservation, err := b.ec2Client.RunInstancesWithContext(ctx, input)
+	if err != nil {
+		return nil, errors.Wrap(err, "launching the instance")
+	}
+	b.Instance = reservation.Instances[0]
+	return waitForRunning(ctx, b.ec2Client, aws.StringValue(b.Instance.InstanceId), "Launching", ErrBastionLaunch, progress)
+}
+
+// Terminate terminates the instance, waits for it to go, and removes its
+// security group and the rule allowing it into the database's
+func (b *EphemeralBastion) Terminate(ctx context.Context, progress Progress) error {
+	if b.Instance != nil {
+		id := aws.StringValue(b.Instance.InstanceId)
+		progress(fmt.Sprintf("Terminating %s", id))
+		_, err := b.ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []*string{aws.String(id)},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "terminating %s", id)
+		}
+		// The security group can't be deleted while the instance's network
+		// interface is using it
+		if err := waitForTerminated(ctx, b.ec2Client, []string{id}, progress); err != nil {
+			return err
+		}
+	}
+	if b.dbGroupID != "" {
+		_, err := b.ec2Client.RevokeSecurityGroupIngressWithContext(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(b.dbGroupID),
+			IpPermissions: dbPermission(b.dbPort, b.groupID),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "removing the bastion's rule from %s", b.dbGroupID)
+		}
+	}
+	if b.groupID != "" {
+		_, err := b.ec2Client.DeleteSecurityGroupWithContext(ctx, &ec2.DeleteSecurityGroupInput{
+			GroupId: aws.String(b.groupID),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "deleting %s", b.groupID)
+		}
+	}
+	return nil
+}
+
+// allowedGroup finds a security group in db's VPC that db's security groups
+// already allow in on port, so a bastion can join it rather than have a
+// rule added to them. Returns an empty string if there isn't one.
+func allowedGroup(ctx context.Context, ec2Client ec2iface.EC2API, db *rds.DBInstance, port int64) (string, error) {
+	var ids []*string
+	for _, g := range db.VpcSecurityGroups {
+		ids = append(ids, g.VpcSecurityGroupId)
+	}
+	resp, err := ec2Client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: ids})
+	if err != nil {
+		return "", errors.Wrap(err, "describing the database's security groups")
+	}
+	dbGroups := resp.SecurityGroups
+
+	var referenced []*string
+	for _, g := range dbGroups {
+		for _, perm := range g.IpPermissions {
+			for _, pair := range perm.UserIdGroupPairs {
+				referenced = append(referenced, pair.GroupId)
+			}
+		}
+	}
+	if len(referenced) == 0 {
+		return "", nil
+	}
+	// Groups in other VPCs or accounts can't be joined, and a rule may
+	// refer to a group that has since been deleted
+	resp, err = ec2Client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("group-id"), Values: referenced},
+			{Name: aws.String("vpc-id"), Values: []*string{db.DBSubnetGroup.VpcId}},
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "describing the groups the database allows")
+	}
+	for _, g := range resp.SecurityGroups {
+		id := aws.StringValue(g.GroupId)
+		if allowingGroup(dbGroups, false, port, map[string]bool{id: true}, nil) != "" {
+			return id, nil
+		}
+	}
+	return "", nil
+}
+
+func dbPermission(port int64, groupID string) []*ec2.IpPermission {
+	return []*ec2.IpPermission{{
+		IpProtocol:       aws.String("tcp"),
+		FromPort:         aws.Int64(port),
+		ToPort:           aws.Int64(port),
+		UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String(groupID)}},
+	}}
+}
+
+// pickSubnet picks the subnet of db's subnet group to launch in, preferring
+// ones giving instances public addresses, then the database's availability
+// zone
+func pickSubnet(ctx context.Context, ec2Client ec2iface.EC2API, db *rds.DBInstance) (*ec2.Subnet, error) {
+	var ids []*string
+	for _, s := range db.DBSubnetGroup.Subnets {
+		ids = append(ids, s.SubnetIdentifier)
+	}
+	resp, err := ec2Client.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{SubnetIds: ids})
+	if err != nil {
+		return nil, errors.Wrap(err, "describing the database's subnets")
+	}
+	if len(resp.Subnets) == 0 {
+		return nil, fmt.Errorf("%s has no subnets", aws.StringValue(db.DBSubnetGroup.DBSubnetGroupName))
+	}
+	best, bestScore := resp.Subnets[0], -1
+	for _, s := range resp.Subnets {
+		score := 0
+		if aws.BoolValue(s.MapPublicIpOnLaunch) {
+			score += 2
+		}
+		if aws.StringValue(s.AvailabilityZone) == aws.StringValue(db.AvailabilityZone) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best, nil
+}
+
+func waitForTerminated(ctx context.Context, ec2Client ec2iface.EC2API, instanceIDs []string, progress Progress) error {
+	started := time.Now()
+	for {
+		resp, err := ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: aws.StringSlice(instanceIDs),
+		})
+		if err != nil {
+			return err
+		}
+		remaining := 0
+		for _, res := range resp.Reservations {
+			for _, inst := range res.Instances {
+				if aws.StringValue(inst.State.Name) != ec2.InstanceStateNameTerminated {
+					remaining++
+				}
+			}
+		}
+		if remaining == 0 {
+			return nil
+		}
+		progress(fmt.Sprintf("Waiting for %d instance(s) to terminate (%s)", remaining,
+			time.Since(started).Round(time.Second)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(instancePollInterval):
+		}
+	}
+}
+
+// CleanupEphemeral terminates instances tagged with EphemeralTagKey that no
+// session holds a lease on, and deletes tagged security groups nothing uses
+// any more, along with the rules referring to them. Instances launched
+// within DefaultLeaseTTL are left alone, in case their session hasn't taken
+// its lease yet. With dryRun set it only reports what it would remove.
+// Returns what was removed.
+func CleanupEphemeral(ctx context.Context, ec2Client ec2iface.EC2API, dryRun bool, progress Progress) ([]string, error) {
+	var removed, terminate []string
+	err := ec2Client.DescribeInstancesPagesWithContext(ctx, &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag-key"), Values: []*string{aws.String(EphemeralTagKey)}},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{
+				ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning,
+				ec2.InstanceStateNameStopping, ec2.InstanceStateNameStopped,
+			})},
+		},
+	}, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, res := range page.Reservations {
+			for _, inst := range res.Instances {
+				if time.Since(aws.TimeValue(inst.LaunchTime)) > DefaultLeaseTTL {
+					terminate = append(terminate, aws.StringValue(inst.InstanceId))
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing temporary instances")
+	}
+
+	var orphans []string
+	orphaned := make(map[string]bool)
+	for _, id := range terminate {
+		holders, err := ActiveLeases(ctx, ec2Client, id)
+		if err != nil {
+			return removed, errors.Wrapf(err, "checking the leases on %s", id)
+		}
+		if len(holders) > 0 {
+			log.Infof("%s is still used by %s", id, strings.Join(holders, ", "))
+			continue
+		}
+		orphans = append(orphans, id)
+		orphaned[id] = true
+		removed = append(removed, "instance "+id)
+	}
+	if len(orphans) > 0 && !dryRun {
+		progress(fmt.Sprintf("Terminating %s", strings.Join(orphans, ", ")))
+		_, err := ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: aws.StringSlice(orphans),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "terminating temporary instances")
+		}
+		if err := waitForTerminated(ctx, ec2Client, orphans, progress); err != nil {
+			return removed, err
+		}
+	}
+
+	groups, err := ec2Client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("tag-key"), Values: []*string{aws.String(EphemeralTagKey)}}},
+	})
+	if err != nil {
+		return removed, errors.Wrap(err, "listing temporary security groups")
+	}
+	for _, g := range groups.SecurityGroups {
+		id := aws.StringValue(g.GroupId)
+		interfaces, err := ec2Client.DescribeNetworkInterfacesWithContext(ctx, &ec2.DescribeNetworkInterfacesInput{
+			Filters: []*ec2.Filter{{Name: aws.String("group-id"), Values: []*string{g.GroupId}}},
+		})
+		if err != nil {
+			return removed, errors.Wrapf(err, "checking whether %s is in use", id)
+		}
+		inUse := false
+		for _, ni := range interfaces.NetworkInterfaces {
+			// With a dry run the orphaned instances are still using their groups
+			if ni.Attachment == nil || !orphaned[aws.StringValue(ni.Attachment.InstanceId)] {
+				inUse = true
+			}
+		}
+		if inUse {
+			continue
+		}
+		if dryRun {
+			removed = append(removed, "security group "+id)
+			continue
+		}
+		if err := revokeReferences(ctx, ec2Client, id); err != nil {
+			return removed, err
+		}
+		_, err = ec2Client.DeleteSecurityGroupWithContext(ctx, &ec2.DeleteSecurityGroupInput{GroupId: g.GroupId})
+		if err != nil {
+			return removed, errors.Wrapf(err, "deleting %s", id)
+		}
+		removed = append(removed, "security group "+id)
+	}
+	return removed, nil
+}
+
+// revokeReferences removes the ingress rules of other security groups that
+// allow groupID
+func revokeReferences(ctx context.Context, ec2Client ec2iface.EC2API, groupID string) error {
+	resp, err := ec2Client.DescribeSecurityGroupsWithContext(ctx, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("ip-permission.group-id"), Values: []*string{aws.String(groupID)}}},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "finding rules referring to %s", groupID)
+	}
+	for _, g := range resp.SecurityGroups {
+		var perms []*ec2.IpPermission
+		for _, perm := range g.IpPermissions {
+			for _, pair := range perm.UserIdGroupPairs {
+				if aws.StringValue(pair.GroupId) == groupID {
+					perms = append(perms, &ec2.IpPermission{
+						IpProtocol:       perm.IpProtocol,
+						FromPort:         perm.FromPort,
+						ToPort:           perm.ToPort,
+						UserIdGroupPairs: []*ec2.UserIdGroupPair{{GroupId: aws.String(groupID)}},
+					})
+				}
+			}
+		}
+		if len(perms) == 0 {
+			continue
+		}
+		_, err := ec2Client.RevokeSecurityGroupIngressWithContext(ctx, &ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       g.GroupId,
+			IpPermissions: perms,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "removing the rule for %s from %s", groupID, aws.StringValue(g.GroupId))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/pkg/errors"
+)
+
+// Stage errors identify which step of setting up a tunnel failed. Use
+// errors.Is to test for them, and errors.As with a *TunnelError to get the
+// AWS error code and a remediation hint.
+var (
+	ErrCredentialLoad  = errors.New("could not load AWS credentials")
+	ErrRoleAssumption  = errors.New("could not assume role")
+	ErrDiscovery       = errors.New("could not discover AWS resources")
+	ErrKeyPush         = errors.New("could not push public key to the bastion")
+	ErrBastionStart    = errors.New("could not start the bastion")
+	ErrBastionLaunch   = errors.New("could not launch a temporary bastion")
+	ErrDatabaseStart   = errors.New("could not start the database")
+	ErrDatabaseRestore = errors.New("could not restore a temporary copy of the database")
+	ErrDatabaseAuth    = errors.New("could not get database credentials")
+	ErrDatabaseSecret  = errors.New("could not read the database secret")
+	ErrBastionDial     = errors.New("could not reach the bastion")
+	ErrSSHAuth         = errors.New("bastion rejected SSH authentication")
+	ErrTargetDial      = errors.New("bastion could not reach the target")
+	ErrListenerBind    = errors.New("could not bind the local listener")
+)
+
+// Cause errors say more about why a stage failed, and are matched with
+// errors.Is like the stage errors
+var (
+	// ErrNoAddress is a bastion having no address of the kind asked for
+	ErrNoAddress = errors.New("no such address")
+	// ErrAllUsersRejected is the bastion rejecting every OS user tried
+	ErrAllUsersRejected = errors.New("every OS user was rejected")
+	// ErrInstanceConnectAuth is an EC2 bastion rejecting authentication
+	// when the ephemeral key is meant to be pushed with EC2 Instance Connect
+	ErrInstanceConnectAuth = errors.New("EC2 Instance Connect bastion rejected authentication")
+)
+
+// causeError matches cause with errors.Is, keeping err's message and chain
+type causeError struct {
+	cause error
+	err   error
+}
+
+func (e *causeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *causeError) Unwrap() error {
+	return e.err
+}
+
+func (e *causeError) Is(target error) bool {
+	return target == e.cause
+}
+
+// withCause attaches cause to err, a TunnelError, and prefixes its message
+// if format isn't empty. The TunnelError is made again so that its hint
+// takes the cause into account.
+func withCause(err error, cause error, format string, args ...interface{}) error {
+	var te *TunnelError
+	if !errors.As(err, &te) {
+		return err
+	}
+	inner := te.Err
+	if format != "" {
+		inner = errors.Wrapf(inner, format, args...)
+	}
+	return NewTunnelError(te.Stage, &causeError{cause, inner})
+}
+
+// TunnelError wraps an underlying failure with the stage it happened in
+type TunnelError struct {
+	// Stage is one of the Err* stage errors above
+	Stage error
+	// Code is the AWS error code of the underlying error, if it came from AWS
+	Code string
+	// Hint is a human readable suggestion for fixing the problem
+	Hint string
+	Err  error
+}
+
+// NewTunnelError wraps err as a failure in the given stage. Returns nil if
+// err is nil.
+func NewTunnelError(stage error, err error) error {
+	if err == nil {
+		return nil
+	}
+	var existing *TunnelError
+	if errors.As(err, &existing) && existing.Stage == stage {
+		return err
+	}
+	te := &TunnelError{
+		Stage: stage,
+		Err:   err,
+	}
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		te.Code = awsErr.Code()
+	}
+	te.Hint = hintFor(stage, te.Code, err)
+	return te
+}
+
+func (e *TunnelError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%s): %v", e.Stage, e.Code, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TunnelError) Is(target error) bool {
+	return target == e.Stage
+}
+
+// Hint returns the remediation hint attached to err, or an empty string if
+// it isn't a TunnelError
+func Hint(err error) string {
+	var te *TunnelError
+	if errors.As(err, &te) {
+		return te.Hint
+	}
+	return ""
+}
+
+func hintFor(stage error, code string, err error) string {
+	switch code {
+	case "InvalidClientTokenId", "SignatureDoesNotMatch", "AuthFailure", "UnrecognizedClientException":
+		return "AWS rejected the credentials. Check the access key ID and secret in your credentials file " +
+			"haven't been rotated or mistyped"
+	case "ExpiredToken", "ExpiredTokenException", "RequestExpired":
+		return "The credentials have expired. Refresh them, and check your system clock is correct"
+	case "OptInRequired", "RegionDisabledException":
+		return "The region is not enabled for this account. Enable it in the account settings or pick another region"
+	case request.CanceledErrorCode:
+		return "The request was cancelled before it finished"
+	}
+
+	switch stage {
+	case ErrCredentialLoad:
+		return "Check the credentials file (-credentials) exists and each profile has either " +
+			"aws_access_key_id and aws_secret_access_key, or role_arn and source_profile"
+	case ErrRoleAssumption:
+		if isAccessDenied(code) {
+			return "The source profile is not allowed to call sts:AssumeRole on the role, or the role's " +
+				"trust policy does not trust the source profile"
+		}
+		return "Check the role_arn and source_profile of the profile are correct"
+	case ErrDiscovery:
+		if isAccessDenied(code) {
+			return "The profile is missing read permissions. It needs ec2:DescribeInstances and " +
+				"rds:DescribeDBInstances in this region"
+		}
+		return "Check the profile has access to the selected region"
+	case ErrKeyPush:
+		switch code {
+		case "AuthException", "AccessDeniedException":
+			return "The profile needs ec2-instance-connect:SendSSHPublicKey for this instance and OS user. " +
+				"Check any ec2:osuser condition in the IAM policy matches -os-user"
+		case "EC2InstanceNotFoundException":
+			return "The instance could not be found. It may have been terminated or be in another region"
+		case "InvalidArgsException":
+			return "The OS user or key was rejected. Check -os-user is a valid user name for the instance"
+		case "ServiceException":
+			return "EC2 Instance Connect had an internal error. Try again in a moment"
+		}
+		return "Check the instance is running and supports EC2 Instance Connect"
+	case ErrBastionStart:
+		if isAccessDenied(code) {
+			return "The profile needs ec2:StartInstances and ec2:DescribeInstances for the bastion"
+		}
+		if code == "IncorrectInstanceState" {
+			return "The instance is changing state. Wait for it to finish stopping and try again"
+		}
+		return "Check the instance can be started from the EC2 console, e.g. that there is capacity for its type"
+	case ErrBastionLaunch:
+		switch {
+		case isAccessDenied(code):
+			return "The profile needs ec2:RunInstances, ec2:TerminateInstances, ec2:CreateSecurityGroup, " +
+				"ec2:DeleteSecurityGroup, ec2:AuthorizeSecurityGroupIngress, ec2:RevokeSecurityGroupIngress, " +
+				"ec2:CreateTags and ssm:GetParameter"
+		case code == "ParameterNotFound":
+			return "The AMI parameter doesn't exist in this region. Check -ephemeral-ami-parameter"
+		case strings.HasPrefix(code, "InvalidLaunchTemplate"):
+			return "Check -ephemeral-launch-template is the name or ID of a launch template in this region"
+		case code == "InsufficientInstanceCapacity" || code == "Unsupported":
+			return "The instance type isn't available in the database's subnet. Try another with " +
+				"-ephemeral-instance-type"
+		}
+		return "Anything tunneller created is tagged tunneller:ephemeral, run tunneller cleanup to remove leftovers"
+	case ErrDatabaseStart:
+		switch {
+		case isAccessDenied(code):
+			return "The profile needs rds:StartDBInstance, or rds:StartDBCluster for Aurora, and " +
+				"rds:DescribeDBInstances and rds:DescribeDBClusters"
+		case code == rds.ErrCodeInvalidDBInstanceStateFault || code == rds.ErrCodeInvalidDBClusterStateFault:
+			return "The database is changing state. Wait for it to finish stopping and try again"
+		}
+		return "Some databases, like read replicas, can't be stopped and started. Check it can be started " +
+			"from the RDS console"
+	case ErrDatabaseRestore:
+		switch {
+		case isAccessDenied(code):
+			return "The profile needs rds:RestoreDBInstanceFromDBSnapshot or rds:RestoreDBInstanceToPointInTime, " +
+				"rds:AddTagsToResource and rds:DeleteDBInstance"
+		case code == rds.ErrCodeDBSnapshotNotFoundFault:
+			return "Check the snapshot identifier, or pick one from the list with -restore ask"
+		case code == rds.ErrCodeInvalidRestoreFault || code == rds.ErrCodePointInTimeRestoreNotEnabledFault:
+			return "The time has to be within the instance's backup retention period, and backups have to be " +
+				"enabled. Use latest for the most recent restorable time"
+		case code == rds.ErrCodeInstanceQuotaExceededFault || code == rds.ErrCodeStorageQuotaExceededFault:
+			return "The account has reached its RDS quota. Delete unused instances or run tunneller cleanup"
+		}
+		return "Anything tunneller restored is tagged tunneller:ephemeral, run tunneller cleanup to remove leftovers"
+	case ErrDatabaseSecret:
+		switch {
+		case isAccessDenied(code):
+			return "Reading database secrets needs secretsmanager:GetSecretValue, and kms:Decrypt on the " +
+				"secret's key if it isn't the default one"
+		case code == "ResourceNotFoundException":
+			return "Check the secret's name or ARN in -db-secret or the tunneller:secret tag, and that it is " +
+				"in the same region"
+		case code == "DecryptionFailure":
+			return "The profile can't use the KMS key the secret is encrypted with"
+		case code != "":
+			return ""
+		}
+		return "The secret has to be JSON with at least a password, as RDS stores them"
+	case ErrDatabaseAuth:
+		return "IAM auth tokens are signed with the profile's credentials, which also need rds-db:connect for " +
+			"the database user, and the user has to be granted rds_iam (PostgreSQL) or identified with " +
+			"AWSAuthenticationPlugin (MySQL)"
+	case ErrBastionDial:
+		var proxyErr *ProxyError
+		if errors.As(err, &proxyErr) {
+			return "Check the proxy address and credentials (-proxy, -proxy-user, HTTPS_PROXY or ALL_PROXY), " +
+				"and that it allows connections to port 22. Add the bastion to -no-proxy to skip the proxy"
+		}
+		if errors.Is(err, ErrNoAddress) {
+			return "Pick another address with -bastion-address (or press a in the bastion list). " +
+				"Use private if you are on a VPN or Direct Connect, or probe to try them all"
+		}
+		return "Check the bastion has a public IP (or that you are on a network that can reach its private IP) " +
+			"and that its security group allows inbound SSH on port 22 from your address"
+	case ErrSSHAuth:
+		switch {
+		case errors.Is(err, ErrAllUsersRejected):
+			return "None of the usual OS users worked. Tag the instance with tunneller:os-user=<user>, or set " +
+				"-os-user, and check ec2-instance-connect is installed on the instance"
+		case errors.Is(err, ErrInstanceConnectAuth):
+			return "The bastion rejected the key. The OS user is probably wrong for the AMI (ec2-user for Amazon " +
+				"Linux, ubuntu for Ubuntu, admin for Debian; set it with -os-user or a tunneller:os-user tag), " +
+				"or ec2-instance-connect is not installed on the instance"
+		}
+		return "The bastion rejected every method tried. Check the user (user@host or User in the ssh config), " +
+			"that ssh-agent or -identity-file has a key the bastion accepts, and that -auth includes the " +
+			"methods it allows"
+	case ErrTargetDial:
+		return "The bastion could not connect to the target. Check the target's security group allows its port " +
+			"from the bastion's security group, and that both are in the same or a peered VPC"
+	case ErrListenerBind:
+		return "Another program is probably already using the local port. Choose another with -local-port"
+	}
+	return ""
+}
+
+func isAccessDenied(code string) bool {
+	return code == "AccessDenied" || code == "AccessDeniedException" || code == "UnauthorizedOperation"
+}
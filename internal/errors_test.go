@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+func TestNewTunnelError(t *testing.T) {
+	accessDenied := awserr.New("AccessDenied", "not allowed", nil)
+	existing := NewTunnelError(ErrDiscovery, accessDenied)
+
+	tests := []struct {
+		name      string
+		stage     error
+		err       error
+		wantNil   bool
+		wantSame  bool
+		wantStage error
+		wantCode  string
+		wantIs    []error
+		wantNotIs []error
+	}{
+		{name: "nil", stage: ErrDiscovery, err: nil, wantNil: true},
+		{name: "plain error", stage: ErrBastionDial, err: errors.New("connection refused"),
+			wantStage: ErrBastionDial, wantIs: []error{ErrBastionDial}, wantNotIs: []error{ErrSSHAuth}},
+		{name: "AWS error", stage: ErrDiscovery, err: accessDenied,
+			wantStage: ErrDiscovery, wantCode: "AccessDenied", wantIs: []error{ErrDiscovery}},
+		{name: "wrapped AWS error", stage: ErrKeyPush, err: errors.Wrap(awserr.New("AuthException", "denied", nil), "pushing"),
+			wantStage: ErrKeyPush, wantCode: "AuthException", wantIs: []error{ErrKeyPush}},
+		{name: "same stage", stage: ErrDiscovery, err: existing, wantSame: true,
+			wantStage: ErrDiscovery, wantCode: "AccessDenied", wantIs: []error{ErrDiscovery}},
+		{name: "another stage", stage: ErrBastionStart, err: existing,
+			wantStage: ErrBastionStart, wantCode: "AccessDenied", wantIs: []error{ErrBastionStart, ErrDiscovery}},
+		{name: "cause", stage: ErrBastionDial, err: &causeError{ErrNoAddress, errors.New("no public IPv4 address")},
+			wantStage: ErrBastionDial, wantIs: []error{ErrBastionDial, ErrNoAddress}, wantNotIs: []error{ErrAllUsersRejected}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewTunnelError(tt.stage, tt.err)
+			if tt.wantNil {
+				if err != nil {
+					t.Fatalf("got %v, want nil", err)
+				}
+				return
+			}
+			if tt.wantSame && err != tt.err {
+				t.Fatalf("got a new error %v, want the existing one", err)
+			}
+			var te *TunnelError
+			if !errors.As(err, &te) {
+				t.Fatalf("%v is not a TunnelError", err)
+			}
+			if te.Stage != tt.wantStage {
+				t.Errorf("stage = %v, want %v", te.Stage, tt.wantStage)
+			}
+			if te.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", te.Code, tt.wantCode)
+			}
+			for _, target := range tt.wantIs {
+				if !errors.Is(err, target) {
+					t.Errorf("errors.Is(%v) = false, want true", target)
+				}
+			}
+			for _, target := range tt.wantNotIs {
+				if errors.Is(err, target) {
+					t.Errorf("errors.Is(%v) = true, want false", target)
+				}
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("the underlying error is lost")
+			}
+		})
+	}
+}
+
+func TestHint(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		contains string
+	}{
+		{name: "nil", err: nil},
+		{name: "not a tunnel error", err: errors.New("boom")},
+		{name: "expired credentials beat the stage", err: NewTunnelError(ErrDiscovery, awserr.New("ExpiredToken", "expired", nil)),
+			contains: "expired"},
+		{name: "stage with access denied", err: NewTunnelError(ErrBastionStart, awserr.New("UnauthorizedOperation", "no", nil)),
+			contains: "ec2:StartInstances"},
+		{name: "stage default", err: NewTunnelError(ErrListenerBind, errors.New("address already in use")),
+			contains: "-local-port"},
+		{name: "proxy failure", err: NewTunnelError(ErrBastionDial, &ProxyError{Proxy: "http://proxy:3128", Err: errors.New("refused")}),
+			contains: "-no-proxy"},
+		{name: "no address", err: NewTunnelError(ErrBastionDial, &causeError{ErrNoAddress, errors.New("no public IPv4 address")}),
+			contains: "-bastion-address"},
+		{name: "plain SSH bastion rejected", err: NewTunnelError(ErrSSHAuth, errors.New("unable to authenticate")),
+			contains: "-auth"},
+		{name: "Instance Connect bastion rejected",
+			err:      withCause(NewTunnelError(ErrSSHAuth, errors.New("unable to authenticate")), ErrInstanceConnectAuth, ""),
+			contains: "ec2-instance-connect"},
+		{name: "every user rejected",
+			err:      withCause(NewTunnelError(ErrSSHAuth, errors.New("unable to authenticate")), ErrAllUsersRejected, "tried %s", "ec2-user, ubuntu"),
+			contains: "tunneller:os-user"},
+		{name: "wrapped tunnel error", err: errors.Wrap(NewTunnelError(ErrListenerBind, errors.New("in use")), "tunnel 1"),
+			contains: "-local-port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hint := Hint(tt.err)
+			if tt.contains == "" {
+				if hint != "" {
+					t.Fatalf("got hint %q, want none", hint)
+				}
+				return
+			}
+			if !strings.Contains(hint, tt.contains) {
+				t.Fatalf("hint %q doesn't mention %q", hint, tt.contains)
+			}
+		})
+	}
+}
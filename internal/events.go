@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EventType identifies a change in the state of a tunnel
+type EventType string
+
+const (
+	// EventTunnelUp is published once the local listener is accepting connections
+	EventTunnelUp EventType = "tunnel-up"
+	// EventClientConnected is published when a local client connects to the listener
+	EventClientConnected EventType = "client-connected"
+	// EventClientDisconnected is published when a local client's forwarded connection ends
+	EventClientDisconnected EventType = "client-disconnected"
+	// EventBastionDropped is published when the bastion drops an SSH connection we didn't close
+	EventBastionDropped EventType = "bastion-dropped"
+	// EventTunnelDown is published when the local listener is torn down
+	EventTunnelDown EventType = "tunnel-down"
+)
+
+// EventTypes lists every event a tunnel can publish
+var EventTypes = []EventType{
+	EventTunnelUp,
+	EventClientConnected,
+	EventClientDisconnected,
+	EventBastionDropped,
+	EventTunnelDown,
+}
+
+// ParseEventType turns a name like "tunnel-up" into an EventType
+func ParseEventType(s string) (EventType, error) {
+	for _, t := range EventTypes {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q", s)
+}
+
+// Event describes a single tunnel state change
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	LocalPort int
+	Bastion   string
+	Remote    string
+	// Client is the address of the local client, set for client events, and
+	// for bastion-dropped when the bastion connection was the client's own
+	Client string
+	// Err is the error that caused the event, if any
+	Err error
+}
+
+// Observer receives tunnel events. Each subscription gets its events on a
+// goroutine of its own, in the order they were published, so a slow
+// observer holds up neither the tunnel nor the other observers.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc adapts a plain function to the Observer interface
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// subscription queues events for one observer and hands them over on its
+// own goroutine
+type subscription struct {
+	observer Observer
+	types    map[EventType]bool
+
+	mu sync.Mutex
+	// delivered is signalled each time pending drops to zero
+	delivered *sync.Cond
+	queue     []Event
+	// pending counts the queued events and the one being delivered
+	pending int
+	wake    chan struct{}
+	closed  bool
+}
+
+func newSubscription(o Observer, types []EventType) *subscription {
+	s := &subscription{observer: o, wake: make(chan struct{}, 1)}
+	s.delivered = sync.NewCond(&s.mu)
+	if len(types) > 0 {
+		s.types = make(map[EventType]bool)
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	go s.deliver()
+	return s
+}
+
+func (s *subscription) wants(t EventType) bool {
+	return s.types == nil || s.types[t]
+}
+
+func (s *subscription) send(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.pending++
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) deliver() {
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			if s.closed || len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			e := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.observer.OnEvent(e)
+
+			s.mu.Lock()
+			s.pending--
+			if s.pending == 0 {
+				s.delivered.Broadcast()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// wait blocks until every event sent so far has been delivered, or the
+// subscription is closed
+func (s *subscription) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.pending > 0 && !s.closed {
+		s.delivered.Wait()
+	}
+}
+
+// close drops any events not yet delivered
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	close(s.wake)
+	s.delivered.Broadcast()
+}
+
+type eventBus struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]*subscription
+}
+
+func (b *eventBus) subscribe(o Observer, types []EventType) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs == nil {
+		b.subs = make(map[int]*subscription)
+	}
+	id := b.next
+	b.next++
+	b.subs[id] = newSubscription(o, types)
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if s, ok := b.subs[id]; ok {
+			delete(b.subs, id)
+			s.close()
+		}
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subs {
+		if s.wants(e.Type) {
+			s.send(e)
+		}
+	}
+}
+
+// flush blocks until every event published so far has been handed to its
+// observers
+func (b *eventBus) flush() {
+	b.mu.RLock()
+	subs := make([]*subscription, 0, len(b.subs))
+	for _, s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+	for _, s := range subs {
+		s.wait()
+	}
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is an Observer that keeps the types of the events it receives
+type recorder struct {
+	mu     sync.Mutex
+	events []EventType
+}
+
+func (r *recorder) OnEvent(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e.Type)
+}
+
+func (r *recorder) received() []EventType {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]EventType(nil), r.events...)
+}
+
+func TestEventBus(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []EventType
+		// unsubscribeAfter unsubscribes once that many events have been
+		// published, if set
+		unsubscribeAfter int
+		want             []EventType
+	}{
+		{name: "every event", want: EventTypes},
+		{name: "filtered", types: []EventType{EventTunnelUp, EventTunnelDown},
+			want: []EventType{EventTunnelUp, EventTunnelDown}},
+		{name: "unsubscribed", unsubscribeAfter: 2,
+			want: []EventType{EventTunnelUp, EventClientConnected}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bus eventBus
+			r := &recorder{}
+			unsubscribe := bus.subscribe(r, tt.types)
+			for i, typ := range EventTypes {
+				if tt.unsubscribeAfter > 0 && i == tt.unsubscribeAfter {
+					bus.flush()
+					unsubscribe()
+				}
+				bus.publish(Event{Type: typ})
+			}
+			bus.flush()
+			if got := r.received(); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventBusSlowObserver(t *testing.T) {
+	var bus eventBus
+	release := make(chan struct{})
+	bus.subscribe(ObserverFunc(func(Event) { <-release }), nil)
+	r := &recorder{}
+	bus.subscribe(r, nil)
+
+	published := make(chan struct{})
+	go func() {
+		for _, typ := range EventTypes {
+			bus.publish(Event{Type: typ})
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on a slow observer")
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		bus.flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before the slow observer had its events")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-flushed
+	if got := r.received(); !reflect.DeepEqual(got, EventTypes) {
+		t.Fatalf("received %v, want %v", got, EventTypes)
+	}
+}
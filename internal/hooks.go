@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CommandHook is an Observer that runs a shell command for each event it
+// receives, with the event details in TUNNELLER_* environment variables
+type CommandHook struct {
+	Events  []EventType
+	Command string
+
+	running sync.WaitGroup
+}
+
+// ParseCommandHook parses a hook spec of the form "event[,event...]=command".
+// The event list may be "all" to run the command for every event.
+func ParseCommandHook(spec string) (*CommandHook, error) {
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("hook %q should look like event[,event...]=command", spec)
+	}
+	hook := &CommandHook{
+		Command: parts[1],
+	}
+	if strings.TrimSpace(parts[0]) == "all" {
+		return hook, nil
+	}
+	for _, name := range strings.Split(parts[0], ",") {
+		t, err := ParseEventType(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		hook.Events = append(hook.Events, t)
+	}
+	return hook, nil
+}
+
+func (h *CommandHook) OnEvent(e Event) {
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		cmd := shellCommand(h.Command)
+		cmd.Env = append(os.Environ(), eventEnvironment(e)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Errorf("Hook %q for %s failed: %v: %s", h.Command, e.Type, err, strings.TrimSpace(string(out)))
+		}
+	}()
+}
+
+// Wait blocks until every command started by the hook has exited
+func (h *CommandHook) Wait() {
+	h.running.Wait()
+}
+
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("/bin/sh", "-c", command)
+}
+
+func eventEnvironment(e Event) []string {
+	env := []string{
+		"TUNNELLER_EVENT=" + string(e.Type),
+		"TUNNELLER_TIME=" + e.Time.Format(time.RFC3339),
+		"TUNNELLER_LOCAL_PORT=" + strconv.Itoa(e.LocalPort),
+		"TUNNELLER_BASTION=" + e.Bastion,
+		"TUNNELLER_REMOTE=" + e.Remote,
+		"TUNNELLER_CLIENT=" + e.Client,
+	}
+	if e.Err != nil {
+		env = append(env, "TUNNELLER_ERROR="+e.Err.Error())
+	} else {
+		env = append(env, "TUNNELLER_ERROR=")
+	}
+	return env
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandHook(t *testing.T) {
+	tests := []struct {
+		spec        string
+		wantEvents  []EventType
+		wantCommand string
+		wantErr     bool
+	}{
+		{spec: "tunnel-up=./up.sh", wantEvents: []EventType{EventTunnelUp}, wantCommand: "./up.sh"},
+		{spec: "tunnel-up, tunnel-down=notify-send tunnel",
+			wantEvents: []EventType{EventTunnelUp, EventTunnelDown}, wantCommand: "notify-send tunnel"},
+		{spec: "all=echo $TUNNELLER_EVENT", wantCommand: "echo $TUNNELLER_EVENT"},
+		{spec: "bastion-dropped=FOO=bar ./alert.sh", wantEvents: []EventType{EventBastionDropped},
+			wantCommand: "FOO=bar ./alert.sh"},
+		{spec: "tunnel-up", wantErr: true},
+		{spec: "tunnel-up=  ", wantErr: true},
+		{spec: "tunnel-sideways=./up.sh", wantErr: true},
+		{spec: "tunnel-up,=./up.sh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			hook, err := ParseCommandHook(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCommandHook() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(hook.Events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", hook.Events, tt.wantEvents)
+			}
+			if hook.Command != tt.wantCommand {
+				t.Errorf("command = %q, want %q", hook.Command, tt.wantCommand)
+			}
+		})
+	}
+}
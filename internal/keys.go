@@ -1,29 +1,135 @@
 package internal
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
 )
 
+// KeyType is the algorithm of a generated SSH key
+type KeyType string
+
+const (
+	KeyTypeED25519 KeyType = "ed25519"
+	KeyTypeECDSA   KeyType = "ecdsa"
+	KeyTypeRSA     KeyType = "rsa"
+)
+
+// DefaultKeyType is used when no key type is asked for
+const DefaultKeyType = KeyTypeED25519
+
+// InstanceConnectKeyTypes are the key types EC2 Instance Connect accepts
+var InstanceConnectKeyTypes = []KeyType{KeyTypeED25519, KeyTypeRSA}
+
+// ParseKeyType turns a name like "ed25519" into a KeyType
+func ParseKeyType(s string) (KeyType, error) {
+	switch KeyType(s) {
+	case KeyTypeED25519, KeyTypeECDSA, KeyTypeRSA:
+		return KeyType(s), nil
+	}
+	return "", fmt.Errorf("unknown key type %q, expected one of ed25519, ecdsa or rsa", s)
+}
+
+// KeyPair is a PEM encoded private key and its public key in authorized_keys format
+type KeyPair struct {
+	Type       KeyType
+	PrivateKey string
+	PublicKey  string
+}
+
+// PendingKeys is a key pair being generated in the background
+type PendingKeys struct {
+	done chan struct{}
+	keys KeyPair
+	err  error
+}
+
+// GenerateKeysAsync starts generating a key pair of the given type and
+// returns straight away. Call Wait to get the keys.
+func GenerateKeysAsync(keyType KeyType) *PendingKeys {
+	p := &PendingKeys{
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(p.done)
+		p.keys, p.err = GenerateKeysOfType(keyType)
+	}()
+	return p
+}
+
+// Wait blocks until the keys have been generated
+func (p *PendingKeys) Wait() (KeyPair, error) {
+	<-p.done
+	return p.keys, p.err
+}
+
+// GenerateKeys creates a 4096 bit RSA key pair, returning the PEM encoded
+// private key and the authorized_keys formatted public key
 func GenerateKeys() (string, string, error) {
-	bitSize := 4096
-	privateKey, err := generatePrivateKey(bitSize)
+	keys, err := GenerateKeysOfType(KeyTypeRSA)
 	if err != nil {
 		return "", "", err
 	}
+	return keys.PrivateKey, keys.PublicKey, nil
+}
 
-	publicKeyBytes, err := generatePublicKey(&privateKey.PublicKey)
-	if err != nil {
-		return "", "", err
+// GenerateKeysOfType creates a new key pair of the given type
+func GenerateKeysOfType(keyType KeyType) (KeyPair, error) {
+	var privateKeyBytes []byte
+	var publicKey interface{}
+	switch keyType {
+	case KeyTypeED25519:
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		// ssh can only parse ED25519 keys from the OpenSSH format
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		if err != nil {
+			return KeyPair{}, err
+		}
+		privateKeyBytes = pem.EncodeToMemory(block)
+		publicKey = pub
+	case KeyTypeECDSA:
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		privateKeyBytes, err = encodeECDSAPrivateKeyToPEM(priv)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		publicKey = &priv.PublicKey
+	case KeyTypeRSA:
+		bitSize := 4096
+		priv, err := generatePrivateKey(bitSize)
+		if err != nil {
+			return KeyPair{}, err
+		}
+		privateKeyBytes = encodePrivateKeyToPEM(priv)
+		publicKey = &priv.PublicKey
+	default:
+		return KeyPair{}, fmt.Errorf("unknown key type %q", keyType)
 	}
 
-	privateKeyBytes := encodePrivateKeyToPEM(privateKey)
-	return string(privateKeyBytes), string(publicKeyBytes), nil
+	publicKeyBytes, err := generatePublicKey(publicKey)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	log.Debugf("Generated %s key pair", keyType)
+	return KeyPair{
+		Type:       keyType,
+		PrivateKey: string(privateKeyBytes),
+		PublicKey:  string(publicKeyBytes),
+	}, nil
 }
 
 // generatePrivateKey creates a RSA Private Key of specified byte size
@@ -62,15 +168,27 @@ func encodePrivateKeyToPEM(privateKey *rsa.PrivateKey) []byte {
 	return privatePEM
 }
 
-// generatePublicKey take a rsa.PublicKey and return bytes suitable for writing to .pub file
-// returns in the format "ssh-rsa ..."
-func generatePublicKey(privatekey *rsa.PublicKey) ([]byte, error) {
-	publicRsaKey, err := ssh.NewPublicKey(privatekey)
+// encodeECDSAPrivateKeyToPEM encodes an ECDSA Private Key in SEC 1 PEM format
+func encodeECDSAPrivateKeyToPEM(privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	privDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: privDER,
+	}), nil
+}
+
+// generatePublicKey takes a public key and returns bytes suitable for writing
+// to a .pub file, in the format "ssh-ed25519 ..." or "ssh-rsa ..."
+func generatePublicKey(publicKey interface{}) ([]byte, error) {
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
 	if err != nil {
 		return nil, err
 	}
 
-	pubKeyBytes := ssh.MarshalAuthorizedKey(publicRsaKey)
+	pubKeyBytes := ssh.MarshalAuthorizedKey(sshPublicKey)
 
 	log.Debug("Public key generated")
 	return pubKeyBytes, nil
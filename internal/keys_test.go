@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeysOfType(t *testing.T) {
+	tests := []struct {
+		keyType KeyType
+		sshType string
+		wantErr bool
+	}{
+		{keyType: KeyTypeED25519, sshType: ssh.KeyAlgoED25519},
+		{keyType: KeyTypeECDSA, sshType: ssh.KeyAlgoECDSA256},
+		{keyType: KeyTypeRSA, sshType: ssh.KeyAlgoRSA},
+		{keyType: "dsa", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.keyType), func(t *testing.T) {
+			keys, err := GenerateKeysOfType(tt.keyType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got a %s key", keys.Type)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if keys.Type != tt.keyType {
+				t.Fatalf("got a %s key, want %s", keys.Type, tt.keyType)
+			}
+
+			signer, err := ssh.ParsePrivateKey([]byte(keys.PrivateKey))
+			if err != nil {
+				t.Fatalf("could not parse the private key: %v", err)
+			}
+			pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keys.PublicKey))
+			if err != nil {
+				t.Fatalf("could not parse the public key: %v", err)
+			}
+			if pub.Type() != tt.sshType {
+				t.Fatalf("public key is %s, want %s", pub.Type(), tt.sshType)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+				t.Fatalf("the private key doesn't match the public key")
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// instancePollInterval is how often StartInstance and WaitForSSH check on
+// the instance
+const instancePollInterval = 3 * time.Second
+
+// Progress is told what a long running operation is waiting for
+type Progress func(status string)
+
+// IsStopped reports whether the instance is stopped
+func IsStopped(instance *ec2.Instance) bool {
+	return instance.State != nil && aws.StringValue(instance.State.Name) == ec2.InstanceStateNameStopped
+}
+
+// StartInstance starts a stopped instance and waits for it to be running,
+// returning its refreshed description, which has its new public address
+func StartInstance(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string, progress Progress) (*ec2.Instance, error) {
+	_, err := ec2Client.StartInstancesWithContext(ctx, &ec2.StartInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return nil, NewTunnelError(ErrBastionStart, err)
+	}
+	return waitForRunning(ctx, ec2Client, instanceID, "Starting", ErrBastionStart, progress)
+}
+
+// waitForRunning polls the instance until it is running, reporting its
+// state as "<verb> <id>: <state>"
+func waitForRunning(ctx context.Context, ec2Client ec2iface.EC2API, instanceID, verb string, stage error,
+	progress Progress) (*ec2.Instance, error) {
+	started := time.Now()
+	for {
+		instance, err := describeInstance(ctx, ec2Client, instanceID)
+		if err != nil {
+			return nil, NewTunnelError(stage, err)
+		}
+		state := aws.StringValue(instance.State.Name)
+		switch state {
+		case ec2.InstanceStateNameRunning:
+			return instance, nil
+		case ec2.InstanceStateNamePending, ec2.InstanceStateNameStopped, ec2.InstanceStateNameStopping:
+			progress(fmt.Sprintf("%s %s: %s (%s)", verb, instanceID, state, time.Since(started).Round(time.Second)))
+		default:
+			return nil, NewTunnelError(stage, fmt.Errorf("instance %s is %s", instanceID, state))
+		}
+		select {
+		case <-ctx.Done():
+			return nil, NewTunnelError(stage, ctx.Err())
+		case <-time.After(instancePollInterval):
+		}
+	}
+}
+
+func describeInstance(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string) (*ec2.Instance, error) {
+	resp, err := ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceID)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Reservations) == 0 || len(resp.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("instance %s disappeared", instanceID)
+	}
+	return resp.Reservations[0].Instances[0], nil
+}
+
+// WaitForSSH waits until something answers on addr with an SSH banner.
+// Instances take a while to start sshd after they are running.
+func WaitForSSH(ctx context.Context, proxy *Proxy, addr string, progress Progress) error {
+	started := time.Now()
+	for {
+		err := probeSSH(ctx, proxy, addr)
+		if err == nil {
+			return nil
+		}
+		log.Debugf("Waiting for sshd on %s: %v", addr, err)
+		progress(fmt.Sprintf("Waiting for SSH on %s (%s)", addr, time.Since(started).Round(time.Second)))
+		select {
+		case <-ctx.Done():
+			return NewTunnelError(ErrBastionDial, errors.Wrapf(err, "waiting for SSH on %s", addr))
+		case <-time.After(instancePollInterval):
+		}
+	}
+}
+
+func probeSSH(ctx context.Context, proxy *Proxy, addr string) error {
+	ctx, cancel := context.WithTimeout(ctx, DefaultProbeTimeout)
+	defer cancel()
+	conn, err := proxy.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(DefaultProbeTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(banner))
+	}
+	return nil
+}
+
+// sessionID identifies this tunneller process in the tags it leaves on AWS
+// resources, as user@host:pid
+func sessionID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s:%d", currentUsername(), host, os.Getpid())
+}
+
+// leaseTagPrefix starts the tag each session puts on its bastion while it
+// uses it. The value is when the lease expires, as a Unix time, so leases
+// of sessions that died without releasing them run out.
+const leaseTagPrefix = "tunneller:lease:"
+
+// DefaultLeaseTTL is how long a lease lasts without being renewed
+const DefaultLeaseTTL = 15 * time.Minute
+
+// StopWhenIdleTagKey on a bastion asks whichever session releases the last
+// lease on it to stop it, not only the one that started it. The value is
+// the session that asked.
+const StopWhenIdleTagKey = "tunneller:stop-when-idle"
+
+// leaseSettle is how long Release waits before looking at the leases again
+// and stopping the instance. Tags are eventually consistent, so a lease a
+// colleague has just taken may not show up straight away.
+const leaseSettle = 2 * time.Second
+
+// SetStopWhenIdle tags the instance with StopWhenIdleTagKey if stop is set,
+// and removes the tag otherwise
+func SetStopWhenIdle(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string, stop bool) error {
+	var err error
+	if stop {
+		_, err = ec2Client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+			Resources: []*string{aws.String(instanceID)},
+			Tags:      []*ec2.Tag{{Key: aws.String(StopWhenIdleTagKey), Value: aws.String(sessionID())}},
+		})
+	} else {
+		_, err = ec2Client.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+			Resources: []*string{aws.String(instanceID)},
+			Tags:      []*ec2.Tag{{Key: aws.String(StopWhenIdleTagKey)}},
+		})
+	}
+	return err
+}
+
+// BastionLease marks a bastion as in use by this session, so other sessions
+// don't stop it from under us
+type BastionLease struct {
+	ec2Client  ec2iface.EC2API
+	instanceID string
+	key        string
+	ttl        time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// AcquireLease tags the instance with a lease for this session and keeps
+// renewing it until Release is called
+func AcquireLease(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string, ttl time.Duration) (*BastionLease, error) {
+	l := &BastionLease{
+		ec2Client:  ec2Client,
+		instanceID: instanceID,
+		key:        leaseTagPrefix + sessionID(),
+		ttl:        ttl,
+		stop:       make(chan struct{}),
+	}
+	if err := l.renew(ctx); err != nil {
+		return nil, err
+	}
+	go l.keepAlive()
+	return l, nil
+}
+
+func (l *BastionLease) renew(ctx context.Context) error {
+	expiry := time.Now().Add(l.ttl).Unix()
+	_, err := l.ec2Client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(l.instanceID)},
+		Tags:      []*ec2.Tag{{Key: aws.String(l.key), Value: aws.String(strconv.FormatInt(expiry, 10))}},
+	})
+	return err
+}
+
+func (l *BastionLease) keepAlive() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.renew(context.Background()); err != nil {
+				log.Warnf("Could not renew the lease on %s: %v", l.instanceID, err)
+			}
+		}
+	}
+}
+
+// Release removes this session's lease. If the instance is tagged with
+// StopWhenIdleTagKey, by this session or another, and no other session
+// holds an unexpired lease, the instance is stopped and the tag removed.
+// Returns whether it was stopped.
+func (l *BastionLease) Release(ctx context.Context) (bool, error) {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+	_, err := l.ec2Client.DeleteTagsWithContext(ctx, &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(l.instanceID)},
+		Tags:      []*ec2.Tag{{Key: aws.String(l.key)}},
+	})
+	if err != nil {
+		return false, err
+	}
+	others, askedBy, err := leaseTags(ctx, l.ec2Client, l.instanceID)
+	if err != nil || askedBy == "" {
+		return false, err
+	}
+	if len(others) > 0 {
+		log.Infof("Leaving %s running, it is still used by %s", l.instanceID, strings.Join(others, ", "))
+		return false, nil
+	}
+
+	// Look again right before stopping, in case a colleague has just
+	// started using it
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(leaseSettle):
+	}
+	if others, askedBy, err = leaseTags(ctx, l.ec2Client, l.instanceID); err != nil || askedBy == "" {
+		return false, err
+	}
+	if len(others) > 0 {
+		log.Infof("Leaving %s running, it is now used by %s", l.instanceID, strings.Join(others, ", "))
+		return false, nil
+	}
+	log.Debugf("Stopping %s, as %s asked", l.instanceID, askedBy)
+	_, err = l.ec2Client.StopInstancesWithContext(ctx, &ec2.StopInstancesInput{
+		InstanceIds: []*string{aws.String(l.instanceID)},
+	})
+	if err != nil {
+		return false, err
+	}
+	if err := SetStopWhenIdle(ctx, l.ec2Client, l.instanceID, false); err != nil {
+		log.Warnf("Could not remove the %s tag from %s: %v", StopWhenIdleTagKey, l.instanceID, err)
+	}
+	return true, nil
+}
+
+// ActiveLeases lists who holds unexpired leases on the instance
+func ActiveLeases(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string) ([]string, error) {
+	holders, _, err := leaseTags(ctx, ec2Client, instanceID)
+	return holders, err
+}
+
+// leaseTags reads who holds unexpired leases on the instance, and who
+// tagged it with StopWhenIdleTagKey, if anyone did
+func leaseTags(ctx context.Context, ec2Client ec2iface.EC2API, instanceID string) ([]string, string, error) {
+	resp, err := ec2Client.DescribeTagsWithContext(ctx, &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: []*string{aws.String(instanceID)}},
+			{Name: aws.String("key"), Values: []*string{aws.String(leaseTagPrefix + "*"), aws.String(StopWhenIdleTagKey)}},
+		},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	var holders []string
+	askedBy := ""
+	for _, t := range resp.Tags {
+		if aws.StringValue(t.Key) == StopWhenIdleTagKey {
+			askedBy = aws.StringValue(t.Value)
+			continue
+		}
+		expiry, err := strconv.ParseInt(aws.StringValue(t.Value), 10, 64)
+		if err != nil || time.Unix(expiry, 0).Before(time.Now()) {
+			continue
+		}
+		holders = append(holders, strings.TrimPrefix(aws.StringValue(t.Key), leaseTagPrefix))
+	}
+	return holders, askedBy, nil
+}
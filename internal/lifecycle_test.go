@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+)
+
+// tagsEC2API is a fake EC2 API holding the tags of one instance, which
+// counts the times it is stopped
+type tagsEC2API struct {
+	ec2iface.EC2API
+	mu    sync.Mutex
+	tags  map[string]string
+	stops int
+}
+
+func (a *tagsEC2API) CreateTagsWithContext(_ aws.Context, in *ec2.CreateTagsInput,
+	_ ...request.Option) (*ec2.CreateTagsOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, t := range in.Tags {
+		a.tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (a *tagsEC2API) DeleteTagsWithContext(_ aws.Context, in *ec2.DeleteTagsInput,
+	_ ...request.Option) (*ec2.DeleteTagsOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, t := range in.Tags {
+		delete(a.tags, aws.StringValue(t.Key))
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// DescribeTagsWithContext applies the key filter, with a trailing * as a
+// prefix match like EC2's
+func (a *tagsEC2API) DescribeTagsWithContext(_ aws.Context, in *ec2.DescribeTagsInput,
+	_ ...request.Option) (*ec2.DescribeTagsOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var keys []*string
+	for _, f := range in.Filters {
+		if aws.StringValue(f.Name) == "key" {
+			keys = f.Values
+		}
+	}
+	out := &ec2.DescribeTagsOutput{}
+	for k, v := range a.tags {
+		for _, pattern := range aws.StringValueSlice(keys) {
+			if k == pattern || strings.HasSuffix(pattern, "*") && strings.HasPrefix(k, strings.TrimSuffix(pattern, "*")) {
+				out.Tags = append(out.Tags, &ec2.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (a *tagsEC2API) StopInstancesWithContext(_ aws.Context, _ *ec2.StopInstancesInput,
+	_ ...request.Option) (*ec2.StopInstancesOutput, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stops++
+	return &ec2.StopInstancesOutput{}, nil
+}
+
+func TestBastionLeaseRelease(t *testing.T) {
+	live := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	tests := []struct {
+		name     string
+		tags     map[string]string
+		want     bool
+		wantTags map[string]string
+	}{
+		{name: "not asked to stop", tags: map[string]string{"Name": "bastion"},
+			wantTags: map[string]string{"Name": "bastion"}},
+		{name: "last session", tags: map[string]string{StopWhenIdleTagKey: "someone@laptop:1"},
+			want: true, wantTags: map[string]string{}},
+		{name: "still in use", tags: map[string]string{StopWhenIdleTagKey: "someone@laptop:1",
+			leaseTagPrefix + "colleague@desktop:2": live},
+			wantTags: map[string]string{StopWhenIdleTagKey: "someone@laptop:1",
+				leaseTagPrefix + "colleague@desktop:2": live}},
+		{name: "other lease expired", tags: map[string]string{StopWhenIdleTagKey: "someone@laptop:1",
+			leaseTagPrefix + "colleague@desktop:2": expired},
+			want: true, wantTags: map[string]string{leaseTagPrefix + "colleague@desktop:2": expired}},
+		{name: "other lease unreadable", tags: map[string]string{StopWhenIdleTagKey: "someone@laptop:1",
+			leaseTagPrefix + "colleague@desktop:2": "soon"},
+			want: true, wantTags: map[string]string{leaseTagPrefix + "colleague@desktop:2": "soon"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &tagsEC2API{tags: tt.tags}
+			lease, err := AcquireLease(context.Background(), api, "i-0123abcd", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			holders, err := ActiveLeases(context.Background(), api, "i-0123abcd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, h := range holders {
+				found = found || h == sessionID()
+			}
+			if !found {
+				t.Fatalf("ActiveLeases() = %v, want it to include %s", holders, sessionID())
+			}
+
+			stopped, err := lease.Release(context.Background())
+			if err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if stopped != tt.want {
+				t.Errorf("Release() = %v, want %v", stopped, tt.want)
+			}
+			if (api.stops > 0) != tt.want {
+				t.Errorf("stopped the instance %d times", api.stops)
+			}
+			if !reflect.DeepEqual(api.tags, tt.wantTags) {
+				t.Errorf("tags = %v, want %v", api.tags, tt.wantTags)
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package internal
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
 	"github.com/aws/aws-sdk-go/service/ec2instanceconnect/ec2instanceconnectiface"
@@ -11,11 +13,16 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	"github.com/pkg/errors"
@@ -25,11 +32,15 @@ type Profiles interface {
 	GetProfiles() []ProfileContainer
 	Refresh() error
 	GetProfile(profile string) ProfileContainer
+	// SetHTTPClient sets the HTTP client every profile's AWS sessions use,
+	// e.g. to go through a proxy
+	SetHTTPClient(client *http.Client)
 }
 
 type iniProfiles struct {
-	path     string
-	profiles map[string]ProfileContainer
+	path       string
+	profiles   map[string]ProfileContainer
+	httpClient *http.Client
 }
 
 func (i *iniProfiles) GetProfiles() []ProfileContainer {
@@ -43,7 +54,7 @@ func (i *iniProfiles) GetProfiles() []ProfileContainer {
 func (i *iniProfiles) Refresh() error {
 	cfg, err := ini.Load(i.path)
 	if err != nil {
-		return err
+		return NewTunnelError(ErrCredentialLoad, err)
 	}
 	i.profiles = make(map[string]ProfileContainer)
 
@@ -64,6 +75,7 @@ func (i *iniProfiles) Refresh() error {
 				secret:   sKey.Value(),
 			}
 			sp.setName(s.Name())
+			sp.httpClient = i.httpClient
 			i.profiles[s.Name()] = sp
 		} else if s.HasKey("role_arn") &&
 			s.HasKey("source_profile") {
@@ -72,6 +84,7 @@ func (i *iniProfiles) Refresh() error {
 				role: roleArn.Value(),
 			}
 			rp.setName(s.Name())
+			rp.httpClient = i.httpClient
 			i.profiles[s.Name()] = rp
 		} else {
 			//log.Printf("Could not determine the type of profile %s", s.Name())
@@ -83,7 +96,8 @@ func (i *iniProfiles) Refresh() error {
 			source, _ := cfg.Section(r.profileName).GetKey("source_profile")
 			v, exists := i.profiles[source.Value()]
 			if !exists {
-				return fmt.Errorf("Could not create profile %s, source profile %s not found", r.profileName, source.Value())
+				return NewTunnelError(ErrCredentialLoad,
+					fmt.Errorf("Could not create profile %s, source profile %s not found", r.profileName, source.Value()))
 			}
 			r.parent = v
 		}
@@ -96,6 +110,18 @@ func (i *iniProfiles) GetProfile(profile string) ProfileContainer {
 	return v
 }
 
+func (i *iniProfiles) SetHTTPClient(client *http.Client) {
+	i.httpClient = client
+	for _, p := range i.profiles {
+		switch v := p.(type) {
+		case *secretProfile:
+			v.httpClient = client
+		case *roleProfile:
+			v.httpClient = client
+		}
+	}
+}
+
 func NewIniConfig(path string) Profiles {
 	i := &iniProfiles{
 		path:     path,
@@ -112,11 +138,19 @@ type ProfileContainer interface {
 	GetRDSService() (rdsiface.RDSAPI, error)
 	GetSTSService() (stsiface.STSAPI, error)
 	GetEC2InstanceConnectService() (ec2instanceconnectiface.EC2InstanceConnectAPI, error)
+	GetSSMService() (ssmiface.SSMAPI, error)
+	// GetSecretsManagerService returns a Secrets Manager client, using
+	// endpoint instead of the region's if it is set, e.g. for LocalStack
+	GetSecretsManagerService(endpoint string) (secretsmanageriface.SecretsManagerAPI, error)
+	// GetCredentials returns the credentials of the connected session, e.g.
+	// to sign IAM database auth tokens with
+	GetCredentials() (*credentials.Credentials, error)
 }
 
 type baseProfile struct {
 	profileName string
 	session     *session.Session
+	httpClient  *http.Client
 }
 
 func (b *baseProfile) setName(n string) {
@@ -155,6 +189,31 @@ func (b *baseProfile) GetEC2InstanceConnectService() (ec2instanceconnectiface.EC
 	return ec2instanceconnect.New(b.session), nil
 }
 
+func (b *baseProfile) GetSSMService() (ssmiface.SSMAPI, error) {
+	if b.session == nil {
+		return nil, fmt.Errorf("Session not connected, cannot create SSM service")
+	}
+	return ssm.New(b.session), nil
+}
+
+func (b *baseProfile) GetSecretsManagerService(endpoint string) (secretsmanageriface.SecretsManagerAPI, error) {
+	if b.session == nil {
+		return nil, fmt.Errorf("Session not connected, cannot create Secrets Manager service")
+	}
+	conf := aws.NewConfig()
+	if endpoint != "" {
+		conf.Endpoint = aws.String(endpoint)
+	}
+	return secretsmanager.New(b.session, conf), nil
+}
+
+func (b *baseProfile) GetCredentials() (*credentials.Credentials, error) {
+	if b.session == nil {
+		return nil, fmt.Errorf("Session not connected, cannot get credentials")
+	}
+	return b.session.Config.Credentials, nil
+}
+
 type secretProfile struct {
 	baseProfile
 	accessId string
@@ -172,10 +231,14 @@ func (s *secretProfile) Connect(region string) error {
 		conf := aws.NewConfig()
 		conf.Region = aws.String(region)
 		conf.Credentials = creds
+		if s.httpClient != nil {
+			conf.HTTPClient = s.httpClient
+		}
 		var err error
 		s.session, err = session.NewSession(conf)
 		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("Failure to create session for profile %s", s.profileName))
+			return NewTunnelError(ErrCredentialLoad,
+				errors.Wrap(err, fmt.Sprintf("Failure to create session for profile %s", s.profileName)))
 		}
 	}
 	return nil
@@ -200,23 +263,28 @@ func (r *roleProfile) Connect(region string) error {
 	if err != nil {
 		return errors.Wrap(err, "Could not get STS service from base profile")
 	}
+	// The provider assumes the role again before the credentials expire, so
+	// long sessions keep working, e.g. signing IAM database auth tokens
 	sessionName := fmt.Sprintf("dogenet-wow-%d", rand.Int())
-	assumedRole, err := tok.AssumeRole(&sts.AssumeRoleInput{
-		RoleArn:         aws.String(r.role),
-		RoleSessionName: aws.String(sessionName),
-	})
-	if err != nil {
-		return err
-	}
-	r.session, err = session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(
-			*assumedRole.Credentials.AccessKeyId,
-			*assumedRole.Credentials.SecretAccessKey,
-			*assumedRole.Credentials.SessionToken),
-		Region: aws.String(region),
+	creds := stscreds.NewCredentialsWithClient(tok, r.role, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		// An IAM auth token lasts 15 minutes, so has to be signed with
+		// credentials that last at least as long
+		p.ExpiryWindow = 15 * time.Minute
 	})
+	if _, err := creds.Get(); err != nil {
+		return NewTunnelError(ErrRoleAssumption, errors.Wrapf(err, "assuming %s", r.role))
+	}
+	conf := &aws.Config{
+		Credentials: creds,
+		Region:      aws.String(region),
+	}
+	if r.httpClient != nil {
+		conf.HTTPClient = r.httpClient
+	}
+	r.session, err = session.NewSession(conf)
 	if err != nil {
-		return errors.Wrap(err, "Error creating session")
+		return NewTunnelError(ErrCredentialLoad, errors.Wrap(err, "Error creating session"))
 	}
 	return nil
 }
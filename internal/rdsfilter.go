@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+)
+
+// DatabaseFilter narrows down the database list. Every term has to match a
+// cluster or standalone instance for it to be kept.
+type DatabaseFilter struct {
+	terms []databaseTerm
+}
+
+type databaseTerm struct {
+	// field is engine, status, tag or name
+	field   string
+	key     string
+	pattern string
+}
+
+// ParseDatabaseFilter parses a comma separated list of terms: engine=pattern,
+// status=pattern, tag:key=pattern, or a pattern for the identifier of the
+// cluster or instance or any of its endpoints. Patterns can use the * and ?
+// wildcards. An empty spec matches everything.
+func ParseDatabaseFilter(spec string) (*DatabaseFilter, error) {
+	f := &DatabaseFilter{}
+	for _, term := range strings.Split(spec, ",") {
+		term = strings.TrimSpace(term)
+		var t databaseTerm
+		switch {
+		case term == "":
+			continue
+		case strings.HasPrefix(term, "tag:"):
+			kv := strings.TrimPrefix(term, "tag:")
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("%q should be tag:key=value", term)
+			}
+			t = databaseTerm{field: "tag", key: kv[:i], pattern: kv[i+1:]}
+		case strings.HasPrefix(term, "engine="):
+			t = databaseTerm{field: "engine", pattern: strings.TrimPrefix(term, "engine=")}
+		case strings.HasPrefix(term, "status="):
+			t = databaseTerm{field: "status", pattern: strings.TrimPrefix(term, "status=")}
+		default:
+			t = databaseTerm{field: "name", pattern: strings.TrimPrefix(term, "name:")}
+		}
+		if _, err := path.Match(t.pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %v", term, err)
+		}
+		f.terms = append(f.terms, t)
+	}
+	return f, nil
+}
+
+// Empty reports whether the filter matches everything
+func (f *DatabaseFilter) Empty() bool {
+	return f == nil || len(f.terms) == 0
+}
+
+// Apply returns the groups matching every term. Tags are only fetched for
+// groups that match every other term, and are kept on the groups.
+func (f *DatabaseFilter) Apply(ctx context.Context, rdsClient rdsiface.RDSAPI, groups []DatabaseGroup) ([]DatabaseGroup, error) {
+	if f.Empty() {
+		return groups, nil
+	}
+	var matched []DatabaseGroup
+	for i := range groups {
+		ok, err := f.matches(ctx, rdsClient, &groups[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, groups[i])
+		}
+	}
+	return matched, nil
+}
+
+func (f *DatabaseFilter) matches(ctx context.Context, rdsClient rdsiface.RDSAPI, g *DatabaseGroup) (bool, error) {
+	// The first target is the cluster's writer, or the standalone instance,
+	// and has the engine and status of the whole group
+	first := g.Targets[0]
+	var tagTerms []databaseTerm
+	for _, t := range f.terms {
+		switch t.field {
+		case "engine":
+			if !matchPattern(t.pattern, first.Engine) {
+				return false, nil
+			}
+		case "status":
+			if !matchPattern(t.pattern, first.Status) {
+				return false, nil
+			}
+		case "name":
+			found := matchPattern(t.pattern, g.Name())
+			for _, target := range g.Targets {
+				found = found || matchPattern(t.pattern, target.Name)
+			}
+			if !found {
+				return false, nil
+			}
+		case "tag":
+			tagTerms = append(tagTerms, t)
+		}
+	}
+	if len(tagTerms) == 0 {
+		return true, nil
+	}
+	if err := g.LoadTags(ctx, rdsClient); err != nil {
+		return false, err
+	}
+	for _, t := range tagTerms {
+		value, ok := g.Tags[t.key]
+		if !ok || !matchPattern(t.pattern, value) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchPattern matches a shell style pattern, ignoring case
+func matchPattern(pattern, s string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(s))
+	return ok
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+)
+
+// tagsAPI is a fake RDS API that only lists tags, and counts the calls
+type tagsAPI struct {
+	rdsiface.RDSAPI
+	tags  map[string]map[string]string
+	calls int
+}
+
+func (a *tagsAPI) ListTagsForResourceWithContext(_ aws.Context, in *rds.ListTagsForResourceInput,
+	_ ...request.Option) (*rds.ListTagsForResourceOutput, error) {
+	a.calls++
+	out := &rds.ListTagsForResourceOutput{}
+	for k, v := range a.tags[aws.StringValue(in.ResourceName)] {
+		out.TagList = append(out.TagList, &rds.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return out, nil
+}
+
+func filterGroups() []DatabaseGroup {
+	cluster := &rds.DBCluster{DBClusterIdentifier: aws.String("orders"), DBClusterArn: aws.String("arn:orders")}
+	member := &rds.DBInstance{DBInstanceArn: aws.String("arn:orders-1")}
+	return []DatabaseGroup{
+		{Cluster: cluster, Targets: []DatabaseTarget{
+			{Kind: TargetWriter, Name: "orders", Engine: "aurora-postgresql", Status: "available",
+				Cluster: cluster, Instance: member},
+			{Kind: TargetReader, Name: "orders", Engine: "aurora-postgresql", Status: "available",
+				Cluster: cluster, Instance: member},
+			{Kind: TargetCustom, Name: "orders-analytics", Engine: "aurora-postgresql", Status: "available",
+				Cluster: cluster, Instance: member},
+		}},
+		{Targets: []DatabaseTarget{
+			{Kind: TargetInstance, Name: "legacy-db", Engine: "mysql", Status: "stopped",
+				Instance: &rds.DBInstance{DBInstanceArn: aws.String("arn:legacy-db")}},
+		}},
+	}
+}
+
+func TestParseDatabaseFilter(t *testing.T) {
+	tests := []struct {
+		spec      string
+		wantTerms []databaseTerm
+		wantErr   bool
+	}{
+		{spec: ""},
+		{spec: " , "},
+		{spec: "orders*", wantTerms: []databaseTerm{{field: "name", pattern: "orders*"}}},
+		{spec: "name:engine=x", wantTerms: []databaseTerm{{field: "name", pattern: "engine=x"}}},
+		{spec: "engine=aurora*, status=available", wantTerms: []databaseTerm{
+			{field: "engine", pattern: "aurora*"}, {field: "status", pattern: "available"}}},
+		{spec: "tag:team=pay=ments", wantTerms: []databaseTerm{{field: "tag", key: "team", pattern: "pay=ments"}}},
+		{spec: "tag:team=", wantTerms: []databaseTerm{{field: "tag", key: "team", pattern: ""}}},
+		{spec: "tag:=payments", wantErr: true},
+		{spec: "tag:team", wantErr: true},
+		{spec: "orders[", wantErr: true},
+		{spec: "engine=[a-", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			f, err := ParseDatabaseFilter(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDatabaseFilter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(f.terms, tt.wantTerms) {
+				t.Fatalf("terms = %+v, want %+v", f.terms, tt.wantTerms)
+			}
+			if f.Empty() != (len(tt.wantTerms) == 0) {
+				t.Fatalf("Empty() = %v with %d terms", f.Empty(), len(tt.wantTerms))
+			}
+		})
+	}
+}
+
+func TestDatabaseFilterApply(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []string
+		// wantCalls is how many groups had their tags fetched
+		wantCalls int
+	}{
+		{spec: "", want: []string{"orders", "legacy-db"}},
+		{spec: "orders", want: []string{"orders"}},
+		{spec: "*analytics", want: []string{"orders"}},
+		{spec: "LEGACY-*", want: []string{"legacy-db"}},
+		{spec: "engine=aurora*", want: []string{"orders"}},
+		{spec: "status=stopped", want: []string{"legacy-db"}},
+		{spec: "engine=mysql,status=available"},
+		{spec: "tag:team=pay*", want: []string{"orders"}, wantCalls: 2},
+		{spec: "tag:owner=*", want: []string{"legacy-db"}, wantCalls: 2},
+		{spec: "engine=mysql,tag:team=ops", want: []string{"legacy-db"}, wantCalls: 1},
+		{spec: "nothing*,tag:team=ops"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			f, err := ParseDatabaseFilter(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			api := &tagsAPI{tags: map[string]map[string]string{
+				"arn:orders":    {"team": "payments"},
+				"arn:legacy-db": {"team": "ops", "owner": ""},
+			}}
+			groups, err := f.Apply(context.Background(), api, filterGroups())
+			if err != nil {
+				t.Fatalf("Apply() error = %v", err)
+			}
+			var got []string
+			for _, g := range groups {
+				got = append(got, g.Name())
+				if tt.wantCalls > 0 && g.Tags == nil {
+					t.Errorf("%s kept without its tags", g.Name())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+			if api.calls != tt.wantCalls {
+				t.Errorf("fetched tags %d times, want %d", api.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/pkg/errors"
+)
+
+// databasePollInterval is how often StartDatabase and RestoreDatabase check
+// on the database. RDS takes minutes to start or restore one, so there's no
+// point asking more often.
+const databasePollInterval = 15 * time.Second
+
+// statusAvailable and statusStopped are the DB instance and cluster
+// statuses that matter here. The SDK doesn't define them.
+const (
+	statusAvailable = "available"
+	statusStopped   = "stopped"
+)
+
+// IsStopped reports whether the target's instance or cluster is stopped
+func (t DatabaseTarget) IsStopped() bool {
+	return t.Status == statusStopped
+}
+
+// startsCluster reports whether starting the target means starting its
+// cluster. Aurora instances can't be started on their own.
+func (t DatabaseTarget) startsCluster() bool {
+	return t.Cluster != nil
+}
+
+// StartDatabase starts a stopped DB instance, or the cluster of a cluster
+// endpoint or Aurora instance, and waits for it to be available. It
+// returns the target with its status and address refreshed.
+func StartDatabase(ctx context.Context, rdsClient rdsiface.RDSAPI, target DatabaseTarget, progress Progress) (DatabaseTarget, error) {
+	var err error
+	if target.startsCluster() {
+		_, err = rdsClient.StartDBClusterWithContext(ctx, &rds.StartDBClusterInput{
+			DBClusterIdentifier: target.Cluster.DBClusterIdentifier,
+		})
+	} else {
+		_, err = rdsClient.StartDBInstanceWithContext(ctx, &rds.StartDBInstanceInput{
+			DBInstanceIdentifier: aws.String(target.Name),
+		})
+	}
+	if err != nil {
+		return target, NewTunnelError(ErrDatabaseStart, err)
+	}
+
+	return waitForDatabase(ctx, rdsClient, target, "Starting", ErrDatabaseStart, progress)
+}
+
+// waitForDatabase polls the target until it is available, reporting its
+// status as "<verb> <name>: <status>"
+func waitForDatabase(ctx context.Context, rdsClient rdsiface.RDSAPI, target DatabaseTarget, verb string, stage error,
+	progress Progress) (DatabaseTarget, error) {
+	started := time.Now()
+	for {
+		refreshed, ready, err := refreshTarget(ctx, rdsClient, target)
+		if err != nil {
+			return target, NewTunnelError(stage, err)
+		}
+		if ready {
+			return refreshed, nil
+		}
+		progress(fmt.Sprintf("%s %s: %s (%s)", verb, target.Name, refreshed.Status, time.Since(started).Round(time.Second)))
+		select {
+		case <-ctx.Done():
+			return target, NewTunnelError(stage, ctx.Err())
+		case <-time.After(databasePollInterval):
+		}
+	}
+}
+
+// refreshTarget describes the target's instance or cluster again, and
+// reports whether it, and for clusters every instance in it, is available
+func refreshTarget(ctx context.Context, rdsClient rdsiface.RDSAPI, target DatabaseTarget) (DatabaseTarget, bool, error) {
+	if !target.startsCluster() {
+		db, err := describeDBInstance(ctx, rdsClient, target.Name)
+		if err != nil {
+			return target, false, err
+		}
+		refreshed := instanceTarget(db, nil)
+		return refreshed, refreshed.Status == statusAvailable, nil
+	}
+
+	resp, err := rdsClient.DescribeDBClustersWithContext(ctx, &rds.DescribeDBClustersInput{
+		DBClusterIdentifier: target.Cluster.DBClusterIdentifier,
+	})
+	if err != nil {
+		return target, false, err
+	}
+	if len(resp.DBClusters) == 0 {
+		return target, false, fmt.Errorf("cluster %s disappeared", aws.StringValue(target.Cluster.DBClusterIdentifier))
+	}
+	cluster := resp.DBClusters[0]
+	refreshed := target
+	refreshed.Cluster = cluster
+	refreshed.Status = aws.StringValue(cluster.Status)
+	ready := refreshed.Status == statusAvailable
+	// The cluster is available before its instances are, and its
+	// endpoints don't answer until they are
+	for _, m := range cluster.DBClusterMembers {
+		db, err := describeDBInstance(ctx, rdsClient, aws.StringValue(m.DBInstanceIdentifier))
+		if err != nil {
+			return target, false, err
+		}
+		if aws.StringValue(db.DBInstanceStatus) != statusAvailable {
+			ready = false
+		}
+		if target.Kind == TargetInstance && aws.StringValue(db.DBInstanceIdentifier) == target.Name {
+			refreshed = instanceTarget(db, cluster)
+		}
+	}
+	return refreshed, ready, nil
+}
+
+func describeDBInstance(ctx context.Context, rdsClient rdsiface.RDSAPI, id string) (*rds.DBInstance, error) {
+	resp, err := rdsClient.DescribeDBInstancesWithContext(ctx, &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(id),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.DBInstances) == 0 {
+		return nil, fmt.Errorf("instance %s disappeared", id)
+	}
+	return resp.DBInstances[0], nil
+}
+
+// StopDatabase stops what StartDatabase started. It doesn't wait for it to
+// stop.
+func StopDatabase(ctx context.Context, rdsClient rdsiface.RDSAPI, target DatabaseTarget) error {
+	var err error
+	if target.startsCluster() {
+		_, err = rdsClient.StopDBClusterWithContext(ctx, &rds.StopDBClusterInput{
+			DBClusterIdentifier: target.Cluster.DBClusterIdentifier,
+		})
+	} else {
+		_, err = rdsClient.StopDBInstanceWithContext(ctx, &rds.StopDBInstanceInput{
+			DBInstanceIdentifier: aws.String(target.Name),
+		})
+	}
+	return errors.Wrapf(err, "stopping %s", target.Name)
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+)
+
+// describeRDSAPI is a fake RDS API that describes instances and clusters by
+// identifier
+type describeRDSAPI struct {
+	rdsiface.RDSAPI
+	instances map[string]*rds.DBInstance
+	clusters  map[string]*rds.DBCluster
+}
+
+func (a *describeRDSAPI) DescribeDBInstancesWithContext(_ aws.Context, in *rds.DescribeDBInstancesInput,
+	_ ...request.Option) (*rds.DescribeDBInstancesOutput, error) {
+	out := &rds.DescribeDBInstancesOutput{}
+	if db, ok := a.instances[aws.StringValue(in.DBInstanceIdentifier)]; ok {
+		out.DBInstances = []*rds.DBInstance{db}
+	}
+	return out, nil
+}
+
+func (a *describeRDSAPI) DescribeDBClustersWithContext(_ aws.Context, in *rds.DescribeDBClustersInput,
+	_ ...request.Option) (*rds.DescribeDBClustersOutput, error) {
+	out := &rds.DescribeDBClustersOutput{}
+	if c, ok := a.clusters[aws.StringValue(in.DBClusterIdentifier)]; ok {
+		out.DBClusters = []*rds.DBCluster{c}
+	}
+	return out, nil
+}
+
+func TestRefreshTarget(t *testing.T) {
+	instance := func(id, status string) *rds.DBInstance {
+		db := clusterInstance(id)
+		db.DBInstanceStatus = aws.String(status)
+		return db
+	}
+	cluster := func(status string, members ...string) *rds.DBCluster {
+		c := &rds.DBCluster{DBClusterIdentifier: aws.String("orders"), Status: aws.String(status)}
+		for _, m := range members {
+			c.DBClusterMembers = append(c.DBClusterMembers, &rds.DBClusterMember{DBInstanceIdentifier: aws.String(m)})
+		}
+		return c
+	}
+	clusterTarget := func(kind TargetKind, name string) DatabaseTarget {
+		return DatabaseTarget{Kind: kind, Name: name, Status: statusStopped,
+			Cluster: &rds.DBCluster{DBClusterIdentifier: aws.String("orders")}}
+	}
+
+	tests := []struct {
+		name       string
+		target     DatabaseTarget
+		instances  map[string]*rds.DBInstance
+		cluster    *rds.DBCluster
+		wantReady  bool
+		wantStatus string
+		wantAddr   string
+		wantErr    bool
+	}{
+		{name: "instance starting", target: DatabaseTarget{Kind: TargetInstance, Name: "legacy"},
+			instances:  map[string]*rds.DBInstance{"legacy": instance("legacy", "starting")},
+			wantStatus: "starting", wantAddr: "legacy.rds.example.com"},
+		{name: "instance available", target: DatabaseTarget{Kind: TargetInstance, Name: "legacy"},
+			instances: map[string]*rds.DBInstance{"legacy": instance("legacy", statusAvailable)},
+			wantReady: true, wantStatus: statusAvailable, wantAddr: "legacy.rds.example.com"},
+		{name: "instance gone", target: DatabaseTarget{Kind: TargetInstance, Name: "legacy"}, wantErr: true},
+		{name: "cluster available before its instances", target: clusterTarget(TargetWriter, "orders"),
+			cluster: cluster(statusAvailable, "orders-1", "orders-2"),
+			instances: map[string]*rds.DBInstance{
+				"orders-1": instance("orders-1", statusAvailable),
+				"orders-2": instance("orders-2", "starting"),
+			},
+			wantStatus: statusAvailable},
+		{name: "cluster and instances available", target: clusterTarget(TargetReader, "orders"),
+			cluster: cluster(statusAvailable, "orders-1"),
+			instances: map[string]*rds.DBInstance{
+				"orders-1": instance("orders-1", statusAvailable),
+			},
+			wantReady: true, wantStatus: statusAvailable},
+		{name: "Aurora instance", target: clusterTarget(TargetInstance, "orders-2"),
+			cluster: cluster("starting", "orders-1", "orders-2"),
+			instances: map[string]*rds.DBInstance{
+				"orders-1": instance("orders-1", "starting"),
+				"orders-2": instance("orders-2", "configuring-enhanced-monitoring"),
+			},
+			wantStatus: "configuring-enhanced-monitoring", wantAddr: "orders-2.rds.example.com"},
+		{name: "cluster gone", target: clusterTarget(TargetWriter, "orders"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &describeRDSAPI{instances: tt.instances, clusters: map[string]*rds.DBCluster{}}
+			if tt.cluster != nil {
+				api.clusters["orders"] = tt.cluster
+			}
+			got, ready, err := refreshTarget(context.Background(), api, tt.target)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("refreshTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ready != tt.wantReady {
+				t.Errorf("ready = %v, want %v", ready, tt.wantReady)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("status = %q, want %q", got.Status, tt.wantStatus)
+			}
+			if got.Address != tt.wantAddr {
+				t.Errorf("address = %q, want %q", got.Address, tt.wantAddr)
+			}
+			if tt.cluster != nil && got.Cluster != tt.cluster {
+				t.Errorf("cluster wasn't refreshed")
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// restorePrefix starts the identifier of every temporary restore, so
+// cleanup only has to look at the tags of those instances
+const restorePrefix = "tunneller-"
+
+// RestoredFromTagKey records which instance a temporary restore is a copy of
+const RestoredFromTagKey = "tunneller:restored-from"
+
+// expiresTagKey holds when a temporary restore may be deleted by cleanup,
+// as a Unix time. The session using it keeps pushing it back.
+const expiresTagKey = "tunneller:expires"
+
+// RestorePoint is what to restore a temporary copy of a database from
+type RestorePoint struct {
+	// SnapshotID is the snapshot to restore. If it is empty the instance
+	// is restored to Time.
+	SnapshotID string
+	// Time is the point in time to restore to. The zero time means the
+	// latest restorable time.
+	Time time.Time
+}
+
+func (p RestorePoint) String() string {
+	switch {
+	case p.SnapshotID != "":
+		return "snapshot " + p.SnapshotID
+	case p.Time.IsZero():
+		return "the latest restorable time"
+	}
+	return p.Time.Format(time.RFC3339)
+}
+
+// ParseRestorePoint parses latest, an RFC 3339 time such as
+// 2020-05-01T09:30:00Z, or anything else as a snapshot identifier
+func ParseRestorePoint(s string) (RestorePoint, error) {
+	switch {
+	case s == "":
+		return RestorePoint{}, fmt.Errorf("no snapshot or time given")
+	case s == "latest":
+		return RestorePoint{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return RestorePoint{Time: t}, nil
+	}
+	if s[0] >= '0' && s[0] <= '9' {
+		return RestorePoint{}, fmt.Errorf("%q is neither a snapshot identifier nor an RFC 3339 time", s)
+	}
+	return RestorePoint{SnapshotID: s}, nil
+}
+
+// ListSnapshots lists the available snapshots of an instance, automated and
+// manual, newest first
+func ListSnapshots(ctx context.Context, rdsClient rdsiface.RDSAPI, instanceID string) ([]*rds.DBSnapshot, error) {
+	var snapshots []*rds.DBSnapshot
+	err := rdsClient.DescribeDBSnapshotsPagesWithContext(ctx, &rds.DescribeDBSnapshotsInput{
+		DBInstanceIdentifier: aws.String(instanceID),
+	}, func(page *rds.DescribeDBSnapshotsOutput, lastPage bool) bool {
+		for _, s := range page.DBSnapshots {
+			if aws.StringValue(s.Status) == statusAvailable {
+				snapshots = append(snapshots, s)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return aws.TimeValue(snapshots[i].SnapshotCreateTime).After(aws.TimeValue(snapshots[j].SnapshotCreateTime))
+	})
+	return snapshots, nil
+}
+
+// RestoredDatabase is a temporary copy of an instance, deleted when the
+// session ends
+type RestoredDatabase struct {
+	Target DatabaseTarget
+
+	rdsClient rdsiface.RDSAPI
+	arn       *string
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// RestoreDatabase restores a copy of a standalone instance from a snapshot
+// or to a point in time, into the same subnet group and security groups,
+// with the same parameter group, option group, port and IAM auth setting,
+// and waits for it to be available. The copy is tagged so tunneller
+// cleanup can delete it if the session dies, and is deleted again if
+// restoring fails or ctx is cancelled.
+func RestoreDatabase(ctx context.Context, rdsClient rdsiface.RDSAPI, source DatabaseTarget, point RestorePoint,
+	progress Progress) (*RestoredDatabase, error) {
+	src := source.Instance
+	if source.Kind != TargetInstance || source.Cluster != nil || src == nil {
+		return nil, NewTunnelError(ErrDatabaseRestore, fmt.Errorf("only standalone instances can be restored"))
+	}
+	id := restoredIdentifier(source.Name, time.Now())
+	tags := []*rds.Tag{
+		{Key: aws.String(EphemeralTagKey), Value: aws.String(sessionID())},
+		{Key: aws.String(RestoredFromTagKey), Value: aws.String(source.Name)},
+		{Key: aws.String(expiresTagKey), Value: aws.String(expiry())},
+	}
+	var groupIDs []*string
+	for _, g := range src.VpcSecurityGroups {
+		groupIDs = append(groupIDs, g.VpcSecurityGroupId)
+	}
+	var subnetGroup *string
+	if src.DBSubnetGroup != nil {
+		subnetGroup = src.DBSubnetGroup.DBSubnetGroupName
+	}
+	// Left unset, RDS restores with the engine's default groups, which
+	// may not have the settings or options the database relies on
+	var parameterGroup, optionGroup *string
+	if len(src.DBParameterGroups) > 0 {
+		parameterGroup = src.DBParameterGroups[0].DBParameterGroupName
+	}
+	if len(src.OptionGroupMemberships) > 0 {
+		optionGroup = src.OptionGroupMemberships[0].OptionGroupName
+	}
+	var port *int64
+	if src.Endpoint != nil {
+		port = src.Endpoint.Port
+	}
+
+	progress(fmt.Sprintf("Restoring %s from %s as %s", source.Name, point, id))
+	var created *rds.DBInstance
+	if point.SnapshotID != "" {
+		resp, err := rdsClient.RestoreDBInstanceFromDBSnapshotWithContext(ctx, &rds.RestoreDBInstanceFromDBSnapshotInput{
+			DBInstanceIdentifier:            aws.String(id),
+			DBSnapshotIdentifier:            aws.String(point.SnapshotID),
+			DBInstanceClass:                 src.DBInstanceClass,
+			DBSubnetGroupName:               subnetGroup,
+			VpcSecurityGroupIds:             groupIDs,
+			PubliclyAccessible:              src.PubliclyAccessible,
+			DBParameterGroupName:            parameterGroup,
+			OptionGroupName:                 optionGroup,
+			Port:                            port,
+			CopyTagsToSnapshot:              src.CopyTagsToSnapshot,
+			MultiAZ:                         aws.Bool(false),
+			DeletionProtection:              aws.Bool(false),
+			Tags:                            tags,
+			EnableIAMDatabaseAuthentication: src.IAMDatabaseAuthenticationEnabled,
+		})
+		if err != nil {
+			return nil, NewTunnelError(ErrDatabaseRestore, err)
+		}
+		created = resp.DBInstance
+	} else {
+		input := &rds.RestoreDBInstanceToPointInTimeInput{
+			SourceDBInstanceIdentifier:      aws.String(source.Name),
+			TargetDBInstanceIdentifier:      aws.String(id),
+			DBInstanceClass:                 src.DBInstanceClass,
+			DBSubnetGroupName:               subnetGroup,
+			VpcSecurityGroupIds:             groupIDs,
+			PubliclyAccessible:              src.PubliclyAccessible,
+			DBParameterGroupName:            parameterGroup,
+			OptionGroupName:                 optionGroup,
+			Port:                            port,
+			CopyTagsToSnapshot:              src.CopyTagsToSnapshot,
+			MultiAZ:                         aws.Bool(false),
+			DeletionProtection:              aws.Bool(false),
+			Tags:                            tags,
+			EnableIAMDatabaseAuthentication: src.IAMDatabaseAuthenticationEnabled,
+		}
+		if point.Time.IsZero() {
+			input.UseLatestRestorableTime = aws.Bool(true)
+		} else {
+			input.RestoreTime = aws.Time(point.Time)
+		}
+		resp, err := rdsClient.RestoreDBInstanceToPointInTimeWithContext(ctx, input)
+		if err != nil {
+			return nil, NewTunnelError(ErrDatabaseRestore, err)
+		}
+		created = resp.DBInstance
+	}
+
+	r := &RestoredDatabase{
+		Target:    DatabaseTarget{Kind: TargetInstance, Name: id, Instance: created},
+		rdsClient: rdsClient,
+		arn:       created.DBInstanceArn,
+		stop:      make(chan struct{}),
+	}
+	go r.keepAlive()
+	target, err := waitForDatabase(ctx, rdsClient, r.Target, "Restoring", ErrDatabaseRestore, progress)
+	if err != nil {
+		if delErr := r.Delete(context.Background()); delErr != nil {
+			// RDS won't delete an instance that is still being created
+			log.Warnf("Could not delete %s, run tunneller cleanup once it has finished restoring: %v", id, delErr)
+		}
+		return nil, err
+	}
+	r.Target = target
+	return r, nil
+}
+
+// restoredIdentifier makes a valid, unique instance identifier for a
+// restore of source: letters, digits and single hyphens, at most 63 long
+func restoredIdentifier(source string, now time.Time) string {
+	suffix := "-" + strconv.FormatInt(now.Unix(), 36)
+	name := strings.Trim(identifierInvalid.ReplaceAllString(strings.ToLower(source), "-"), "-")
+	if max := 63 - len(restorePrefix) - len(suffix); len(name) > max {
+		name = strings.TrimRight(name[:max], "-")
+	}
+	return restorePrefix + name + suffix
+}
+
+var identifierInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+func expiry() string {
+	return strconv.FormatInt(time.Now().Add(DefaultLeaseTTL).Unix(), 10)
+}
+
+// keepAlive pushes the expiry tag back until Delete is called
+func (r *RestoredDatabase) keepAlive() {
+	ticker := time.NewTicker(DefaultLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			_, err := r.rdsClient.AddTagsToResourceWithContext(context.Background(), &rds.AddTagsToResourceInput{
+				ResourceName: r.arn,
+				Tags:         []*rds.Tag{{Key: aws.String(expiresTagKey), Value: aws.String(expiry())}},
+			})
+			if err != nil {
+				log.Warnf("Could not renew the expiry of %s: %v", r.Target.Name, err)
+			}
+		}
+	}
+}
+
+// Delete deletes the restored instance without a final snapshot. It doesn't
+// wait for it to go.
+func (r *RestoredDatabase) Delete(ctx context.Context) error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	return deleteRestore(ctx, r.rdsClient, r.Target.Name)
+}
+
+func deleteRestore(ctx context.Context, rdsClient rdsiface.RDSAPI, id string) error {
+	_, err := rdsClient.DeleteDBInstanceWithContext(ctx, &rds.DeleteDBInstanceInput{
+		DBInstanceIdentifier:   aws.String(id),
+		SkipFinalSnapshot:      aws.Bool(true),
+		DeleteAutomatedBackups: aws.Bool(true),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+		return nil
+	}
+	return errors.Wrapf(err, "deleting %s", id)
+}
+
+// CleanupRestores deletes the temporary restores whose sessions stopped
+// pushing back their expiry. With dryRun set it only reports what it would
+// delete. Returns what was deleted.
+func CleanupRestores(ctx context.Context, rdsClient rdsiface.RDSAPI, dryRun bool, progress Progress) ([]string, error) {
+	var candidates []*rds.DBInstance
+	err := rdsClient.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{},
+		func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+			for _, db := range page.DBInstances {
+				if strings.HasPrefix(aws.StringValue(db.DBInstanceIdentifier), restorePrefix) &&
+					aws.StringValue(db.DBInstanceStatus) != "deleting" {
+					candidates = append(candidates, db)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing instances")
+	}
+
+	var removed []string
+	for _, db := range candidates {
+		id := aws.StringValue(db.DBInstanceIdentifier)
+		resp, err := rdsClient.ListTagsForResourceWithContext(ctx, &rds.ListTagsForResourceInput{
+			ResourceName: db.DBInstanceArn,
+		})
+		if err != nil {
+			return removed, errors.Wrapf(err, "reading the tags of %s", id)
+		}
+		ephemeral, expired := false, false
+		for _, t := range resp.TagList {
+			switch aws.StringValue(t.Key) {
+			case EphemeralTagKey:
+				ephemeral = true
+			case expiresTagKey:
+				at, err := strconv.ParseInt(aws.StringValue(t.Value), 10, 64)
+				expired = err != nil || time.Unix(at, 0).Before(time.Now())
+			}
+		}
+		if !ephemeral || !expired {
+			continue
+		}
+		if !dryRun {
+			progress(fmt.Sprintf("Deleting %s", id))
+			err := deleteRestore(ctx, rdsClient, id)
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && awsErr.Code() == rds.ErrCodeInvalidDBInstanceStateFault {
+				// It's still being restored, and can't be deleted until it's done
+				progress(fmt.Sprintf("%s is %s, try again later", id, aws.StringValue(db.DBInstanceStatus)))
+				continue
+			}
+			if err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, "database "+id)
+	}
+	return removed, nil
+}
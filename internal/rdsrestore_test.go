@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRestorePoint(t *testing.T) {
+	tests := []struct {
+		in         string
+		want       RestorePoint
+		wantString string
+		wantErr    bool
+	}{
+		{in: "latest", want: RestorePoint{}, wantString: "the latest restorable time"},
+		{in: "2020-05-01T09:30:00Z", want: RestorePoint{Time: time.Date(2020, 5, 1, 9, 30, 0, 0, time.UTC)},
+			wantString: "2020-05-01T09:30:00Z"},
+		{in: "2020-05-01T10:30:00+01:00", want: RestorePoint{Time: time.Date(2020, 5, 1, 9, 30, 0, 0, time.UTC)},
+			wantString: "2020-05-01T10:30:00+01:00"},
+		{in: "rds:orders-2020-05-01-09-30", want: RestorePoint{SnapshotID: "rds:orders-2020-05-01-09-30"},
+			wantString: "snapshot rds:orders-2020-05-01-09-30"},
+		{in: "before-migration", want: RestorePoint{SnapshotID: "before-migration"},
+			wantString: "snapshot before-migration"},
+		{in: "", wantErr: true},
+		{in: "2020-05-01", wantErr: true},
+		{in: "2020-05-01 09:30", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseRestorePoint(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRestorePoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.SnapshotID != tt.want.SnapshotID || !got.Time.Equal(tt.want.Time) {
+				t.Errorf("ParseRestorePoint() = %+v, want %+v", got, tt.want)
+			}
+			if s := got.String(); s != tt.wantString {
+				t.Errorf("String() = %q, want %q", s, tt.wantString)
+			}
+		})
+	}
+}
+
+func TestRestoredIdentifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "orders", want: "tunneller-orders-s44we8"},
+		{source: "Orders_DB.prod", want: "tunneller-orders-db-prod-s44we8"},
+		{source: "--orders--", want: "tunneller-orders-s44we8"},
+		{source: strings.Repeat("a", 45) + "-bcd", want: "tunneller-" + strings.Repeat("a", 45) + "-s44we8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			got := restoredIdentifier(tt.source, now)
+			if got != tt.want {
+				t.Errorf("restoredIdentifier() = %s, want %s", got, tt.want)
+			}
+			if len(got) > 63 {
+				t.Errorf("%s is %d characters long", got, len(got))
+			}
+		})
+	}
+}
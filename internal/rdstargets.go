@@ -0,0 +1,335 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	log "github.com/sirupsen/logrus"
+)
+
+// TargetKind says what sort of RDS address a DatabaseTarget is
+type TargetKind string
+
+const (
+	// TargetInstance is a DB instance's own endpoint
+	TargetInstance TargetKind = "instance"
+	// TargetWriter is a cluster's writer endpoint, which follows failovers
+	TargetWriter TargetKind = "writer"
+	// TargetReader is a cluster's reader endpoint, balancing over its replicas
+	TargetReader TargetKind = "reader"
+	// TargetCustom is one of a cluster's custom endpoints
+	TargetCustom TargetKind = "custom"
+)
+
+// DatabaseTarget is an RDS address to tunnel to
+type DatabaseTarget struct {
+	Kind TargetKind
+	// Name is the instance or custom endpoint identifier, or the cluster
+	// identifier for writer and reader endpoints
+	Name    string
+	Address string
+	Port    int64
+	Engine  string
+	// EngineVersion, Status, InstanceClass and MultiAZ are the instance's,
+	// or the cluster's for cluster endpoints, which have no class
+	EngineVersion string
+	Status        string
+	InstanceClass string
+	MultiAZ       bool
+	// Cluster is the cluster the target belongs to, if any
+	Cluster *rds.DBCluster
+	// Instance is the target instance or, for cluster endpoints, one of the
+	// instances behind it. Its subnet group, security groups and
+	// availability zone are used to find and check bastions.
+	Instance *rds.DBInstance
+}
+
+// HasEndpoint reports whether the target has an address to tunnel to yet.
+// Instances being created, and some stopped ones, don't.
+func (t DatabaseTarget) HasEndpoint() bool {
+	return t.Address != ""
+}
+
+// VpcID returns the VPC the target is in, if known
+func (t DatabaseTarget) VpcID() string {
+	if t.Instance == nil || t.Instance.DBSubnetGroup == nil {
+		return ""
+	}
+	return aws.StringValue(t.Instance.DBSubnetGroup.VpcId)
+}
+
+func (t DatabaseTarget) String() string {
+	return fmt.Sprintf("%s:%d", t.Address, t.Port)
+}
+
+// DatabaseGroup is an Aurora cluster with its endpoints and instances, or a
+// standalone instance
+type DatabaseGroup struct {
+	Cluster *rds.DBCluster
+	Targets []DatabaseTarget
+	// Tags are the cluster's or the standalone instance's, once LoadTags
+	// has been called
+	Tags map[string]string
+}
+
+// Name returns the cluster or standalone instance identifier
+func (g DatabaseGroup) Name() string {
+	if g.Cluster != nil {
+		return aws.StringValue(g.Cluster.DBClusterIdentifier)
+	}
+	return g.Targets[0].Name
+}
+
+// LoadTags fetches the group's tags, once. DescribeDBInstances and
+// DescribeDBClusters don't return them, so they are only fetched when
+// needed.
+func (g *DatabaseGroup) LoadTags(ctx context.Context, rdsClient rdsiface.RDSAPI) error {
+	if g.Tags != nil {
+		return nil
+	}
+	arn := g.Targets[0].Instance.DBInstanceArn
+	if g.Cluster != nil {
+		arn = g.Cluster.DBClusterArn
+	}
+	resp, err := rdsClient.ListTagsForResourceWithContext(ctx, &rds.ListTagsForResourceInput{ResourceName: arn})
+	if err != nil {
+		return NewTunnelError(ErrDiscovery, err)
+	}
+	g.Tags = make(map[string]string)
+	for _, t := range resp.TagList {
+		g.Tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return nil
+}
+
+// Writer and Reader return the cluster's writer and reader endpoints, or nil
+// if it doesn't have one
+func (g DatabaseGroup) Writer() *DatabaseTarget {
+	return g.find(TargetWriter)
+}
+
+func (g DatabaseGroup) Reader() *DatabaseTarget {
+	return g.find(TargetReader)
+}
+
+func (g DatabaseGroup) find(kind TargetKind) *DatabaseTarget {
+	for i := range g.Targets {
+		if g.Targets[i].Kind == kind {
+			return &g.Targets[i]
+		}
+	}
+	return nil
+}
+
+// DiscoverDatabases lists the RDS instances and Aurora clusters, grouping
+// each cluster's writer, reader and custom endpoints with its instances.
+// Clusters come first, then standalone instances, each sorted by name.
+// Failing to list clusters or custom endpoints isn't an error, they are just
+// left out.
+func DiscoverDatabases(ctx context.Context, rdsClient rdsiface.RDSAPI) ([]DatabaseGroup, error) {
+	var instances []*rds.DBInstance
+	err := rdsClient.DescribeDBInstancesPagesWithContext(ctx, &rds.DescribeDBInstancesInput{},
+		func(page *rds.DescribeDBInstancesOutput, lastPage bool) bool {
+			instances = append(instances, page.DBInstances...)
+			return true
+		})
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	var clusters []*rds.DBCluster
+	err = rdsClient.DescribeDBClustersPagesWithContext(ctx, &rds.DescribeDBClustersInput{},
+		func(page *rds.DescribeDBClustersOutput, lastPage bool) bool {
+			clusters = append(clusters, page.DBClusters...)
+			return true
+		})
+	if err != nil {
+		log.Debugf("Could not describe clusters: %v", err)
+		clusters = nil
+	}
+	customEndpoints := make(map[string][]*rds.DBClusterEndpoint)
+	input := &rds.DescribeDBClusterEndpointsInput{}
+	for {
+		resp, err := rdsClient.DescribeDBClusterEndpointsWithContext(ctx, input)
+		if err != nil {
+			log.Debugf("Could not describe cluster endpoints: %v", err)
+			break
+		}
+		for _, e := range resp.DBClusterEndpoints {
+			if aws.StringValue(e.EndpointType) == "CUSTOM" {
+				id := aws.StringValue(e.DBClusterIdentifier)
+				customEndpoints[id] = append(customEndpoints[id], e)
+			}
+		}
+		if aws.StringValue(resp.Marker) == "" {
+			break
+		}
+		input.Marker = resp.Marker
+	}
+
+	clusterInstances := make(map[string][]*rds.DBInstance)
+	var groups, standalone []DatabaseGroup
+	for _, db := range instances {
+		if id := aws.StringValue(db.DBClusterIdentifier); id != "" {
+			clusterInstances[id] = append(clusterInstances[id], db)
+			continue
+		}
+		standalone = append(standalone, DatabaseGroup{Targets: []DatabaseTarget{instanceTarget(db, nil)}})
+	}
+	for _, cluster := range clusters {
+		id := aws.StringValue(cluster.DBClusterIdentifier)
+		g := clusterGroup(cluster, clusterInstances[id], customEndpoints[id])
+		if len(clusterInstances[id]) == 0 {
+			// Aurora Serverless v1 clusters have no instances to take the
+			// subnet group from
+			g.setSubnetGroup(ctx, rdsClient)
+		}
+		if len(g.Targets) > 0 {
+			groups = append(groups, g)
+		}
+		delete(clusterInstances, id)
+	}
+	// Without the clusters, their instances are listed on their own
+	for _, instances := range clusterInstances {
+		for _, db := range instances {
+			standalone = append(standalone, DatabaseGroup{Targets: []DatabaseTarget{instanceTarget(db, nil)}})
+		}
+	}
+	sortGroups(groups)
+	sortGroups(standalone)
+	return append(groups, standalone...), nil
+}
+
+// setSubnetGroup looks up the cluster's subnet group for the placement of
+// targets that have no instance behind them
+func (g DatabaseGroup) setSubnetGroup(ctx context.Context, rdsClient rdsiface.RDSAPI) {
+	if g.Cluster.DBSubnetGroup == nil {
+		return
+	}
+	resp, err := rdsClient.DescribeDBSubnetGroupsWithContext(ctx, &rds.DescribeDBSubnetGroupsInput{
+		DBSubnetGroupName: g.Cluster.DBSubnetGroup,
+	})
+	if err != nil || len(resp.DBSubnetGroups) == 0 {
+		log.Debugf("Could not describe the subnet group of %s: %v", aws.StringValue(g.Cluster.DBClusterIdentifier), err)
+		return
+	}
+	for _, t := range g.Targets {
+		t.Instance.DBSubnetGroup = resp.DBSubnetGroups[0]
+	}
+}
+
+func sortGroups(groups []DatabaseGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Name() < groups[j].Name()
+	})
+}
+
+// clusterPlacement stands in for the instances of a cluster that has none,
+// with the cluster's network settings
+func clusterPlacement(cluster *rds.DBCluster) *rds.DBInstance {
+	db := &rds.DBInstance{
+		DBInstanceIdentifier: cluster.DBClusterIdentifier,
+		DBClusterIdentifier:  cluster.DBClusterIdentifier,
+		DbInstancePort:       cluster.Port,
+		Engine:               cluster.Engine,
+		VpcSecurityGroups:    cluster.VpcSecurityGroups,
+	}
+	if cluster.Endpoint != nil {
+		db.Endpoint = &rds.Endpoint{Address: cluster.Endpoint, Port: cluster.Port}
+	}
+	return db
+}
+
+func instanceTarget(db *rds.DBInstance, cluster *rds.DBCluster) DatabaseTarget {
+	t := DatabaseTarget{
+		Kind:          TargetInstance,
+		Name:          aws.StringValue(db.DBInstanceIdentifier),
+		Port:          aws.Int64Value(db.DbInstancePort),
+		Engine:        aws.StringValue(db.Engine),
+		EngineVersion: aws.StringValue(db.EngineVersion),
+		Status:        aws.StringValue(db.DBInstanceStatus),
+		InstanceClass: aws.StringValue(db.DBInstanceClass),
+		MultiAZ:       aws.BoolValue(db.MultiAZ),
+		Cluster:       cluster,
+		Instance:      db,
+	}
+	if db.Endpoint != nil {
+		t.Address = aws.StringValue(db.Endpoint.Address)
+		t.Port = aws.Int64Value(db.Endpoint.Port)
+	}
+	return t
+}
+
+// clusterGroup builds the targets of a cluster: its writer, reader and
+// custom endpoints, then its instances
+func clusterGroup(cluster *rds.DBCluster, instances []*rds.DBInstance, custom []*rds.DBClusterEndpoint) DatabaseGroup {
+	sort.Slice(instances, func(i, j int) bool {
+		return aws.StringValue(instances[i].DBInstanceIdentifier) < aws.StringValue(instances[j].DBInstanceIdentifier)
+	})
+	byID := make(map[string]*rds.DBInstance)
+	for _, db := range instances {
+		byID[aws.StringValue(db.DBInstanceIdentifier)] = db
+	}
+	// Cluster endpoints borrow the network placement of an instance behind
+	// them. Every instance of a cluster shares its subnet group and
+	// security groups, so any will do if the preferred one is missing.
+	var writer, reader *rds.DBInstance
+	for _, m := range cluster.DBClusterMembers {
+		db := byID[aws.StringValue(m.DBInstanceIdentifier)]
+		switch {
+		case db == nil:
+		case aws.BoolValue(m.IsClusterWriter):
+			writer = db
+		case reader == nil:
+			reader = db
+		}
+	}
+	placement := func(preferred ...*rds.DBInstance) *rds.DBInstance {
+		for _, db := range append(preferred, instances...) {
+			if db != nil {
+				return db
+			}
+		}
+		return clusterPlacement(cluster)
+	}
+
+	name := aws.StringValue(cluster.DBClusterIdentifier)
+	clusterTarget := func(kind TargetKind, name, address string, db *rds.DBInstance) DatabaseTarget {
+		return DatabaseTarget{
+			Kind:          kind,
+			Name:          name,
+			Address:       address,
+			Port:          aws.Int64Value(cluster.Port),
+			Engine:        aws.StringValue(cluster.Engine),
+			EngineVersion: aws.StringValue(cluster.EngineVersion),
+			Status:        aws.StringValue(cluster.Status),
+			MultiAZ:       aws.BoolValue(cluster.MultiAZ),
+			Cluster:       cluster,
+			Instance:      db,
+		}
+	}
+	g := DatabaseGroup{Cluster: cluster}
+	if cluster.Endpoint != nil {
+		g.Targets = append(g.Targets, clusterTarget(TargetWriter, name, aws.StringValue(cluster.Endpoint),
+			placement(writer)))
+	}
+	if cluster.ReaderEndpoint != nil {
+		g.Targets = append(g.Targets, clusterTarget(TargetReader, name, aws.StringValue(cluster.ReaderEndpoint),
+			placement(reader, writer)))
+	}
+	for _, e := range custom {
+		var member *rds.DBInstance
+		if len(e.StaticMembers) > 0 {
+			member = byID[aws.StringValue(e.StaticMembers[0])]
+		}
+		g.Targets = append(g.Targets, clusterTarget(TargetCustom, aws.StringValue(e.DBClusterEndpointIdentifier),
+			aws.StringValue(e.Endpoint), placement(member)))
+	}
+	for _, db := range instances {
+		g.Targets = append(g.Targets, instanceTarget(db, cluster))
+	}
+	return g
+}
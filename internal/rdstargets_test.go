@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+func clusterInstance(id string) *rds.DBInstance {
+	return &rds.DBInstance{
+		DBInstanceIdentifier: aws.String(id),
+		DBClusterIdentifier:  aws.String("orders"),
+		Endpoint:             &rds.Endpoint{Address: aws.String(id + ".rds.example.com"), Port: aws.Int64(5432)},
+		Engine:               aws.String("aurora-postgresql"),
+		DBInstanceStatus:     aws.String("available"),
+	}
+}
+
+func TestClusterGroup(t *testing.T) {
+	members := func(writer string, readers ...string) []*rds.DBClusterMember {
+		m := []*rds.DBClusterMember{{DBInstanceIdentifier: aws.String(writer), IsClusterWriter: aws.Bool(true)}}
+		for _, r := range readers {
+			m = append(m, &rds.DBClusterMember{DBInstanceIdentifier: aws.String(r), IsClusterWriter: aws.Bool(false)})
+		}
+		return m
+	}
+	custom := &rds.DBClusterEndpoint{
+		DBClusterEndpointIdentifier: aws.String("analytics"),
+		Endpoint:                    aws.String("analytics.cluster-custom.example.com"),
+		StaticMembers:               []*string{aws.String("orders-3")},
+	}
+
+	// summary is a target's kind, name and address, and the instance whose
+	// placement it uses
+	type summary struct {
+		kind      TargetKind
+		name      string
+		address   string
+		placement string
+	}
+	tests := []struct {
+		name       string
+		cluster    *rds.DBCluster
+		instances  []*rds.DBInstance
+		custom     []*rds.DBClusterEndpoint
+		want       []summary
+		wantWriter string
+		wantReader string
+	}{
+		{name: "writer, reader, custom and instances",
+			cluster: &rds.DBCluster{
+				Endpoint:         aws.String("orders.cluster.example.com"),
+				ReaderEndpoint:   aws.String("orders.cluster-ro.example.com"),
+				DBClusterMembers: members("orders-2", "orders-1", "orders-3"),
+			},
+			instances: []*rds.DBInstance{clusterInstance("orders-3"), clusterInstance("orders-1"), clusterInstance("orders-2")},
+			custom:    []*rds.DBClusterEndpoint{custom},
+			want: []summary{
+				{TargetWriter, "orders", "orders.cluster.example.com", "orders-2"},
+				{TargetReader, "orders", "orders.cluster-ro.example.com", "orders-1"},
+				{TargetCustom, "analytics", "analytics.cluster-custom.example.com", "orders-3"},
+				{TargetInstance, "orders-1", "orders-1.rds.example.com", "orders-1"},
+				{TargetInstance, "orders-2", "orders-2.rds.example.com", "orders-2"},
+				{TargetInstance, "orders-3", "orders-3.rds.example.com", "orders-3"},
+			},
+			wantWriter: "orders.cluster.example.com", wantReader: "orders.cluster-ro.example.com"},
+		{name: "single instance reader falls back to the writer",
+			cluster: &rds.DBCluster{
+				Endpoint:         aws.String("orders.cluster.example.com"),
+				ReaderEndpoint:   aws.String("orders.cluster-ro.example.com"),
+				DBClusterMembers: members("orders-1"),
+			},
+			instances: []*rds.DBInstance{clusterInstance("orders-1")},
+			want: []summary{
+				{TargetWriter, "orders", "orders.cluster.example.com", "orders-1"},
+				{TargetReader, "orders", "orders.cluster-ro.example.com", "orders-1"},
+				{TargetInstance, "orders-1", "orders-1.rds.example.com", "orders-1"},
+			},
+			wantWriter: "orders.cluster.example.com", wantReader: "orders.cluster-ro.example.com"},
+		{name: "custom endpoint member missing",
+			cluster: &rds.DBCluster{
+				Endpoint:         aws.String("orders.cluster.example.com"),
+				DBClusterMembers: members("orders-1"),
+			},
+			instances: []*rds.DBInstance{clusterInstance("orders-1")},
+			custom:    []*rds.DBClusterEndpoint{custom},
+			want: []summary{
+				{TargetWriter, "orders", "orders.cluster.example.com", "orders-1"},
+				{TargetCustom, "analytics", "analytics.cluster-custom.example.com", "orders-1"},
+				{TargetInstance, "orders-1", "orders-1.rds.example.com", "orders-1"},
+			},
+			wantWriter: "orders.cluster.example.com"},
+		{name: "serverless without instances",
+			cluster: &rds.DBCluster{
+				Endpoint:       aws.String("orders.cluster.example.com"),
+				ReaderEndpoint: aws.String("orders.cluster-ro.example.com"),
+			},
+			want: []summary{
+				{TargetWriter, "orders", "orders.cluster.example.com", "orders"},
+				{TargetReader, "orders", "orders.cluster-ro.example.com", "orders"},
+			},
+			wantWriter: "orders.cluster.example.com", wantReader: "orders.cluster-ro.example.com"},
+		{name: "no endpoints yet", cluster: &rds.DBCluster{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cluster.DBClusterIdentifier = aws.String("orders")
+			tt.cluster.Port = aws.Int64(5432)
+			g := clusterGroup(tt.cluster, tt.instances, tt.custom)
+			var got []summary
+			for _, target := range g.Targets {
+				if target.Cluster != tt.cluster {
+					t.Errorf("%s %s isn't in the cluster", target.Kind, target.Name)
+				}
+				got = append(got, summary{target.Kind, target.Name, target.Address,
+					aws.StringValue(target.Instance.DBInstanceIdentifier)})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("targets = %v, want %v", got, tt.want)
+			}
+			address := func(target *DatabaseTarget) string {
+				if target == nil {
+					return ""
+				}
+				return target.Address
+			}
+			if w := address(g.Writer()); w != tt.wantWriter {
+				t.Errorf("Writer() = %q, want %q", w, tt.wantWriter)
+			}
+			if r := address(g.Reader()); r != tt.wantReader {
+				t.Errorf("Reader() = %q, want %q", r, tt.wantReader)
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// returnPort stands in for the ephemeral port the database replies to when
+// checking stateless network ACLs
+const returnPort = 49152
+
+// PathCheck is the result of checking one hop of the network path from a
+// bastion to a database
+type PathCheck struct {
+	Name string
+	OK   bool
+	// Detail names the rule or route that allows or blocks the traffic
+	Detail string
+}
+
+func (c PathCheck) String() string {
+	verdict := "ok"
+	if !c.OK {
+		verdict = "BLOCKED"
+	}
+	return fmt.Sprintf("%s: %s - %s", c.Name, verdict, c.Detail)
+}
+
+// PathReport is the outcome of AnalyzePath
+type PathReport struct {
+	Checks []PathCheck
+}
+
+// Allowed reports whether every check passed
+func (r *PathReport) Allowed() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// Blocked returns the checks that failed
+func (r *PathReport) Blocked() []PathCheck {
+	var blocked []PathCheck
+	for _, c := range r.Checks {
+		if !c.OK {
+			blocked = append(blocked, c)
+		}
+	}
+	return blocked
+}
+
+func (r *PathReport) add(name string, ok bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PathCheck{Name: name, OK: ok, Detail: fmt.Sprintf(format, args...)})
+}
+
+// pathEnd is one end of the path: its address, subnet and security groups
+type pathEnd struct {
+	ip     net.IP
+	subnet *ec2.Subnet
+	vpcID  string
+	groups []*ec2.SecurityGroup
+}
+
+func (e *pathEnd) groupIDs() map[string]bool {
+	ids := make(map[string]bool)
+	for _, g := range e.groups {
+		ids[aws.StringValue(g.GroupId)] = true
+	}
+	return ids
+}
+
+// AnalyzePath works out from the AWS configuration whether bastion should be
+// able to open a TCP connection to the database on its port. It checks the
+// security groups at both ends, the route tables of both subnets including
+// any VPC peering or transit gateway hop, and both subnets' network ACLs.
+// Only IPv4 is checked.
+func AnalyzePath(ctx context.Context, ec2Client ec2iface.EC2API, bastion *ec2.Instance, db *rds.DBInstance) (*PathReport, error) {
+	a := &pathAnalysis{ctx: ctx, ec2: ec2Client}
+	src, err := a.bastionEnd(bastion)
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	dst, err := a.databaseEnd(db)
+	if err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	port := aws.Int64Value(db.Endpoint.Port)
+
+	report := &PathReport{}
+	if g := allowingGroup(src.groups, true, port, dst.groupIDs(), dst.ip); g != "" {
+		report.add("Bastion security group egress", true, "%s allows port %d to %s", g, port, dst.ip)
+	} else {
+		report.add("Bastion security group egress", false, "no outbound rule in %s allows port %d to %s",
+			joinGroupIDs(src.groups), port, dst.ip)
+	}
+	if g := allowingGroup(dst.groups, false, port, src.groupIDs(), src.ip); g != "" {
+		report.add("Database security group ingress", true, "%s allows port %d from %s", g, port, src.ip)
+	} else {
+		report.add("Database security group ingress", false, "no inbound rule in %s allows port %d from the bastion "+
+			"(%s or its security groups)", joinGroupIDs(dst.groups), port, src.ip)
+	}
+
+	if err := a.checkRoute(report, "Route from the bastion", src, dst); err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	if err := a.checkRoute(report, "Route back from the database", dst, src); err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+
+	// ACLs are stateless, so the bastion's subnet has to let the database
+	// port out and replies on an ephemeral port in, and the database's
+	// subnet the other way round
+	if err := a.checkACL(report, "Bastion subnet network ACL", src, dst, port, returnPort); err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	if err := a.checkACL(report, "Database subnet network ACL", dst, src, returnPort, port); err != nil {
+		return nil, NewTunnelError(ErrDiscovery, err)
+	}
+	return report, nil
+}
+
+type pathAnalysis struct {
+	ctx context.Context
+	ec2 ec2iface.EC2API
+}
+
+func (a *pathAnalysis) bastionEnd(bastion *ec2.Instance) (*pathEnd, error) {
+	end := &pathEnd{
+		ip:    net.ParseIP(aws.StringValue(bastion.PrivateIpAddress)),
+		vpcID: aws.StringValue(bastion.VpcId),
+	}
+	subnets, err := a.subnets([]*string{bastion.SubnetId})
+	if err != nil {
+		return nil, err
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("could not find the bastion's subnet %s", aws.StringValue(bastion.SubnetId))
+	}
+	end.subnet = subnets[0]
+	var ids []*string
+	for _, g := range bastion.SecurityGroups {
+		ids = append(ids, g.GroupId)
+	}
+	end.groups, err = a.securityGroups(ids)
+	return end, err
+}
+
+// databaseEnd works out where the database is. RDS doesn't say which
+// subnet it is in, so its endpoint is resolved and matched against the
+// subnets of its subnet group.
+func (a *pathAnalysis) databaseEnd(db *rds.DBInstance) (*pathEnd, error) {
+	if db.Endpoint == nil || db.DBSubnetGroup == nil {
+		return nil, fmt.Errorf("%s has no endpoint or subnet group yet", aws.StringValue(db.DBInstanceIdentifier))
+	}
+	end := &pathEnd{vpcID: aws.StringValue(db.DBSubnetGroup.VpcId)}
+	var subnetIDs []*string
+	for _, s := range db.DBSubnetGroup.Subnets {
+		subnetIDs = append(subnetIDs, s.SubnetIdentifier)
+	}
+	subnets, err := a.subnets(subnetIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(a.ctx, aws.StringValue(db.Endpoint.Address))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %v", aws.StringValue(db.Endpoint.Address), err)
+	}
+	for _, ip := range ips {
+		for _, s := range subnets {
+			_, cidr, err := net.ParseCIDR(aws.StringValue(s.CidrBlock))
+			if err == nil && cidr.Contains(ip.IP) {
+				end.ip, end.subnet = ip.IP, s
+			}
+		}
+	}
+	if end.subnet == nil {
+		// Publicly accessible databases resolve to their public address
+		// from outside the VPC, so the private one can't be found
+		return nil, fmt.Errorf("%s does not resolve to an address in its subnet group, it may be publicly accessible",
+			aws.StringValue(db.Endpoint.Address))
+	}
+
+	var ids []*string
+	for _, g := range db.VpcSecurityGroups {
+		ids = append(ids, g.VpcSecurityGroupId)
+	}
+	end.groups, err = a.securityGroups(ids)
+	return end, err
+}
+
+func (a *pathAnalysis) subnets(ids []*string) ([]*ec2.Subnet, error) {
+	resp, err := a.ec2.DescribeSubnetsWithContext(a.ctx, &ec2.DescribeSubnetsInput{SubnetIds: ids})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Subnets, nil
+}
+
+func (a *pathAnalysis) securityGroups(ids []*string) ([]*ec2.SecurityGroup, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	resp, err := a.ec2.DescribeSecurityGroupsWithContext(a.ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: ids})
+	if err != nil {
+		return nil, err
+	}
+	return resp.SecurityGroups, nil
+}
+
+// routeTable finds the route table of a subnet, which is the VPC's main one
+// unless the subnet has its own
+func (a *pathAnalysis) routeTable(subnet *ec2.Subnet) (*ec2.RouteTable, error) {
+	resp, err := a.ec2.DescribeRouteTablesWithContext(a.ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("association.subnet-id"), Values: []*string{subnet.SubnetId}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.RouteTables) > 0 {
+		return resp.RouteTables[0], nil
+	}
+	resp, err = a.ec2.DescribeRouteTablesWithContext(a.ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{subnet.VpcId}},
+			{Name: aws.String("association.main"), Values: []*string{aws.String("true")}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.RouteTables) == 0 {
+		return nil, fmt.Errorf("no route table found for %s", aws.StringValue(subnet.SubnetId))
+	}
+	return resp.RouteTables[0], nil
+}
+
+// checkRoute checks the route table of from's subnet sends traffic for to's
+// address somewhere that can deliver it: the VPC itself, an active peering
+// connection or an available transit gateway attachment
+func (a *pathAnalysis) checkRoute(report *PathReport, name string, from *pathEnd, to *pathEnd) error {
+	table, err := a.routeTable(from.subnet)
+	if err != nil {
+		return err
+	}
+	route, cidr := longestMatch(table.Routes, to.ip)
+	tableID := aws.StringValue(table.RouteTableId)
+	switch {
+	case route == nil:
+		report.add(name, false, "%s has no route to %s", tableID, to.ip)
+	case aws.StringValue(route.State) == ec2.RouteStateBlackhole:
+		report.add(name, false, "%s route %s is a blackhole", tableID, cidr)
+	case aws.StringValue(route.GatewayId) == "local":
+		if from.vpcID == to.vpcID {
+			report.add(name, true, "%s local route %s", tableID, cidr)
+		} else {
+			report.add(name, false, "%s sends %s to its own VPC, but it is in %s", tableID, to.ip, to.vpcID)
+		}
+	case aws.StringValue(route.VpcPeeringConnectionId) != "":
+		return a.checkPeering(report, name, tableID, cidr, aws.StringValue(route.VpcPeeringConnectionId), from, to)
+	case aws.StringValue(route.TransitGatewayId) != "":
+		return a.checkTransitGateway(report, name, tableID, cidr, aws.StringValue(route.TransitGatewayId), from, to)
+	default:
+		report.add(name, false, "%s sends %s (%s) to %s, not the VPC, a peering connection or a transit gateway",
+			tableID, to.ip, cidr, routeTarget(route))
+	}
+	return nil
+}
+
+func (a *pathAnalysis) checkPeering(report *PathReport, name, tableID, cidr, peeringID string, from, to *pathEnd) error {
+	resp, err := a.ec2.DescribeVpcPeeringConnectionsWithContext(a.ctx, &ec2.DescribeVpcPeeringConnectionsInput{
+		VpcPeeringConnectionIds: []*string{aws.String(peeringID)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.VpcPeeringConnections) == 0 {
+		report.add(name, false, "%s sends %s to %s, which doesn't exist", tableID, cidr, peeringID)
+		return nil
+	}
+	pcx := resp.VpcPeeringConnections[0]
+	state := ""
+	if pcx.Status != nil {
+		state = aws.StringValue(pcx.Status.Code)
+	}
+	vpcs := []string{vpcOf(pcx.RequesterVpcInfo), vpcOf(pcx.AccepterVpcInfo)}
+	connects := (vpcs[0] == from.vpcID && vpcs[1] == to.vpcID) || (vpcs[1] == from.vpcID && vpcs[0] == to.vpcID)
+	switch {
+	case state != ec2.VpcPeeringConnectionStateReasonCodeActive:
+		report.add(name, false, "%s sends %s to %s, which is %s", tableID, cidr, peeringID, state)
+	case !connects:
+		report.add(name, false, "%s sends %s to %s, which connects %s, not %s", tableID, cidr, peeringID,
+			strings.Join(vpcs, " and "), to.vpcID)
+	default:
+		report.add(name, true, "%s sends %s to active peering connection %s", tableID, cidr, peeringID)
+	}
+	return nil
+}
+
+func (a *pathAnalysis) checkTransitGateway(report *PathReport, name, tableID, cidr, tgwID string, from, to *pathEnd) error {
+	resp, err := a.ec2.DescribeTransitGatewayVpcAttachmentsWithContext(a.ctx, &ec2.DescribeTransitGatewayVpcAttachmentsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("transit-gateway-id"), Values: []*string{aws.String(tgwID)}},
+			{Name: aws.String("vpc-id"), Values: []*string{aws.String(from.vpcID), aws.String(to.vpcID)}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	attached := make(map[string]string)
+	for _, att := range resp.TransitGatewayVpcAttachments {
+		attached[aws.StringValue(att.VpcId)] = aws.StringValue(att.State)
+	}
+	for _, vpc := range []string{from.vpcID, to.vpcID} {
+		state, ok := attached[vpc]
+		if !ok {
+			report.add(name, false, "%s sends %s to %s, but %s isn't attached to it", tableID, cidr, tgwID, vpc)
+			return nil
+		}
+		if state != ec2.TransitGatewayAttachmentStateAvailable {
+			report.add(name, false, "%s sends %s to %s, but the attachment for %s is %s", tableID, cidr, tgwID, vpc, state)
+			return nil
+		}
+	}
+	// The transit gateway's own route tables aren't checked
+	report.add(name, true, "%s sends %s to %s, which both VPCs are attached to", tableID, cidr, tgwID)
+	return nil
+}
+
+// checkACL checks the network ACL of end's subnet allows TCP to peer on
+// outPort and from it on inPort
+func (a *pathAnalysis) checkACL(report *PathReport, name string, end *pathEnd, peer *pathEnd, outPort, inPort int64) error {
+	if aws.StringValue(end.subnet.SubnetId) == aws.StringValue(peer.subnet.SubnetId) {
+		report.add(name, true, "both ends are in %s, so its ACL doesn't apply", aws.StringValue(end.subnet.SubnetId))
+		return nil
+	}
+	resp, err := a.ec2.DescribeNetworkAclsWithContext(a.ctx, &ec2.DescribeNetworkAclsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("association.subnet-id"), Values: []*string{end.subnet.SubnetId}}},
+	})
+	if err != nil {
+		return err
+	}
+	if len(resp.NetworkAcls) == 0 {
+		report.add(name, false, "no network ACL found for %s", aws.StringValue(end.subnet.SubnetId))
+		return nil
+	}
+	acl := resp.NetworkAcls[0]
+	aclID := aws.StringValue(acl.NetworkAclId)
+
+	out, outRule := aclAllows(acl.Entries, true, peer.ip, outPort)
+	in, inRule := aclAllows(acl.Entries, false, peer.ip, inPort)
+	switch {
+	case !out:
+		report.add(name, false, "%s outbound rule %s blocks port %d to %s", aclID, outRule, outPort, peer.ip)
+	case !in:
+		report.add(name, false, "%s inbound rule %s blocks port %d from %s", aclID, inRule, inPort, peer.ip)
+	default:
+		report.add(name, true, "%s allows port %d to and %d from %s", aclID, outPort, inPort, peer.ip)
+	}
+	return nil
+}
+
+// aclAllows evaluates network ACL entries in rule number order, as AWS does,
+// and returns whether the first match allows TCP to or from ip on port, and
+// which rule decided it
+func aclAllows(entries []*ec2.NetworkAclEntry, egress bool, ip net.IP, port int64) (bool, string) {
+	var matching []*ec2.NetworkAclEntry
+	for _, e := range entries {
+		if aws.BoolValue(e.Egress) == egress {
+			matching = append(matching, e)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return aws.Int64Value(matching[i].RuleNumber) < aws.Int64Value(matching[j].RuleNumber)
+	})
+	for _, e := range matching {
+		_, cidr, err := net.ParseCIDR(aws.StringValue(e.CidrBlock))
+		if err != nil || !cidr.Contains(ip) {
+			continue
+		}
+		switch aws.StringValue(e.Protocol) {
+		case "-1":
+		case "6":
+			if e.PortRange == nil || aws.Int64Value(e.PortRange.From) > port || port > aws.Int64Value(e.PortRange.To) {
+				continue
+			}
+		default:
+			continue
+		}
+		rule := fmt.Sprint(aws.Int64Value(e.RuleNumber))
+		if rule == "32767" {
+			rule = "*"
+		}
+		return aws.StringValue(e.RuleAction) == ec2.RuleActionAllow, rule
+	}
+	return false, "*"
+}
+
+// longestMatch finds the most specific IPv4 route containing ip
+func longestMatch(routes []*ec2.Route, ip net.IP) (*ec2.Route, string) {
+	var best *ec2.Route
+	bestLen := -1
+	for _, r := range routes {
+		_, cidr, err := net.ParseCIDR(aws.StringValue(r.DestinationCidrBlock))
+		if err != nil || !cidr.Contains(ip) {
+			continue
+		}
+		if ones, _ := cidr.Mask.Size(); ones > bestLen {
+			best, bestLen = r, ones
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	return best, aws.StringValue(best.DestinationCidrBlock)
+}
+
+func routeTarget(r *ec2.Route) string {
+	for _, target := range []*string{r.GatewayId, r.NatGatewayId, r.InstanceId, r.NetworkInterfaceId, r.LocalGatewayId} {
+		if v := aws.StringValue(target); v != "" {
+			return v
+		}
+	}
+	return "an unknown target"
+}
+
+func vpcOf(info *ec2.VpcPeeringConnectionVpcInfo) string {
+	if info == nil {
+		return ""
+	}
+	return aws.StringValue(info.VpcId)
+}
+
+func joinGroupIDs(groups []*ec2.SecurityGroup) string {
+	var ids []string
+	for _, g := range groups {
+		ids = append(ids, aws.StringValue(g.GroupId))
+	}
+	if len(ids) == 0 {
+		return "no security groups"
+	}
+	return strings.Join(ids, ", ")
+}
+
+// allowingGroup returns the ID of the first of groups with a rule allowing
+// TCP on port to or from (egress or not) one of peerGroups or peerIP, or an
+// empty string if there isn't one
+func allowingGroup(groups []*ec2.SecurityGroup, egress bool, port int64, peerGroups map[string]bool, peerIP net.IP) string {
+	for _, group := range groups {
+		perms := group.IpPermissions
+		if egress {
+			perms = group.IpPermissionsEgress
+		}
+		for _, perm := range perms {
+			if !permissionCoversPort(perm, port) {
+				continue
+			}
+			for _, pair := range perm.UserIdGroupPairs {
+				if peerGroups[aws.StringValue(pair.GroupId)] {
+					return aws.StringValue(group.GroupId)
+				}
+			}
+			for _, ipRange := range perm.IpRanges {
+				_, cidr, err := net.ParseCIDR(aws.StringValue(ipRange.CidrIp))
+				if err == nil && peerIP != nil && cidr.Contains(peerIP) {
+					return aws.StringValue(group.GroupId)
+				}
+			}
+		}
+	}
+	return ""
+}
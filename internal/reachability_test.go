@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// pathNetwork is a fake EC2 API describing the network between a bastion
+// and a database
+type pathNetwork struct {
+	ec2iface.EC2API
+	subnets []*ec2.Subnet
+	groups  []*ec2.SecurityGroup
+	// routeTables is keyed by subnet ID, or "main:" and the VPC ID
+	routeTables map[string]*ec2.RouteTable
+	// acls is keyed by subnet ID
+	acls        map[string]*ec2.NetworkAcl
+	peerings    []*ec2.VpcPeeringConnection
+	attachments []*ec2.TransitGatewayVpcAttachment
+
+	bastion *ec2.Instance
+	db      *rds.DBInstance
+}
+
+func filterValue(filters []*ec2.Filter, name string) []string {
+	for _, f := range filters {
+		if aws.StringValue(f.Name) == name {
+			return aws.StringValueSlice(f.Values)
+		}
+	}
+	return nil
+}
+
+func (n *pathNetwork) DescribeSubnetsWithContext(_ aws.Context, in *ec2.DescribeSubnetsInput,
+	_ ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	out := &ec2.DescribeSubnetsOutput{}
+	for _, id := range in.SubnetIds {
+		for _, s := range n.subnets {
+			if aws.StringValue(s.SubnetId) == aws.StringValue(id) {
+				out.Subnets = append(out.Subnets, s)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (n *pathNetwork) DescribeSecurityGroupsWithContext(_ aws.Context, in *ec2.DescribeSecurityGroupsInput,
+	_ ...request.Option) (*ec2.DescribeSecurityGroupsOutput, error) {
+	out := &ec2.DescribeSecurityGroupsOutput{}
+	for _, id := range in.GroupIds {
+		for _, g := range n.groups {
+			if aws.StringValue(g.GroupId) == aws.StringValue(id) {
+				out.SecurityGroups = append(out.SecurityGroups, g)
+			}
+		}
+	}
+	return out, nil
+}
+
+func (n *pathNetwork) DescribeRouteTablesWithContext(_ aws.Context, in *ec2.DescribeRouteTablesInput,
+	_ ...request.Option) (*ec2.DescribeRouteTablesOutput, error) {
+	key := ""
+	if subnet := filterValue(in.Filters, "association.subnet-id"); len(subnet) > 0 {
+		key = subnet[0]
+	} else if vpc := filterValue(in.Filters, "vpc-id"); len(vpc) > 0 {
+		key = "main:" + vpc[0]
+	}
+	out := &ec2.DescribeRouteTablesOutput{}
+	if table, ok := n.routeTables[key]; ok {
+		out.RouteTables = []*ec2.RouteTable{table}
+	}
+	return out, nil
+}
+
+func (n *pathNetwork) DescribeNetworkAclsWithContext(_ aws.Context, in *ec2.DescribeNetworkAclsInput,
+	_ ...request.Option) (*ec2.DescribeNetworkAclsOutput, error) {
+	out := &ec2.DescribeNetworkAclsOutput{}
+	if acl, ok := n.acls[filterValue(in.Filters, "association.subnet-id")[0]]; ok {
+		out.NetworkAcls = []*ec2.NetworkAcl{acl}
+	}
+	return out, nil
+}
+
+func (n *pathNetwork) DescribeVpcPeeringConnectionsWithContext(_ aws.Context, in *ec2.DescribeVpcPeeringConnectionsInput,
+	_ ...request.Option) (*ec2.DescribeVpcPeeringConnectionsOutput, error) {
+	out := &ec2.DescribeVpcPeeringConnectionsOutput{}
+	for _, p := range n.peerings {
+		if aws.StringValue(p.VpcPeeringConnectionId) == aws.StringValue(in.VpcPeeringConnectionIds[0]) {
+			out.VpcPeeringConnections = append(out.VpcPeeringConnections, p)
+		}
+	}
+	return out, nil
+}
+
+func (n *pathNetwork) DescribeTransitGatewayVpcAttachmentsWithContext(_ aws.Context,
+	in *ec2.DescribeTransitGatewayVpcAttachmentsInput, _ ...request.Option) (*ec2.DescribeTransitGatewayVpcAttachmentsOutput, error) {
+	tgw := filterValue(in.Filters, "transit-gateway-id")[0]
+	out := &ec2.DescribeTransitGatewayVpcAttachmentsOutput{}
+	for _, att := range n.attachments {
+		if aws.StringValue(att.TransitGatewayId) == tgw {
+			out.TransitGatewayVpcAttachments = append(out.TransitGatewayVpcAttachments, att)
+		}
+	}
+	return out, nil
+}
+
+func testSubnet(id, vpc, cidr string) *ec2.Subnet {
+	return &ec2.Subnet{SubnetId: aws.String(id), VpcId: aws.String(vpc), CidrBlock: aws.String(cidr)}
+}
+
+// tcpPermission allows TCP on port from (or to) a CIDR or a security group
+func tcpPermission(port int64, peer string) *ec2.IpPermission {
+	perm := &ec2.IpPermission{IpProtocol: aws.String("tcp"), FromPort: aws.Int64(port), ToPort: aws.Int64(port)}
+	if strings.HasPrefix(peer, "sg-") {
+		perm.UserIdGroupPairs = []*ec2.UserIdGroupPair{{GroupId: aws.String(peer)}}
+	} else {
+		perm.IpRanges = []*ec2.IpRange{{CidrIp: aws.String(peer)}}
+	}
+	return perm
+}
+
+var allTraffic = &ec2.IpPermission{IpProtocol: aws.String("-1"), IpRanges: []*ec2.IpRange{{CidrIp: aws.String("0.0.0.0/0")}}}
+
+func routeTable(id string, routes ...*ec2.Route) *ec2.RouteTable {
+	return &ec2.RouteTable{RouteTableId: aws.String(id), Routes: routes}
+}
+
+func localRoute(cidr string) *ec2.Route {
+	return &ec2.Route{DestinationCidrBlock: aws.String(cidr), GatewayId: aws.String("local"), State: aws.String("active")}
+}
+
+// aclEntry is a rule for protocol "-1" (all) or "6" (TCP) on ports from-to
+func aclEntry(rule int64, egress bool, action, cidr, protocol string, from, to int64) *ec2.NetworkAclEntry {
+	e := &ec2.NetworkAclEntry{
+		RuleNumber: aws.Int64(rule),
+		Egress:     aws.Bool(egress),
+		RuleAction: aws.String(action),
+		CidrBlock:  aws.String(cidr),
+		Protocol:   aws.String(protocol),
+	}
+	if protocol == "6" {
+		e.PortRange = &ec2.PortRange{From: aws.Int64(from), To: aws.Int64(to)}
+	}
+	return e
+}
+
+// defaultACL allows everything, with the * rules every ACL ends with
+func defaultACL(id string) *ec2.NetworkAcl {
+	return &ec2.NetworkAcl{NetworkAclId: aws.String(id), Entries: []*ec2.NetworkAclEntry{
+		aclEntry(100, false, ec2.RuleActionAllow, "0.0.0.0/0", "-1", 0, 0),
+		aclEntry(100, true, ec2.RuleActionAllow, "0.0.0.0/0", "-1", 0, 0),
+		aclEntry(32767, false, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+		aclEntry(32767, true, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+	}}
+}
+
+// newPathNetwork is a bastion in 10.0.1.0/24 and a PostgreSQL database in
+// 10.0.2.0/24 of the same VPC, whose security group allows the bastion's
+func newPathNetwork() *pathNetwork {
+	return &pathNetwork{
+		subnets: []*ec2.Subnet{
+			testSubnet("subnet-bastion", "vpc-a", "10.0.1.0/24"),
+			testSubnet("subnet-db", "vpc-a", "10.0.2.0/24"),
+		},
+		groups: []*ec2.SecurityGroup{
+			{GroupId: aws.String("sg-bastion"), IpPermissionsEgress: []*ec2.IpPermission{allTraffic}},
+			{GroupId: aws.String("sg-db"), IpPermissions: []*ec2.IpPermission{tcpPermission(5432, "sg-bastion")}},
+		},
+		routeTables: map[string]*ec2.RouteTable{
+			"main:vpc-a": routeTable("rtb-a", localRoute("10.0.0.0/16")),
+		},
+		acls: map[string]*ec2.NetworkAcl{
+			"subnet-bastion": defaultACL("acl-a"),
+			"subnet-db":      defaultACL("acl-a"),
+		},
+		bastion: &ec2.Instance{
+			InstanceId:       aws.String("i-bastion"),
+			PrivateIpAddress: aws.String("10.0.1.10"),
+			VpcId:            aws.String("vpc-a"),
+			SubnetId:         aws.String("subnet-bastion"),
+			SecurityGroups:   []*ec2.GroupIdentifier{{GroupId: aws.String("sg-bastion")}},
+		},
+		db: &rds.DBInstance{
+			DBInstanceIdentifier: aws.String("db"),
+			// An IP address resolves to itself, so no DNS is needed
+			Endpoint: &rds.Endpoint{Address: aws.String("10.0.2.20"), Port: aws.Int64(5432)},
+			DBSubnetGroup: &rds.DBSubnetGroup{
+				VpcId:   aws.String("vpc-a"),
+				Subnets: []*rds.Subnet{{SubnetIdentifier: aws.String("subnet-db")}},
+			},
+			VpcSecurityGroups: []*rds.VpcSecurityGroupMembership{{VpcSecurityGroupId: aws.String("sg-db")}},
+		},
+	}
+}
+
+// moveBastion puts the bastion in 172.16.1.0/24 of vpc-b, with only a local
+// route in both directions until the test adds one, and the database's
+// security group allowing it by address
+func (n *pathNetwork) moveBastion() {
+	n.subnets = append(n.subnets, testSubnet("subnet-b", "vpc-b", "172.16.1.0/24"))
+	n.bastion.VpcId, n.bastion.SubnetId, n.bastion.PrivateIpAddress =
+		aws.String("vpc-b"), aws.String("subnet-b"), aws.String("172.16.1.10")
+	n.routeTables["main:vpc-b"] = routeTable("rtb-b", localRoute("172.16.0.0/16"))
+	n.acls["subnet-b"] = defaultACL("acl-b")
+	n.groups[1].IpPermissions = []*ec2.IpPermission{tcpPermission(5432, "172.16.1.0/24")}
+}
+
+// addRoute adds a route to both VPCs' tables, each towards the other
+func (n *pathNetwork) addRoute(route func(cidr string) *ec2.Route) {
+	table := n.routeTables["main:vpc-b"]
+	table.Routes = append(table.Routes, route("10.0.0.0/16"))
+	table = n.routeTables["main:vpc-a"]
+	table.Routes = append(table.Routes, route("172.16.0.0/16"))
+}
+
+func peeringRoute(cidr string) *ec2.Route {
+	return &ec2.Route{DestinationCidrBlock: aws.String(cidr), VpcPeeringConnectionId: aws.String("pcx-1"),
+		State: aws.String("active")}
+}
+
+func transitGatewayRoute(cidr string) *ec2.Route {
+	return &ec2.Route{DestinationCidrBlock: aws.String(cidr), TransitGatewayId: aws.String("tgw-1"),
+		State: aws.String("active")}
+}
+
+func peering(state, requester, accepter string) *ec2.VpcPeeringConnection {
+	return &ec2.VpcPeeringConnection{
+		VpcPeeringConnectionId: aws.String("pcx-1"),
+		Status:                 &ec2.VpcPeeringConnectionStateReason{Code: aws.String(state)},
+		RequesterVpcInfo:       &ec2.VpcPeeringConnectionVpcInfo{VpcId: aws.String(requester)},
+		AccepterVpcInfo:        &ec2.VpcPeeringConnectionVpcInfo{VpcId: aws.String(accepter)},
+	}
+}
+
+func attachment(vpc, state string) *ec2.TransitGatewayVpcAttachment {
+	return &ec2.TransitGatewayVpcAttachment{TransitGatewayId: aws.String("tgw-1"), VpcId: aws.String(vpc),
+		State: aws.String(state)}
+}
+
+func TestAnalyzePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(n *pathNetwork)
+		// blocked is the name of the one check that should fail, and
+		// detail part of what it should say. Empty if the path is allowed.
+		blocked string
+		detail  string
+	}{
+		{name: "allowed", setup: func(n *pathNetwork) {}},
+		{name: "database group allows the bastion's address", setup: func(n *pathNetwork) {
+			n.groups[1].IpPermissions = []*ec2.IpPermission{tcpPermission(5432, "10.0.1.0/24")}
+		}},
+		{name: "database group has no rule", setup: func(n *pathNetwork) {
+			n.groups[1].IpPermissions = nil
+		}, blocked: "Database security group ingress", detail: "sg-db"},
+		{name: "database group allows another port", setup: func(n *pathNetwork) {
+			n.groups[1].IpPermissions = []*ec2.IpPermission{tcpPermission(3306, "sg-bastion")}
+		}, blocked: "Database security group ingress", detail: "port 5432"},
+		{name: "database group allows another address", setup: func(n *pathNetwork) {
+			n.groups[1].IpPermissions = []*ec2.IpPermission{tcpPermission(5432, "10.0.3.0/24")}
+		}, blocked: "Database security group ingress", detail: "10.0.1.10"},
+		{name: "bastion group has no egress", setup: func(n *pathNetwork) {
+			n.groups[0].IpPermissionsEgress = nil
+		}, blocked: "Bastion security group egress", detail: "sg-bastion"},
+		{name: "ACL denies before it allows", setup: func(n *pathNetwork) {
+			n.acls["subnet-db"].Entries = append(n.acls["subnet-db"].Entries,
+				aclEntry(90, false, ec2.RuleActionDeny, "10.0.1.0/24", "6", 5432, 5432))
+		}, blocked: "Database subnet network ACL", detail: "inbound rule 90"},
+		{name: "ACL allows before it denies", setup: func(n *pathNetwork) {
+			n.acls["subnet-db"].Entries = append(n.acls["subnet-db"].Entries,
+				aclEntry(110, false, ec2.RuleActionDeny, "10.0.1.0/24", "6", 5432, 5432))
+		}},
+		{name: "ACL falls through to the * rule", setup: func(n *pathNetwork) {
+			n.acls["subnet-db"] = &ec2.NetworkAcl{NetworkAclId: aws.String("acl-db"), Entries: []*ec2.NetworkAclEntry{
+				aclEntry(100, false, ec2.RuleActionAllow, "10.0.1.0/24", "6", 5432, 5432),
+				aclEntry(32767, false, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+				aclEntry(32767, true, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+			}}
+		}, blocked: "Database subnet network ACL", detail: "outbound rule *"},
+		{name: "ACL blocks the reply's ephemeral port", setup: func(n *pathNetwork) {
+			n.acls["subnet-bastion"] = &ec2.NetworkAcl{NetworkAclId: aws.String("acl-bastion"), Entries: []*ec2.NetworkAclEntry{
+				aclEntry(100, true, ec2.RuleActionAllow, "0.0.0.0/0", "6", 5432, 5432),
+				aclEntry(100, false, ec2.RuleActionAllow, "0.0.0.0/0", "6", 22, 22),
+				aclEntry(32767, false, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+				aclEntry(32767, true, ec2.RuleActionDeny, "0.0.0.0/0", "-1", 0, 0),
+			}}
+		}, blocked: "Bastion subnet network ACL", detail: "inbound rule * blocks port 49152"},
+		{name: "ACL is skipped in one subnet", setup: func(n *pathNetwork) {
+			n.db.DBSubnetGroup.Subnets[0].SubnetIdentifier = aws.String("subnet-bastion")
+			n.subnets[0].CidrBlock = aws.String("10.0.0.0/16")
+			n.acls["subnet-bastion"].Entries = nil
+		}},
+		{name: "subnet's own route table has no route", setup: func(n *pathNetwork) {
+			n.routeTables["subnet-db"] = routeTable("rtb-db", localRoute("10.0.2.0/24"))
+		}, blocked: "Route back from the database", detail: "rtb-db has no route to 10.0.1.10"},
+		{name: "no route to another VPC", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			table := n.routeTables["main:vpc-a"]
+			table.Routes = append(table.Routes, peeringRoute("172.16.0.0/16"))
+			n.peerings = []*ec2.VpcPeeringConnection{peering("active", "vpc-b", "vpc-a")}
+		}, blocked: "Route from the bastion", detail: "rtb-b has no route to 10.0.2.20"},
+		{name: "blackhole route", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(peeringRoute)
+			n.routeTables["main:vpc-b"].Routes[1].State = aws.String(ec2.RouteStateBlackhole)
+			n.peerings = []*ec2.VpcPeeringConnection{peering("active", "vpc-b", "vpc-a")}
+		}, blocked: "Route from the bastion", detail: "blackhole"},
+		{name: "route to an internet gateway", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(func(cidr string) *ec2.Route {
+				return &ec2.Route{DestinationCidrBlock: aws.String("0.0.0.0/0"), GatewayId: aws.String("igw-1")}
+			})
+		}, blocked: "Route from the bastion", detail: "igw-1"},
+		{name: "active peering", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(peeringRoute)
+			n.peerings = []*ec2.VpcPeeringConnection{peering("active", "vpc-b", "vpc-a")}
+		}},
+		{name: "peering not accepted", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(peeringRoute)
+			n.peerings = []*ec2.VpcPeeringConnection{peering("pending-acceptance", "vpc-b", "vpc-a")}
+		}, blocked: "Route from the bastion", detail: "pending-acceptance"},
+		{name: "peering to another VPC", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(peeringRoute)
+			n.peerings = []*ec2.VpcPeeringConnection{peering("active", "vpc-b", "vpc-c")}
+		}, blocked: "Route from the bastion", detail: "connects vpc-b and vpc-c"},
+		{name: "transit gateway", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(transitGatewayRoute)
+			n.attachments = []*ec2.TransitGatewayVpcAttachment{
+				attachment("vpc-a", ec2.TransitGatewayAttachmentStateAvailable),
+				attachment("vpc-b", ec2.TransitGatewayAttachmentStateAvailable),
+			}
+		}},
+		{name: "transit gateway without the database's VPC", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(transitGatewayRoute)
+			n.attachments = []*ec2.TransitGatewayVpcAttachment{
+				attachment("vpc-b", ec2.TransitGatewayAttachmentStateAvailable),
+			}
+		}, blocked: "Route from the bastion", detail: "vpc-a isn't attached"},
+		{name: "transit gateway attachment pending", setup: func(n *pathNetwork) {
+			n.moveBastion()
+			n.addRoute(transitGatewayRoute)
+			n.attachments = []*ec2.TransitGatewayVpcAttachment{
+				attachment("vpc-a", ec2.TransitGatewayAttachmentStatePending),
+				attachment("vpc-b", ec2.TransitGatewayAttachmentStateAvailable),
+			}
+		}, blocked: "Route from the bastion", detail: "attachment for vpc-a is pending"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := newPathNetwork()
+			tt.setup(n)
+			report, err := AnalyzePath(context.Background(), n, n.bastion, n.db)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			blocked := report.Blocked()
+			if tt.blocked == "" {
+				if !report.Allowed() {
+					t.Fatalf("expected the path to be allowed, got %v", blocked)
+				}
+				return
+			}
+			if report.Allowed() {
+				t.Fatalf("expected %q to be blocked, got %v", tt.blocked, report.Checks)
+			}
+			if blocked[0].Name != tt.blocked || !strings.Contains(blocked[0].Detail, tt.detail) {
+				t.Fatalf("got %v, want %q blocked with %q", blocked, tt.blocked, tt.detail)
+			}
+		})
+	}
+}
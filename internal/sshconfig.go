@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	osuser "os/user"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SSHConfig is the subset of an OpenSSH client config file tunneller
+// understands: Host blocks with HostName, User, Port, IdentityFile and
+// ProxyJump
+type SSHConfig struct {
+	blocks []sshConfigBlock
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	options  map[string][]string
+}
+
+// SSHHost is the resolved configuration for a single host
+type SSHHost struct {
+	HostName      string
+	User          string
+	Port          int
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// LoadSSHConfig reads an OpenSSH client config file. A missing file is
+// treated as an empty config.
+func LoadSSHConfig(file string) (*SSHConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &SSHConfig{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	return parseSSHConfig(f)
+}
+
+func parseSSHConfig(r io.Reader) (*SSHConfig, error) {
+	config := &SSHConfig{}
+	// Options before the first Host line apply to every host
+	current := sshConfigBlock{patterns: []string{"*"}, options: make(map[string][]string)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := splitSSHConfigLine(line)
+		switch key {
+		case "host":
+			config.blocks = append(config.blocks, current)
+			current = sshConfigBlock{patterns: strings.Fields(value), options: make(map[string][]string)}
+		case "match", "include":
+			log.Debugf("Ignoring unsupported ssh config directive %q", line)
+			if key == "match" {
+				// Don't let a Match block's options leak into the previous Host
+				config.blocks = append(config.blocks, current)
+				current = sshConfigBlock{options: make(map[string][]string)}
+			}
+		default:
+			current.options[key] = append(current.options[key], value)
+		}
+	}
+	config.blocks = append(config.blocks, current)
+	return config, scanner.Err()
+}
+
+func splitSSHConfigLine(line string) (string, string) {
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+	key := strings.ToLower(line[:i])
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	return key, strings.Trim(value, "\"")
+}
+
+// HasHost reports whether a Host block names host explicitly, rather than
+// only through wildcards
+func (c *SSHConfig) HasHost(host string) bool {
+	for _, b := range c.blocks {
+		for _, p := range b.patterns {
+			if p == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Lookup resolves the options for host. As with OpenSSH, the first value
+// found for an option wins, except IdentityFile which accumulates.
+func (c *SSHConfig) Lookup(host string) (SSHHost, error) {
+	resolved := SSHHost{}
+	for _, b := range c.blocks {
+		if !matchesSSHHost(b.patterns, host) {
+			continue
+		}
+		if v, ok := b.options["hostname"]; ok && resolved.HostName == "" {
+			resolved.HostName = strings.Replace(v[0], "%h", host, -1)
+		}
+		if v, ok := b.options["user"]; ok && resolved.User == "" {
+			resolved.User = v[0]
+		}
+		if v, ok := b.options["port"]; ok && resolved.Port == 0 {
+			port, err := parsePort(v[0])
+			if err != nil {
+				return resolved, errors.Wrapf(err, "Port for %s in the ssh config", host)
+			}
+			resolved.Port = port
+		}
+		if v, ok := b.options["proxyjump"]; ok && resolved.ProxyJump == "" {
+			resolved.ProxyJump = v[0]
+		}
+		for _, f := range b.options["identityfile"] {
+			resolved.IdentityFiles = append(resolved.IdentityFiles, expandHome(f))
+		}
+	}
+	if resolved.HostName == "" {
+		resolved.HostName = host
+	}
+	if strings.EqualFold(resolved.ProxyJump, "none") {
+		resolved.ProxyJump = ""
+	}
+	return resolved, nil
+}
+
+func matchesSSHHost(patterns []string, host string) bool {
+	matched := false
+	for _, p := range patterns {
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if ok, _ := filepath.Match(p, host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func expandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return path.Join(home, p[2:])
+}
+
+// maxProxyJumps stops ProxyJump loops in a config from recursing forever
+const maxProxyJumps = 10
+
+// ResolveSSHEndpoint turns spec into an endpoint. spec is either
+// [user@]host[:port] or the name of a Host in config, whose HostName, User,
+// Port, IdentityFile and ProxyJump are applied. Anything given in spec wins
+// over the config. auth is copied with the host's identity files added.
+func ResolveSSHEndpoint(spec string, config *SSHConfig, auth *AuthConfig) (*Endpoint, error) {
+	return resolveSSHEndpoint(spec, config, auth, 0)
+}
+
+func resolveSSHEndpoint(spec string, config *SSHConfig, auth *AuthConfig, depth int) (*Endpoint, error) {
+	if depth > maxProxyJumps {
+		return nil, fmt.Errorf("more than %d ProxyJump hosts, is there a loop in the ssh config?", maxProxyJumps)
+	}
+	user, host, port, err := parseAddress(spec)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		config = &SSHConfig{}
+	}
+	hostConfig, err := config.Lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := &Endpoint{
+		Host: hostConfig.HostName,
+		Port: port,
+		User: user,
+		Auth: auth.withIdentityFiles(hostConfig.IdentityFiles),
+	}
+	if endpoint.User == "" {
+		endpoint.User = hostConfig.User
+	}
+	if endpoint.User == "" {
+		endpoint.User = currentUsername()
+	}
+	if endpoint.Port == 0 {
+		endpoint.Port = hostConfig.Port
+	}
+	if endpoint.Port == 0 {
+		endpoint.Port = 22
+	}
+
+	if hostConfig.ProxyJump != "" {
+		// ProxyJump a,b means a is dialled first, then b through it
+		jumps := strings.Split(hostConfig.ProxyJump, ",")
+		var previous *Endpoint
+		for _, j := range jumps {
+			jump, err := resolveSSHEndpoint(strings.TrimSpace(j), config, auth, depth+1)
+			if err != nil {
+				return nil, errors.Wrapf(err, "resolving ProxyJump %s for %s", j, host)
+			}
+			if previous != nil {
+				lastJump(jump).ProxyJump = previous
+			}
+			previous = jump
+		}
+		endpoint.ProxyJump = previous
+	}
+	return endpoint, nil
+}
+
+// lastJump follows an endpoint's ProxyJump chain to the host dialled first
+func lastJump(e *Endpoint) *Endpoint {
+	for e.ProxyJump != nil {
+		e = e.ProxyJump
+	}
+	return e
+}
+
+func currentUsername() string {
+	if u, err := osuser.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSSHConfig = `
+# Defaults before any Host line apply everywhere
+IdentityFile ~/.ssh/global
+
+Host bastion
+    HostName bastion.example.com
+    User ops
+    Port 2222
+    IdentityFile ~/.ssh/bastion
+
+Host *.internal !db.internal
+    User app
+    ProxyJump bastion
+
+Host db.internal
+    HostName 10.0.0.5
+
+Host web-*
+    HostName %h.example.com
+    User web
+    IdentityFile=/keys/web
+
+Host web-1
+    User ignored
+    Port 2200
+
+Match host web-1
+    User matched
+
+Host direct
+    ProxyJump none
+
+Host badport
+    Port ssh
+
+Host *
+    User default
+`
+
+func TestSSHConfigLookup(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	config, err := parseSSHConfig(strings.NewReader(testSSHConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		want    SSHHost
+		wantErr bool
+	}{
+		{name: "exact host", host: "bastion", want: SSHHost{HostName: "bastion.example.com", User: "ops", Port: 2222,
+			IdentityFiles: []string{"/home/me/.ssh/global", "/home/me/.ssh/bastion"}}},
+		{name: "wildcard", host: "cache.internal", want: SSHHost{HostName: "cache.internal", User: "app",
+			ProxyJump: "bastion", IdentityFiles: []string{"/home/me/.ssh/global"}}},
+		{name: "negated pattern", host: "db.internal", want: SSHHost{HostName: "10.0.0.5", User: "default",
+			IdentityFiles: []string{"/home/me/.ssh/global"}}},
+		{name: "first value wins and %h", host: "web-1", want: SSHHost{HostName: "web-1.example.com", User: "web",
+			Port: 2200, IdentityFiles: []string{"/home/me/.ssh/global", "/keys/web"}}},
+		{name: "ProxyJump none", host: "direct", want: SSHHost{HostName: "direct", User: "default",
+			IdentityFiles: []string{"/home/me/.ssh/global"}}},
+		{name: "no Host block", host: "elsewhere", want: SSHHost{HostName: "elsewhere", User: "default",
+			IdentityFiles: []string{"/home/me/.ssh/global"}}},
+		{name: "bad port", host: "badport", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := config.Lookup(tt.host)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveSSHEndpoint(t *testing.T) {
+	config, err := parseSSHConfig(strings.NewReader(`
+Host target
+    HostName 10.0.1.10
+    User app
+    ProxyJump outer,inner
+
+Host outer
+    HostName outer.example.com
+    User ops
+
+Host inner
+    HostName 10.0.0.4
+    User ops
+
+Host nested
+    ProxyJump target
+
+Host loop-a
+    ProxyJump loop-b
+
+Host loop-b
+    ProxyJump loop-a
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		// want lists the hosts from the target to the one dialled first,
+		// as user@host:port
+		want    []string
+		wantErr bool
+	}{
+		{name: "not in the config", spec: "me@somewhere:2200", want: []string{"me@somewhere:2200"}},
+		{name: "spec wins over the config", spec: "root@target:2222",
+			want: []string{"root@10.0.1.10:2222", "ops@10.0.0.4:22", "ops@outer.example.com:22"}},
+		{name: "ProxyJump chain", spec: "target",
+			want: []string{"app@10.0.1.10:22", "ops@10.0.0.4:22", "ops@outer.example.com:22"}},
+		{name: "ProxyJump through a host with its own ProxyJump", spec: "me@nested",
+			want: []string{"me@nested:22", "app@10.0.1.10:22", "ops@10.0.0.4:22", "ops@outer.example.com:22"}},
+		{name: "ProxyJump loop", spec: "loop-a", wantErr: true},
+		{name: "bad spec", spec: "host:ssh", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint, err := ResolveSSHEndpoint(tt.spec, config, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", endpoint.Address())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for e := endpoint; e != nil; e = e.ProxyJump {
+				got = append(got, e.Address())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
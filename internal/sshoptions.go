@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	ini "gopkg.in/ini.v1"
+)
+
+// DefaultSSHTimeout bounds connecting to and handshaking with a bastion, so
+// a blackholed address fails rather than hanging
+const DefaultSSHTimeout = 30 * time.Second
+
+// Algorithms understood by golang.org/x/crypto/ssh, used to catch typos
+var (
+	knownCiphers = []string{
+		"aes128-ctr", "aes192-ctr", "aes256-ctr", "aes128-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com", "arcfour256", "arcfour128", "arcfour",
+		"aes128-cbc", "3des-cbc",
+	}
+	knownKeyExchanges = []string{
+		"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256", "ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521", "diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	knownMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256", "hmac-sha1", "hmac-sha1-96",
+	}
+	knownHostKeyAlgorithms = []string{
+		ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+	}
+)
+
+// SSHOptions tunes the SSH connection to a bastion. Empty fields keep the
+// ssh package's defaults.
+type SSHOptions struct {
+	// Timeout bounds the TCP connection and the SSH handshake
+	Timeout           time.Duration
+	Ciphers           []string
+	KeyExchanges      []string
+	MACs              []string
+	HostKeyAlgorithms []string
+	// ClientVersion is sent to the server, and must start with SSH-2.0-
+	ClientVersion string
+	// RekeyThreshold is how many bytes are sent before keys are renegotiated
+	RekeyThreshold uint64
+}
+
+// ParseSSHOptions reads options from name/value pairs, as found in a section
+// of an SSH options file. The names are timeout, ciphers, kex, macs,
+// host-key-algorithms, client-version and rekey-threshold. Lists are comma
+// separated.
+func ParseSSHOptions(values map[string]string) (SSHOptions, error) {
+	o := SSHOptions{}
+	for name, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		var err error
+		switch name {
+		case "timeout":
+			o.Timeout, err = time.ParseDuration(value)
+		case "ciphers":
+			o.Ciphers, err = parseAlgorithms(value, knownCiphers)
+		case "kex":
+			o.KeyExchanges, err = parseAlgorithms(value, knownKeyExchanges)
+		case "macs":
+			o.MACs, err = parseAlgorithms(value, knownMACs)
+		case "host-key-algorithms":
+			o.HostKeyAlgorithms, err = parseAlgorithms(value, knownHostKeyAlgorithms)
+		case "client-version":
+			o.ClientVersion = value
+			if !strings.HasPrefix(o.ClientVersion, "SSH-2.0-") {
+				o.ClientVersion = "SSH-2.0-" + o.ClientVersion
+			}
+		case "rekey-threshold":
+			o.RekeyThreshold, err = parseByteSize(value)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return o, fmt.Errorf("invalid SSH option %s=%s: %v", name, value, err)
+		}
+	}
+	return o, nil
+}
+
+func parseAlgorithms(value string, known []string) ([]string, error) {
+	var algorithms []string
+	for _, a := range strings.Split(value, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		found := false
+		for _, k := range known {
+			if k == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported algorithm %q, expected some of %s", a, strings.Join(known, ", "))
+		}
+		algorithms = append(algorithms, a)
+	}
+	return algorithms, nil
+}
+
+// parseByteSize parses a number of bytes with an optional K, M or G suffix
+func parseByteSize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// Merge returns o with every field set in other overriding it
+func (o SSHOptions) Merge(other SSHOptions) SSHOptions {
+	if other.Timeout != 0 {
+		o.Timeout = other.Timeout
+	}
+	if other.Ciphers != nil {
+		o.Ciphers = other.Ciphers
+	}
+	if other.KeyExchanges != nil {
+		o.KeyExchanges = other.KeyExchanges
+	}
+	if other.MACs != nil {
+		o.MACs = other.MACs
+	}
+	if other.HostKeyAlgorithms != nil {
+		o.HostKeyAlgorithms = other.HostKeyAlgorithms
+	}
+	if other.ClientVersion != "" {
+		o.ClientVersion = other.ClientVersion
+	}
+	if other.RekeyThreshold != 0 {
+		o.RekeyThreshold = other.RekeyThreshold
+	}
+	return o
+}
+
+// apply copies the options into an SSH client config
+func (o *SSHOptions) apply(config *ssh.ClientConfig) {
+	if o == nil {
+		config.Timeout = DefaultSSHTimeout
+		return
+	}
+	config.Timeout = o.Timeout
+	if config.Timeout == 0 {
+		config.Timeout = DefaultSSHTimeout
+	}
+	config.Ciphers = o.Ciphers
+	config.KeyExchanges = o.KeyExchanges
+	config.MACs = o.MACs
+	config.HostKeyAlgorithms = o.HostKeyAlgorithms
+	config.ClientVersion = o.ClientVersion
+	config.RekeyThreshold = o.RekeyThreshold
+}
+
+// describeSSHConfig summarises the connection settings of config for
+// verbose logging
+func describeSSHConfig(config *ssh.ClientConfig) string {
+	orDefault := func(values []string) string {
+		if len(values) == 0 {
+			return "default"
+		}
+		return strings.Join(values, ",")
+	}
+	version := config.ClientVersion
+	if version == "" {
+		version = "default"
+	}
+	rekey := "default"
+	if config.RekeyThreshold != 0 {
+		rekey = strconv.FormatUint(config.RekeyThreshold, 10)
+	}
+	return fmt.Sprintf("user=%s timeout=%s ciphers=%s kex=%s macs=%s host-key-algorithms=%s "+
+		"client-version=%s rekey-threshold=%s",
+		config.User, config.Timeout, orDefault(config.Ciphers), orDefault(config.KeyExchanges),
+		orDefault(config.MACs), orDefault(config.HostKeyAlgorithms), version, rekey)
+}
+
+// SSHOptionsFile holds per bastion SSH options read from an INI file.
+// Options at the top of the file or in a [default] section apply to every
+// bastion, and sections named after a host, instance ID or Name tag
+// override them.
+type SSHOptionsFile struct {
+	file *ini.File
+}
+
+// LoadSSHOptionsFile reads an SSH options file. A missing file is treated
+// as an empty one.
+func LoadSSHOptionsFile(path string) (*SSHOptionsFile, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return &SSHOptionsFile{}, nil
+	}
+	file, err := ini.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &SSHOptionsFile{file: file}
+	// Check every section now, rather than when a bastion is picked
+	for _, s := range file.Sections() {
+		if _, err := ParseSSHOptions(s.KeysHash()); err != nil {
+			return nil, fmt.Errorf("[%s]: %v", s.Name(), err)
+		}
+	}
+	return f, nil
+}
+
+// For returns the options for a bastion known by any of names, the default
+// section overridden by the first section matching one of them
+func (f *SSHOptionsFile) For(names ...string) SSHOptions {
+	if f == nil || f.file == nil {
+		return SSHOptions{}
+	}
+	// Sections were checked when the file was loaded
+	options, _ := ParseSSHOptions(f.file.Section(ini.DefaultSection).KeysHash())
+	defaults, _ := ParseSSHOptions(f.file.Section("default").KeysHash())
+	options = options.Merge(defaults)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if s, err := f.file.GetSection(name); err == nil {
+			override, _ := ParseSSHOptions(s.KeysHash())
+			return options.Merge(override)
+		}
+	}
+	return options
+}
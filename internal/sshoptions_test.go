@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSSHOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    SSHOptions
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "blank values", values: map[string]string{"timeout": " ", "ciphers": ""}},
+		{name: "everything", values: map[string]string{
+			"timeout":             "5s",
+			"ciphers":             "aes256-ctr, chacha20-poly1305@openssh.com",
+			"kex":                 "curve25519-sha256@libssh.org",
+			"macs":                "hmac-sha2-256,",
+			"host-key-algorithms": "ssh-ed25519",
+			"client-version":      "SSH-2.0-tunneller",
+			"rekey-threshold":     "512M",
+		}, want: SSHOptions{
+			Timeout:           5 * time.Second,
+			Ciphers:           []string{"aes256-ctr", "chacha20-poly1305@openssh.com"},
+			KeyExchanges:      []string{"curve25519-sha256@libssh.org"},
+			MACs:              []string{"hmac-sha2-256"},
+			HostKeyAlgorithms: []string{"ssh-ed25519"},
+			ClientVersion:     "SSH-2.0-tunneller",
+			RekeyThreshold:    512 << 20,
+		}},
+		{name: "client version prefix", values: map[string]string{"client-version": "OpenSSH_8.9"},
+			want: SSHOptions{ClientVersion: "SSH-2.0-OpenSSH_8.9"}},
+		{name: "rekey in bytes", values: map[string]string{"rekey-threshold": "1000"}, want: SSHOptions{RekeyThreshold: 1000}},
+		{name: "rekey in kilobytes", values: map[string]string{"rekey-threshold": "64k"}, want: SSHOptions{RekeyThreshold: 64 << 10}},
+		{name: "rekey in gigabytes", values: map[string]string{"rekey-threshold": "1G"}, want: SSHOptions{RekeyThreshold: 1 << 30}},
+		{name: "bad rekey", values: map[string]string{"rekey-threshold": "lots"}, wantErr: true},
+		{name: "bad timeout", values: map[string]string{"timeout": "30"}, wantErr: true},
+		{name: "unknown cipher", values: map[string]string{"ciphers": "aes256-ctr,aes512-ctr"}, wantErr: true},
+		{name: "kex in the MACs", values: map[string]string{"macs": "ecdh-sha2-nistp256"}, wantErr: true},
+		{name: "unknown option", values: map[string]string{"compression": "yes"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSSHOptions(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSSHOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseSSHOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSSHOptionsFileFor(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ssh-options")
+	err := ioutil.WriteFile(file, []byte(`
+timeout = 10s
+client-version = tunneller
+
+[default]
+timeout = 20s
+ciphers = aes256-ctr
+
+[i-0123abcd]
+ciphers = aes128-ctr
+rekey-threshold = 1M
+
+[bastion.example.com]
+timeout = 5s
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := LoadSSHOptionsFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		names []string
+		want  SSHOptions
+	}{
+		{name: "defaults", names: []string{"other.example.com"},
+			want: SSHOptions{Timeout: 20 * time.Second, Ciphers: []string{"aes256-ctr"}, ClientVersion: "SSH-2.0-tunneller"}},
+		{name: "instance ID", names: []string{"", "i-0123abcd", "bastion.example.com"},
+			want: SSHOptions{Timeout: 20 * time.Second, Ciphers: []string{"aes128-ctr"},
+				ClientVersion: "SSH-2.0-tunneller", RekeyThreshold: 1 << 20}},
+		{name: "host", names: []string{"bastion.example.com"},
+			want: SSHOptions{Timeout: 5 * time.Second, Ciphers: []string{"aes256-ctr"}, ClientVersion: "SSH-2.0-tunneller"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := options.For(tt.names...); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("For() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		options, err := LoadSSHOptionsFile(filepath.Join(t.TempDir(), "missing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := options.For("bastion.example.com"); !reflect.DeepEqual(got, SSHOptions{}) {
+			t.Fatalf("For() = %+v, want no options", got)
+		}
+	})
+	t.Run("bad section", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "ssh-options")
+		if err := ioutil.WriteFile(bad, []byte("[bastion]\nciphers = rot13\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSSHOptionsFile(bad); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}